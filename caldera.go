@@ -5,9 +5,13 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -15,18 +19,19 @@ import (
 	"github.com/juliofaura/caldera/data"
 	"github.com/juliofaura/caldera/server"
 	"github.com/juliofaura/oilmeter/files"
-	rpio "github.com/stianeikeland/go-rpio"
 )
 
 const (
-	timeInterval   = 1 * time.Minute
-	sensorRetry    = 3 * time.Second
-	maxSensorRetry = 1 * time.Minute
 	tempFormatter  = "\033[1;33m%.2f\033[0m"
 	errorFormatter = "\033[1;31m%v\033[0m"
 )
 
-var ()
+var (
+	simulate   = flag.Bool("simulate", false, "use simulated relays and inputs instead of the GPIO pins (for running off the Raspberry Pi)")
+	configFile = flag.String("config", data.ConfigFileName, "config file")
+	// Not a positional argument, which would be taken for the web port
+	historyQuery = flag.String("history", "", "print the recorded history and exit, e.g. \"24h now 1h\" (from, to and an optional step)")
+)
 
 func check(e error) {
 	if e != nil {
@@ -34,46 +39,57 @@ func check(e error) {
 	}
 }
 
-func printStatus() {
-	data.ReadPower()
-	data.ReadHeat()
-	data.ReadTemp()
+func printStatus(st data.StateT) {
 	fmt.Print("# Power should be ")
-	if data.PowerOn {
+	if st.PowerOn {
 		fmt.Print(data.ON)
 	} else {
 		fmt.Print(data.OFF)
 	}
 	fmt.Print(" (and is ")
-	if data.PowerReading {
+	if st.PowerReading {
 		fmt.Println(data.ON, ")")
 	} else {
 		fmt.Println(data.OFF, ")")
 	}
 
-	if data.ErrorInTemp {
-		fmt.Printf(errorFormatter, "# Error reading current temperature, reference sensor is "+data.Sensor+"\n")
+	if st.ErrorInTemp {
+		fmt.Printf(errorFormatter, "# Error reading current temperature, reference is "+st.Reference()+"\n")
 	} else {
-		fmt.Printf("# Current temperature is "+tempFormatter+" (reference sensor is %v)\n", data.CurrentTemp, data.Sensor)
+		fmt.Printf("# Current temperature is "+tempFormatter+" (reference is %v)\n", st.CurrentTemp, st.Reference())
+	}
+	for _, s := range st.Sensors {
+		if s.ErrorInTemp {
+			fmt.Printf("#   - %v (weight %v): "+errorFormatter+"\n", s.Name, s.Weight, "error")
+		} else {
+			fmt.Printf("#   - %v (weight %v): "+tempFormatter+"\n", s.Name, s.Weight, s.Temp)
+		}
 	}
 
-	if data.PowerOn {
+	if st.PowerOn {
 		fmt.Print("# Thermostat control is ")
-		if !data.ThermostatOn {
+		if !st.ThermostatOn {
 			fmt.Println(data.OFF)
 		} else {
 			fmt.Println(data.ON)
 		}
-		fmt.Printf("# Target temperature is "+tempFormatter+"\n", data.TargetTemp)
-		fmt.Printf("# Hystheresis is "+tempFormatter+"\n", data.Hysteresis)
+		fmt.Printf("# Target temperature is "+tempFormatter+"\n", st.TargetTemp)
+		if st.Away != nil {
+			now := time.Now()
+			fmt.Printf("# Away from %v to %v, frost protection at "+tempFormatter+", pre-heat %v\n", st.Away.From.Format(data.AwayDateFormat), st.Away.To.Format(data.AwayDateFormat), st.Away.FrostTemp, st.Away.Preheat)
+			if st.AwayActive(now) {
+				fmt.Printf("# Now away, controlling to "+tempFormatter+"\n", st.EffectiveTarget(now))
+			}
+		}
+		fmt.Printf("# Hystheresis is "+tempFormatter+"\n", st.Hysteresis)
 		fmt.Print("# Heat should be ")
-		if data.HeatOn {
+		if st.HeatOn {
 			fmt.Print(data.ON)
 		} else {
 			fmt.Print(data.OFF)
 		}
 		fmt.Print(" (and is ")
-		if data.HeatReading {
+		if st.HeatReading {
 			fmt.Println(data.ON, ")")
 		} else {
 			fmt.Println(data.OFF, ")")
@@ -81,20 +97,251 @@ func printStatus() {
 	}
 }
 
-func main() {
+// printHistory prints the samples, one per line
+func printHistory(samples []data.SampleT) {
+	fmt.Println("time                 samples   temp target  hyst  heat  read power  read sensors")
+	for _, v := range samples {
+		temp := "     -"
+		if v.TempOK {
+			temp = fmt.Sprintf("%6.2f", v.Temp)
+		}
+		var sensors []string
+		for name, t := range v.Sensors {
+			sensors = append(sensors, fmt.Sprintf("%v=%.2f", name, t))
+		}
+		sort.Strings(sensors)
+		fmt.Printf("%v %7d %v %6.2f %5.2f %5.2f %5.2f %5.2f %5.2f %v\n", v.Time.Format("2006-01-02 15:04:05"), v.N, temp, v.Target, v.Hysteresis, v.Heat, v.HeatReading, v.Power, v.PowerRead, strings.Join(sensors, " "))
+	}
+}
 
-	args := os.Args
-	if len(args) >= 2 {
-		server.WEBPORT = args[1]
+// queryHistory runs the history command: history <from> <to> [<step>]
+func queryHistory(history *data.History, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errors.New("wrong syntax, should be: history <from> <to> [<step>]")
 	}
-	server.HEADER_PAGE_TITLE = "Caldera control and report page"
-	log.Printf("Initializing %s with web port='%v'", args[0], server.WEBPORT)
-	server.StartWeb()
-	files.WorkingDir = "/home/pi/Gasoleo/"
-	// files.WorkingDir = "/Users/julio/Dropbox/Gasoleo/"
-	files.DataFile = files.WorkingDir + "data.txt"
-	// files.GraphFile = files.WorkingDir + "graph.png"
-	files.AverageFile = files.WorkingDir + "oilaverage.txt"
+	now := time.Now()
+	from, err := data.ParseHistoryTime(args[0], now)
+	if err != nil {
+		return err
+	}
+	to, err := data.ParseHistoryTime(args[1], now)
+	if err != nil {
+		return err
+	}
+	var step time.Duration
+	if len(args) == 3 {
+		if step, err = time.ParseDuration(args[2]); err != nil || step < 0 {
+			return errors.New("wrong step " + args[2])
+		}
+	}
+	samples, err := history.Query(from, to, step)
+	if err != nil {
+		return err
+	}
+	printHistory(samples)
+	return nil
+}
+
+// consoleActor is whoever runs the console, for the audit log
+func consoleActor() data.ActorT {
+	name := os.Getenv("USER")
+	if name == "" {
+		name = "console"
+	}
+	return data.ActorT{Name: name, Source: data.SourceConsole}
+}
+
+// queryAudit runs the audit command: audit [<n>] [<filter>]
+func queryAudit(audit *data.AuditLog, args []string) error {
+	n := 20
+	if len(args) >= 1 {
+		if v, err := strconv.Atoi(args[0]); err == nil {
+			n, args = v, args[1:]
+		}
+	}
+	if len(args) > 1 || n <= 0 {
+		return errors.New("wrong syntax, should be: audit [<n>] [<filter>]")
+	}
+	filter := ""
+	if len(args) == 1 {
+		filter = args[0]
+	}
+	entries, err := audit.Query(n, filter)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		who := e.Actor + " (" + e.Source
+		if e.IP != "" {
+			who += " " + e.IP
+		}
+		fmt.Printf("%v %v) %v: %v -> %v\n", e.Time.Format("2006-01-02 15:04:05"), who, e.Action, e.Old, e.New)
+	}
+	return nil
+}
+
+// printBurner runs the burner command
+func printBurner(burner *data.BurnerLog) error {
+	datums, err := data.ReadOilDatums()
+	if err != nil {
+		return err
+	}
+	r := data.BurnerReport(burner, datums, time.Now())
+	fmt.Println("period     from         hours   liters     cost")
+	for _, p := range r.Periods {
+		fmt.Printf("%-10v %v %7.1f %8.1f %8.2f\n", p.Name, p.From.Format("2006-01-02"), p.Hours, p.Liters, p.Cost)
+	}
+	if r.LitersPerHour == 0 {
+		fmt.Printf("Not enough data yet to know the liters per burner hour (%.1f hours and %.1f liters since %v)\n", r.RateHours, r.RateLiters, r.RateFrom.Format("2006-01-02"))
+		return nil
+	}
+	fmt.Printf("%.2f liters per burner hour (%.1f liters in %.1f hours since %v)\n", r.LitersPerHour, r.RateLiters, r.RateHours, r.RateFrom.Format("2006-01-02"))
+	fmt.Printf("This month estimated at %.0f liters, costing %.2f at %.3f per liter\n", r.MonthLiters, r.MonthCost, data.OilPrice)
+	return nil
+}
+
+// printForecast runs the forecast command
+func printForecast(history *data.History) error {
+	datums, err := data.ReadOilDatums()
+	if err != nil {
+		return err
+	}
+	f, ok := data.OilForecast(history, datums, time.Now())
+	if !ok {
+		return errors.New("no oil data")
+	}
+	based := "the consumption of each month"
+	if f.Outdoor {
+		based += " and the outdoor temperature"
+	}
+	fmt.Printf("%.0f liters on %v, now burning %.1f liters/day (by %v, band %.0f%% to %.0f%%)\n", f.Liters, f.From.Format("2006-01-02 15:04"), f.Rate, based, f.Band[0]*100, f.Band[1]*100)
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return fmt.Sprintf("beyond %v days", data.ForecastDays)
+		}
+		return t.Format("2006-01-02")
+	}
+	for _, l := range f.Levels {
+		if l.Reached {
+			fmt.Printf("%-8v (%4.0f liters): already reached\n", l.Name, l.Liters)
+			continue
+		}
+		fmt.Printf("%-8v (%4.0f liters): %v, between %v and %v\n", l.Name, l.Liters, date(l.Date), date(l.Earliest), date(l.Latest))
+	}
+	return nil
+}
+
+// printRefills runs the refills command
+func printRefills(refills *data.RefillStore) error {
+	datums, err := data.ReadOilDatums()
+	if err != nil {
+		return err
+	}
+	if _, err := refills.Update(datums); err != nil {
+		return err
+	}
+	periods := data.RefillPeriods(refills.List(), datums)
+	if len(periods) == 0 {
+		fmt.Println("No refills detected")
+	}
+	for _, p := range periods {
+		fmt.Printf("%v: %.0f liters (%.0f to %.0f)", p.Refill.Time.Format("2006-01-02 15:04"), p.Refill.Liters(), p.Refill.Before, p.Refill.After)
+		if p.Refill.Price > 0 {
+			fmt.Printf(", paid %.2f (%.3f per liter)", p.Refill.Price, p.Refill.PricePerLiter())
+		}
+		if !p.Complete {
+			fmt.Println(", no oil data of the whole period")
+			continue
+		}
+		fmt.Printf(", then %.0f liters burnt in %.0f days (%.1f liters/day)", p.Consumed, p.Days, p.PerDay)
+		if p.Refill.Price > 0 {
+			fmt.Printf(" costing %.2f", p.Cost)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// printDegreeDays runs the degreeDays command
+func printDegreeDays(history *data.History) error {
+	datums, err := data.ReadOilDatums()
+	if err != nil {
+		return err
+	}
+	if len(datums) == 0 {
+		return errors.New("no oil data")
+	}
+	temps := data.OutdoorTemps(history, time.Unix(datums[0].Timestamp, 0), time.Now())
+	if temps == nil {
+		return errors.New("no outdoor temperature, set oil outdoor_sensor or outdoor_file in the config")
+	}
+	printPeriods := func(periods []data.DegreeDayPeriodT) {
+		fmt.Println("period    liters  degree days  mean temp  coverage  liters/degree day")
+		for _, p := range periods {
+			perDD := "                 -"
+			if p.LitersPerDD > 0 {
+				perDD = fmt.Sprintf("%18.2f", p.LitersPerDD)
+			}
+			fmt.Printf("%-9v %6.0f %12.0f %10.1f %8.0f%% %v\n", p.Name, p.Liters, p.DegreeDays, p.MeanTemp, p.Coverage*100, perDD)
+		}
+	}
+	fmt.Printf("Degree days below %.1f degrees\n", data.DegreeDayBase)
+	printPeriods(data.DegreeDayMonths(datums, temps))
+	fmt.Println()
+	printPeriods(data.DegreeDaySeasons(datums, temps))
+	return nil
+}
+
+// printSeasons runs the seasons command
+func printSeasons() error {
+	datums, err := data.ReadOilDatums()
+	if err != nil {
+		return err
+	}
+	seasons := data.OilSeasons(datums)
+	if len(seasons) == 0 {
+		return errors.New("no oil data")
+	}
+	fmt.Print("month")
+	for _, s := range seasons {
+		fmt.Printf(" %9v", s.Name)
+	}
+	fmt.Println()
+	for i, m := range data.SeasonMonths {
+		fmt.Printf("%-5v", m.String()[:3])
+		for _, s := range seasons {
+			if s.Days[i] == 0 {
+				fmt.Printf(" %9v", "-")
+				continue
+			}
+			fmt.Printf(" %9.0f", s.Liters[i])
+		}
+		fmt.Println()
+	}
+	fmt.Print("total")
+	for _, s := range seasons {
+		fmt.Printf(" %9.0f", s.Total)
+	}
+	fmt.Println()
+	current := seasons[len(seasons)-1]
+	if !current.Complete {
+		fmt.Println("No oil data since the start of", current.Name)
+		return nil
+	}
+	day := len(current.Cumulative) - 1
+	now, _ := current.CumulativeAt(day)
+	for _, s := range seasons[:len(seasons)-1] {
+		if liters, ok := s.CumulativeAt(day); ok && liters > 0 {
+			fmt.Printf("Up to %v: %v burnt %.0f liters, %v %.0f (%+.0f%%)\n", current.LastDay().Format("01-02"), current.Name, now, s.Name, liters, (now-liters)/liters*100)
+		}
+	}
+	return nil
+}
+
+func main() {
+
+	flag.Parse()
+	data.ConfigFileName = *configFile
 
 	executable, err := os.Executable()
 	check(err)
@@ -111,151 +358,617 @@ func main() {
 	log.Println("Starting thermostat and all")
 	defer logfile.Close()
 
-	log.Println("Configuring rpio ...")
-	check(rpio.Open())
-	data.PowerPin1.Output()
-	data.PowerPin2.Output()
-	defer data.PowerPin1.Input()
-	defer data.PowerPin2.Input()
-	data.HeatPin.Output()
-	defer data.HeatPin.Input()
-	data.ReadPowerPin.Input()
-	data.ReadPowerPin.PullUp()
-	data.ReadHeatPin.Input()
-	data.ReadHeatPin.PullUp()
-	log.Println("Done configuring rpio ...")
-
-	data.ReadConfig()
-
-	if data.PowerOn {
-		data.SetPower(data.ON)
-	} else {
-		data.SetPower(data.OFF)
+	ctl := data.NewController()
+	if err := ctl.Load(); err != nil {
+		log.Println("Error in the config:", err)
+		fmt.Printf(errorFormatter+"\n", "Error in the config, please fix it and start again:\n"+err.Error())
+		os.Exit(1)
+	}
+
+	history, err := data.OpenHistory(data.HistoryDir)
+	if err != nil {
+		log.Println("Error opening the history:", err)
+		fmt.Printf(errorFormatter+"\n", "Error opening the history: "+err.Error())
+		os.Exit(1)
+	}
+
+	// Just querying the history, e.g. caldera -history "24h now 1h"
+	if *historyQuery != "" {
+		if err := queryHistory(history, strings.Fields(*historyQuery)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	users, err := data.OpenUsers(data.UsersFileName)
+	if err != nil {
+		log.Println("Error opening the users:", err)
+		fmt.Printf(errorFormatter+"\n", "Error opening the users: "+err.Error())
+		os.Exit(1)
+	}
+	if u, ok := users.Get(data.DefaultLogin); ok && u.MustChangePassword {
+		fmt.Printf("The web user %v has a temporary password (%v by default), it has to be changed on the first login\n", u.Login, data.DefaultPassword)
+	}
+
+	tokens, err := data.OpenTokens(data.TokensFileName)
+	if err != nil {
+		log.Println("Error opening the API tokens:", err)
+		fmt.Printf(errorFormatter+"\n", "Error opening the API tokens: "+err.Error())
+		os.Exit(1)
 	}
-	if data.HeatOn {
-		data.SetHeat(data.ON)
+
+	audit, err := data.OpenAudit(data.AuditFileName)
+	if err != nil {
+		log.Println("Error opening the audit log:", err)
+		fmt.Printf(errorFormatter+"\n", "Error opening the audit log: "+err.Error())
+		os.Exit(1)
+	}
+	ctl.SetAudit(audit)
+
+	alerts, err := data.OpenAlerts(data.AlertsFileName, data.Notifiers)
+	if err != nil {
+		log.Println("Error opening the alerts:", err)
+		fmt.Printf(errorFormatter+"\n", "Error opening the alerts: "+err.Error())
+		os.Exit(1)
+	}
+
+	burner, err := data.OpenBurner(data.BurnerFileName)
+	if err != nil {
+		log.Println("Error opening the burner log:", err)
+		fmt.Printf(errorFormatter+"\n", "Error opening the burner log: "+err.Error())
+		os.Exit(1)
+	}
+	ctl.SetBurner(burner)
+
+	refills, err := data.OpenRefills(data.RefillsFileName)
+	if err != nil {
+		log.Println("Error opening the refills:", err)
+		fmt.Printf(errorFormatter+"\n", "Error opening the refills: "+err.Error())
+		os.Exit(1)
+	}
+
+	// The oil data and the relays before the web and MQTT, which use them
+	files.DataFile = data.OilDataFile
+	files.AverageFile = data.OilAverageFile
+	files.WorkingDir = filepath.Dir(data.OilDataFile) + "/"
+
+	if *simulate {
+		data.OpenSimulated()
 	} else {
-		data.SetHeat(data.OFF)
+		log.Println("Configuring rpio ...")
+		check(data.OpenRPIO())
+		defer data.CloseRPIO()
+		log.Println("Done configuring rpio ...")
+	}
+
+	st := ctl.Snapshot()
+	ctl.SetPower(st.PowerOn)
+	if err := ctl.SetHeat(st.HeatOn); err != nil {
+		fmt.Printf(errorFormatter+"\n", "Error saving the config: "+err.Error())
 	}
 
-	data.WriteConfig()
+	server.WEBPORT = data.WebPort
+	if flag.NArg() >= 1 {
+		server.WEBPORT = flag.Arg(0)
+	}
+	server.HEADER_PAGE_TITLE = "Caldera control and report page"
+	server.WEBTLS, server.WEBREDIRECTPORT = data.WebTLS, data.WebRedirectPort
+	server.WEBCERTFILE, server.WEBKEYFILE = data.WebCertFile, data.WebKeyFile
+	log.Printf("Initializing %s with web port='%v' (TLS %v)", os.Args[0], server.WEBPORT, server.WEBTLS)
+	server.StartWeb(ctl, history, users, tokens, audit, alerts, burner, refills)
+	if err := server.StartMQTT(); err != nil {
+		log.Println("Error starting MQTT:", err)
+		fmt.Printf(errorFormatter+"\n", "Error starting MQTT: "+err.Error())
+	}
 
 	// Thermostat loop
 	go func() {
-		nextRetry := sensorRetry
 		for {
-			data.ReadPower()
-			data.ReadHeat()
-			data.ReadTemp()
-			if data.ErrorInTemp {
-				// Oops, there has been an error measuring the temperature
-				if data.ThermostatOn {
-					data.SetHeat(data.OFF)
-				}
-				time.Sleep(nextRetry)
-				nextRetry = (nextRetry * 3) / 2 // So we increase the wait time progressively in cummulative errors
-				if nextRetry > maxSensorRetry {
-					nextRetry = maxSensorRetry
-				}
+			ctl.Refresh()
+			now := time.Now()
+			ok := ctl.Control(now)
+			st := ctl.Snapshot()
+			if err := history.Record(st.Sample(now)); err != nil {
+				log.Println("Error recording the history:", err)
+			}
+			alerts.CheckControl(st, ctl.Stats(), now)
+			if !ok {
+				time.Sleep(ctl.RetryDelay()) // Increasing progressively in cummulative errors
 				continue
-			} else {
-				nextRetry = sensorRetry
 			}
-			log.Println("Current temp is ", data.CurrentTemp)
-			if data.PowerReading && data.ThermostatOn {
-				if data.CurrentTemp <= data.TargetTemp-data.Hysteresis && !data.HeatOn {
-					data.SetHeat(data.ON)
-				} else if data.CurrentTemp >= data.TargetTemp+data.Hysteresis && data.HeatOn {
-					data.SetHeat(data.OFF)
-				}
-			} else if data.PowerReading && !data.ThermostatOn && data.HeatOn {
-				data.SetHeat(data.OFF)
+			time.Sleep(data.TimeInterval)
+		}
+	}()
+
+	// Oil alerts and refills
+	go func() {
+		for {
+			alerts.CheckOil(time.Now())
+			if datums, err := data.ReadOilDatums(); err == nil {
+				if _, err := refills.Update(datums); err != nil {
+					log.Println("Error saving the refills:", err)
+				}
 			}
-			time.Sleep(timeInterval)
+			time.Sleep(data.OilCheckInterval)
 		}
 	}()
 
 	time.Sleep(2 * time.Second) // This just to let time to the thermostat loop to read the initial value of the temperature
-	printStatus()
+	printStatus(ctl.Status())
 	fmt.Println()
 
 	// Console loop
+	console := consoleActor()
+	change := func(action string, f func() error) error { return ctl.Change(console, action, f) }
+	reader := bufio.NewReader(os.Stdin)
 	for {
-		reader := bufio.NewReader(os.Stdin)
 		fmt.Print("\nControl console: ")
 
-		s, _ := reader.ReadString('\n')
+		s, err := reader.ReadString('\n')
+		if err != nil && s == "" {
+			// Stdin closed (e.g. running detached), keep serving the web
+			select {}
+		}
 		command := strings.Fields(s)
 		str := ""
 		if len(command) >= 1 {
 			switch command[0] {
 			case "exit":
 				fmt.Println("Have a nice day!")
-				log.Println("Ending program, closing log\n\n")
+				log.Print("Ending program, closing log\n\n")
 				os.Exit(0)
 			case "status":
-				printStatus()
+				printStatus(ctl.Status())
 			case "changeTemp":
 				if len(command) != 2 {
 					fmt.Println("Missing target temperature, syntax is: changeTemp <temp>")
 					continue
 				}
-				oldTemp := data.TargetTemp
+				oldTemp := ctl.Snapshot().TargetTemp
 				newTemp, err := strconv.ParseFloat(command[1], 64)
 				if err != nil {
 					fmt.Println("Wrong target temperature: ", command[1])
 					continue
 				}
-				data.TargetTemp = newTemp
-				str = fmt.Sprintf("Target temperature changed, old temparture was %.2f, new temperature is %.2f", oldTemp, data.TargetTemp)
+				if err := change("target", func() error { return ctl.SetTarget(newTemp, time.Now()) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				st := ctl.Snapshot()
+				str = fmt.Sprintf("Target temperature changed, old temparture was %.2f, new temperature is %.2f", oldTemp, st.TargetTemp)
+				if st.Override != nil {
+					str += " (until " + st.Override.Until.Format("Mon 15:04") + ")"
+				}
 			case "changeHyst":
 				if len(command) != 2 {
 					fmt.Println("Missing hysteresis, syntax is: changeTemp <hyst>")
 					continue
 				}
-				oldHyst := data.Hysteresis
+				oldHyst := ctl.Snapshot().Hysteresis
 				newHyst, err := strconv.ParseFloat(command[1], 64)
 				if err != nil {
 					fmt.Println("Wrong hystheresis: ", command[1])
 					continue
 				}
-				data.Hysteresis = newHyst
+				if err := change("hysteresis", func() error { return ctl.SetHysteresis(newHyst) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
 				str = fmt.Sprintf("Hystheresis changed, old hysteresis was %.2f, new hysteresis is %.2f", oldHyst, newHyst)
 			case "changeSensor":
 				if len(command) != 2 {
 					fmt.Println("Missing new sensor, syntax is: changeSensor <sensor>")
 					continue
 				}
-				oldSensor := data.Sensor
-				data.Sensor = command[1]
+				oldSensor := ctl.Snapshot().Sensor
+				if err := change("sensor", func() error { return ctl.SetSensor(command[1]) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
 				str = "Sensor changed, old sensor was " + oldSensor + ", new sensor is " + command[1]
-				data.ReadTemp()
+			case "addSensor":
+				if len(command) != 2 && len(command) != 3 {
+					fmt.Println("Wrong syntax, should be: addSensor <sensor> [<weight>]")
+					continue
+				}
+				weight := 1.0
+				if len(command) == 3 {
+					w, err := strconv.ParseFloat(command[2], 64)
+					if err != nil {
+						fmt.Println("Wrong weight: ", command[2])
+						continue
+					}
+					weight = w
+				}
+				if err := change("addSensor", func() error { return ctl.AddSensor(command[1], weight) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				str = fmt.Sprintf("Sensor %v registered with weight %v", command[1], weight)
+			case "removeSensor":
+				if len(command) != 2 {
+					fmt.Println("Missing sensor, syntax is: removeSensor <sensor>")
+					continue
+				}
+				if err := change("removeSensor", func() error { return ctl.RemoveSensor(command[1]) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				str = "Sensor " + command[1] + " removed"
+			case "changeAggregation":
+				if len(command) != 2 || !data.ValidAggregation(command[1]) {
+					fmt.Println("Wrong syntax, should be: changeAggregation <" + strings.Join(data.Aggregations, "|") + ">")
+					continue
+				}
+				oldAggregation := ctl.Snapshot().Aggregation
+				if err := change("aggregation", func() error { return ctl.SetAggregation(command[1]) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				str = "Aggregation changed, old aggregation was " + oldAggregation + ", new aggregation is " + command[1]
+			case "schedule":
+				st := ctl.Snapshot()
+				if st.ScheduleOn {
+					fmt.Println("Schedule is", data.ON)
+				} else {
+					fmt.Println("Schedule is", data.OFF)
+				}
+				for _, slot := range st.Schedule {
+					fmt.Println(slot)
+				}
+				if st.Override != nil {
+					fmt.Printf("Manual override to %.2f until %v\n", st.Override.Target, st.Override.Until.Format("Mon 15:04"))
+				}
+			case "scheduleOn":
+				if err := change("schedule", func() error { return ctl.SetScheduleOn(true, time.Now()) }); err != nil {
+					fmt.Println(err, "- add some slots first with addSlot")
+					continue
+				}
+				str = fmt.Sprintf("Schedule now on, target temperature is %.2f", ctl.Snapshot().TargetTemp)
+			case "scheduleOff":
+				if err := change("schedule", func() error { return ctl.SetScheduleOn(false, time.Now()) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				str = "Schedule now off"
+			case "addSlot":
+				if len(command) != 4 {
+					fmt.Println("Wrong syntax, should be: addSlot <days> <HH:MM> <temp>")
+					continue
+				}
+				days, err := data.ParseDays(command[1])
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				start, err := data.ParseHour(command[2])
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				target, err := strconv.ParseFloat(command[3], 64)
+				if err != nil {
+					fmt.Println("Wrong target temperature: ", command[3])
+					continue
+				}
+				if err := change("addSlot", func() error { return ctl.SetSlots(days, start, target, time.Now()) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				str = fmt.Sprintf("Slot added: %v from %v at %.2f", command[1], command[2], target)
+			case "removeSlot":
+				if len(command) != 3 {
+					fmt.Println("Wrong syntax, should be: removeSlot <days> <HH:MM>")
+					continue
+				}
+				days, err := data.ParseDays(command[1])
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				start, err := data.ParseHour(command[2])
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				removed := 0
+				err = change("removeSlot", func() (err error) {
+					removed, err = ctl.RemoveSlots(days, start, time.Now())
+					return err
+				})
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				str = fmt.Sprintf("%v slot(s) removed", removed)
+			case "away":
+				if len(command) != 4 && len(command) != 5 {
+					fmt.Println("Wrong syntax, should be: away <from> <to> <frostTemp> [<preheat hours>]")
+					continue
+				}
+				now := time.Now()
+				from, err := data.ParseAwayDate(command[1], now)
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				to, err := data.ParseAwayDate(command[2], now)
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				frostTemp, err := strconv.ParseFloat(command[3], 64)
+				if err != nil {
+					fmt.Println("Wrong frost protection temperature: ", command[3])
+					continue
+				}
+				preheatHours := 0.0
+				if len(command) == 5 {
+					preheatHours, err = strconv.ParseFloat(command[4], 64)
+					if err != nil {
+						fmt.Println("Wrong pre-heat hours: ", command[4])
+						continue
+					}
+				}
+				away := data.AwayT{From: from, To: to, FrostTemp: frostTemp, Preheat: time.Duration(preheatHours * float64(time.Hour))}
+				if err := change("away", func() error { return ctl.SetAway(away, now) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				str = fmt.Sprintf("Away from %v to %v at %.2f", command[1], command[2], frostTemp)
+			case "awayOff":
+				if err := change("awayOff", ctl.CancelAway); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				str = "Away mode cancelled"
+			case "sensors":
+				specs := ctl.Snapshot().SourceSpecs
+				if len(specs) == 0 {
+					fmt.Println("No sensor backends configured, all sensors are read with ssh")
+				}
+				for name, spec := range specs {
+					fmt.Printf("%v: %v\n", name, spec)
+				}
+			case "setSource":
+				if len(command) != 3 {
+					fmt.Println("Wrong syntax, should be: setSource <sensor> <spec>")
+					continue
+				}
+				if err := change("source", func() error { return ctl.SetSource(command[1], command[2]) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				str = "Sensor " + command[1] + " now read from " + command[2]
+			case "removeSource":
+				if len(command) != 2 {
+					fmt.Println("Missing sensor, syntax is: removeSource <sensor>")
+					continue
+				}
+				if err := change("removeSource", func() error { return ctl.RemoveSource(command[1]) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				str = "Sensor " + command[1] + " back to the default ssh backend"
+			case "history":
+				if err := queryHistory(history, command[1:]); err != nil {
+					fmt.Println(err)
+				}
+			case "audit":
+				if err := queryAudit(audit, command[1:]); err != nil {
+					fmt.Println(err)
+				}
+			case "alerts":
+				active := alerts.Active()
+				if len(active) == 0 {
+					fmt.Println("No active alerts")
+				}
+				for _, a := range active {
+					fmt.Printf("%v %v since %v: %v - %v\n", a.Level, a.Key, a.Since.Format("2006-01-02 15:04"), a.Title, a.Message)
+				}
+			case "forecast":
+				if err := printForecast(history); err != nil {
+					fmt.Println(err)
+				}
+			case "refills":
+				if err := printRefills(refills); err != nil {
+					fmt.Println(err)
+				}
+			case "refillPrice":
+				if len(command) != 3 {
+					fmt.Println("Wrong syntax, should be: refillPrice <2006-01-02> <price>")
+					continue
+				}
+				price, err := strconv.ParseFloat(command[2], 64)
+				if err != nil {
+					fmt.Println("Wrong price", command[2])
+					continue
+				}
+				old, err := refills.SetPrice(command[1], price)
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				audit.Record(console, "refillPrice", fmt.Sprintf("refills.%v.price=%v", command[1], old), fmt.Sprintf("refills.%v.price=%v", command[1], price))
+				str = fmt.Sprintf("Price of the refill of %v set to %.2f", command[1], price)
+			case "degreeDays":
+				if err := printDegreeDays(history); err != nil {
+					fmt.Println(err)
+				}
+			case "seasons":
+				if err := printSeasons(); err != nil {
+					fmt.Println(err)
+				}
+			case "burner":
+				if err := printBurner(burner); err != nil {
+					fmt.Println(err)
+				}
+			case "testAlert":
+				if err := alerts.Test(time.Now()); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				str = "Test alert sent to every notifier"
+			case "users":
+				for _, u := range users.List() {
+					pending := ""
+					if u.MustChangePassword {
+						pending = " (must change the password)"
+					}
+					fmt.Printf("%v: %v%v\n", u.Login, u.Role, pending)
+				}
+			case "addUser":
+				if len(command) != 4 {
+					fmt.Println("Wrong syntax, should be: addUser <login> <" + strings.Join(data.Roles, "|") + "> <temporary password>")
+					continue
+				}
+				if err := users.Add(command[1], command[3], command[2]); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				audit.Record(console, "addUser", "", command[1]+" as "+command[2])
+				str = "User " + command[1] + " added as " + command[2]
+			case "removeUser":
+				if len(command) != 2 {
+					fmt.Println("Missing user, syntax is: removeUser <login>")
+					continue
+				}
+				old, _ := users.Get(command[1])
+				if err := users.Remove(command[1]); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				audit.Record(console, "removeUser", command[1]+" as "+old.Role, "")
+				str = "User " + command[1] + " removed"
+			case "setRole":
+				if len(command) != 3 {
+					fmt.Println("Wrong syntax, should be: setRole <login> <" + strings.Join(data.Roles, "|") + ">")
+					continue
+				}
+				if err := users.SetRole(command[1], command[2]); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				str = "User " + command[1] + " is now " + command[2]
+			case "resetPassword":
+				if len(command) != 3 {
+					fmt.Println("Wrong syntax, should be: resetPassword <login> <temporary password>")
+					continue
+				}
+				if err := users.ResetPassword(command[1], command[2]); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				audit.Record(console, "resetPassword", "", command[1])
+				str = "Password of " + command[1] + " reset, it has to be changed on the next login"
+			case "tokens":
+				for _, t := range tokens.List() {
+					fmt.Printf("%v: %v (issued %v)\n", t.Name, t.Scope, t.Created.Format("2006-01-02 15:04"))
+				}
+			case "issueToken":
+				if len(command) != 3 {
+					fmt.Println("Wrong syntax, should be: issueToken <name> <" + strings.Join(data.Scopes, "|") + ">")
+					continue
+				}
+				secret, err := tokens.Issue(command[1], command[2], time.Now())
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				fmt.Println("Token (it will not be shown again):", secret)
+				audit.Record(console, "issueToken", "", command[1]+" with scope "+command[2])
+				str = "API token " + command[1] + " issued with scope " + command[2]
+			case "revokeToken":
+				if len(command) != 2 {
+					fmt.Println("Missing token, syntax is: revokeToken <name>")
+					continue
+				}
+				var scope string
+				for _, t := range tokens.List() {
+					if t.Name == command[1] {
+						scope = t.Scope
+					}
+				}
+				if err := tokens.Revoke(command[1]); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				audit.Record(console, "revokeToken", command[1]+" with scope "+scope, "")
+				str = "API token " + command[1] + " revoked"
 			case "pauseThermostat":
-				data.ThermostatOn = false
-				data.SetHeat(data.OFF)
+				if err := change("thermostat", func() error { return ctl.SetThermostat(false, true) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
 				str = "Thermostat function now paused (and heat stopped)"
 			case "resumeThermostat":
-				data.ThermostatOn = true
-				fmt.Printf("Thermostat function resumed\n")
+				if err := change("thermostat", func() error { return ctl.SetThermostat(true, false) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
 				str = "Thermostat function now resumed"
 			case "heaterOff":
-				data.SetHeat(data.OFF)
+				if err := change("heat", func() error { return ctl.SetHeat(false) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
 				str = "Heat manually disconnected"
 			case "heaterOn":
-				data.SetHeat(data.ON)
+				if err := change("heat", func() error { return ctl.SetHeat(true) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
 				str = "Heat manually connected"
 			case "powerOff":
-				data.SetPower(data.OFF)
+				if err := change("power", func() error { return ctl.SetPower(false) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
 				str = "Power manually disconnected"
 			case "powerOn":
-				data.SetPower(data.ON)
+				if err := change("power", func() error { return ctl.SetPower(true) }); err != nil {
+					fmt.Println(err)
+					continue
+				}
 				str = "Power manually connected"
 			case "help":
 				fmt.Println("COMMANDS:")
 				fmt.Println("status - prints current status")
-				fmt.Println("changeTemp <temp> - sets a new target temperature, e.g. 21.5")
+				fmt.Println("changeTemp <temp> - sets a new target temperature, e.g. 21.5 (with the schedule on, only until the next slot)")
 				fmt.Println("changeHyst <hyst> - sets a new hysteresis, e.g. 0.1")
 				fmt.Println("changeSensor <sensor> - sets a new refernce temperature sensor, e.g. \"salon\"")
+				fmt.Println("addSensor <sensor> [<weight>] - registers a sensor for the aggregated temperature (weight defaults to 1)")
+				fmt.Println("removeSensor <sensor> - unregisters a sensor")
+				fmt.Println("changeAggregation <policy> - sets how the reference temperature is computed: " + strings.Join(data.Aggregations, ", "))
+				fmt.Println("schedule - prints the weekly program")
+				fmt.Println("scheduleOn - makes the weekly program drive the target temperature")
+				fmt.Println("scheduleOff - back to a fixed target temperature")
+				fmt.Println("addSlot <days> <HH:MM> <temp> - adds a slot to the program, days is e.g. mon, mon-fri, sat,sun, all, weekdays or weekend")
+				fmt.Println("removeSlot <days> <HH:MM> - removes slots from the program")
+				fmt.Println("away <from> <to> <frostTemp> [<preheat hours>] - away mode, dates are now, 2006-01-02 or 2006-01-02T15:04")
+				fmt.Println("awayOff - cancels the away mode")
+				fmt.Println("sensors - lists the configured sensor backends")
+				fmt.Println("setSource <sensor> <spec> - sets the backend of a sensor: ssh:<user@host>[:<command>], w1[:<device>], http(s)://...[#<field>] or file:<path>")
+				fmt.Println("removeSource <sensor> - the sensor goes back to the default ssh backend")
+				fmt.Println("history <from> <to> [<step>] - prints the recorded history, times are now, 24h or 7d back, 2006-01-02 or 2006-01-02T15:04, step is e.g. 15m or 1h")
+				fmt.Println("audit [<n>] [<filter>] - prints the last n (20 by default) changes, newest first, filter is a user, a source (" + strings.Join([]string{data.SourceConsole, data.SourceWeb, data.SourceAPI, data.SourceMQTT, data.SourceSchedule}, ", ") + ") or an action")
+				fmt.Println("alerts - lists the active alerts")
+				fmt.Println("testAlert - sends a test alert to every notifier")
+				fmt.Println("forecast - prints when the oil is expected to reach the warning and critical levels and to run out")
+				fmt.Println("refills - lists the refills detected in the oil data, with the oil burnt until the next one")
+				fmt.Println("refillPrice <2006-01-02> <price> - sets what was paid for the refill of that day")
+				fmt.Println("degreeDays - prints the oil burnt per heating degree day, by month and by heating season (October to May)")
+				fmt.Println("seasons - prints the oil burnt by month of each heating season (October to May), and this season against the previous ones up to the same day")
+				fmt.Println("burner - prints the burner hours, the liters per burner hour and the estimated costs")
+				fmt.Println("users - lists the web users")
+				fmt.Println("addUser <login> <role> <password> - adds a web user, role is one of " + strings.Join(data.Roles, ", ") + " (the password has to be changed on the first login)")
+				fmt.Println("removeUser <login> - removes a web user")
+				fmt.Println("setRole <login> <role> - changes the role of a web user")
+				fmt.Println("resetPassword <login> <password> - sets a temporary password for a web user")
+				fmt.Println("tokens - lists the API tokens")
+				fmt.Println("issueToken <name> <scope> - issues an API token, scope is " + strings.Join(data.Scopes, " or ") + ", use it as Authorization: Bearer <token>")
+				fmt.Println("revokeToken <name> - revokes an API token")
 				fmt.Println("pauseThermostat - disables the thermostat function (also manually stops the heater)")
 				fmt.Println("resumeThermostat - enables the thermostat function")
 				fmt.Println("heaterOff - manually disconnects the heater (irrespective of the thermostat function)")
@@ -267,9 +980,10 @@ func main() {
 			default:
 				fmt.Printf("Unknown command %v\n", command)
 			}
-			fmt.Println(str)
-			log.Println(str)
-			data.WriteConfig()
+			if str != "" {
+				fmt.Println(str)
+				log.Println(str)
+			}
 		}
 	}
 
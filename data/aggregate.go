@@ -0,0 +1,138 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Aggregation policies for the reference (control) temperature
+const (
+	AggSingle   = "single"   // Only the Sensor is read
+	AggAverage  = "average"  // Plain average of all the registered sensors
+	AggWeighted = "weighted" // Average weighted with each sensor's Weight
+	AggMin      = "min"      // The coldest room rules
+	AggMax      = "max"      // The warmest room rules
+	AggMedian   = "median"   // Median of the registered sensors
+)
+
+var Aggregations = []string{AggSingle, AggAverage, AggWeighted, AggMin, AggMax, AggMedian}
+
+type SensorT struct {
+	Name        string
+	Weight      float64
+	Temp        float64
+	ErrorInTemp bool
+}
+
+func ValidAggregation(policy string) bool {
+	for _, v := range Aggregations {
+		if v == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// addSensor registers a sensor (or changes its weight if already registered)
+func (s *StateT) addSensor(name string, weight float64) {
+	for i := range s.Sensors {
+		if s.Sensors[i].Name == name {
+			s.Sensors[i].Weight = weight
+			return
+		}
+	}
+	s.Sensors = append(s.Sensors, SensorT{Name: name, Weight: weight, ErrorInTemp: true})
+}
+
+func (s *StateT) removeSensor(name string) bool {
+	for i := range s.Sensors {
+		if s.Sensors[i].Name == name {
+			s.Sensors = append(s.Sensors[:i], s.Sensors[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// readSensor reads one sensor, checking the reading makes sense
+func readSensor(name string, source TemperatureSource) (temperature float64, err error) {
+	temperature, err = source.Temperature()
+	if err != nil {
+		log.Printf("Error measuring temperature in sensor %v (%v)\n", name, err)
+	} else if temperature < MinTemp {
+		errMsg := fmt.Sprintf("Error measuring temperature in sensor %v, temp is %v and that seems too low (min threshold is %v)", name, temperature, MinTemp)
+		err = errors.New(errMsg)
+		log.Print(errMsg)
+	}
+	return
+}
+
+// Aggregate computes the reference temperature out of the sensors not in
+// error, it fails if there is none left
+func Aggregate(policy string, sensors []SensorT) (float64, error) {
+	var temps, weights []float64
+	for _, s := range sensors {
+		if !s.ErrorInTemp {
+			temps = append(temps, s.Temp)
+			weights = append(weights, s.Weight)
+		}
+	}
+	if len(temps) == 0 {
+		return 0, errors.New("no sensor available")
+	}
+	switch policy {
+	case AggSingle:
+		return temps[0], nil
+	case AggAverage:
+		sum := 0.0
+		for _, t := range temps {
+			sum += t
+		}
+		return sum / float64(len(temps)), nil
+	case AggWeighted:
+		sum, totalWeight := 0.0, 0.0
+		for i, t := range temps {
+			sum += t * weights[i]
+			totalWeight += weights[i]
+		}
+		if totalWeight <= 0 {
+			return 0, errors.New("weights of the available sensors add up to zero")
+		}
+		return sum / totalWeight, nil
+	case AggMin:
+		result := math.Inf(1)
+		for _, t := range temps {
+			result = math.Min(result, t)
+		}
+		return result, nil
+	case AggMax:
+		result := math.Inf(-1)
+		for _, t := range temps {
+			result = math.Max(result, t)
+		}
+		return result, nil
+	case AggMedian:
+		sort.Float64s(temps)
+		n := len(temps)
+		if n%2 == 1 {
+			return temps[n/2], nil
+		}
+		return (temps[n/2-1] + temps[n/2]) / 2, nil
+	}
+	return 0, errors.New("unknown aggregation policy " + policy)
+}
+
+// formatSensors prints the registered sensors as name:weight separated by
+// semicolons
+func formatSensors(sensors []SensorT) string {
+	var parts []string
+	for _, s := range sensors {
+		parts = append(parts, s.Name+":"+strconv.FormatFloat(s.Weight, 'f', -1, 64))
+	}
+	return strings.Join(parts, ";")
+}
@@ -0,0 +1,189 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	sensors := []SensorT{
+		{Name: "salon", Weight: 2, Temp: 20},
+		{Name: "cocina", Weight: 1, Temp: 23},
+		{Name: "dormitorio", Weight: 1, Temp: 17},
+		{Name: "bano", Weight: 5, Temp: 10, ErrorInTemp: true}, // Left out by every policy
+	}
+	tests := []struct {
+		policy  string
+		sensors []SensorT
+		want    float64
+		wantErr bool
+	}{
+		{AggSingle, sensors, 20, false},
+		{AggAverage, sensors, 20, false},
+		{AggWeighted, sensors, 20, false},
+		{AggMin, sensors, 17, false},
+		{AggMax, sensors, 23, false},
+		{AggMedian, sensors, 20, false},
+		{AggMedian, sensors[:2], 21.5, false},
+		{AggWeighted, []SensorT{{Name: "a", Temp: 20}, {Name: "b", Temp: 22}}, 0, true},
+		{AggAverage, sensors[3:], 0, true},
+		{AggAverage, nil, 0, true},
+		{"mode", sensors, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := Aggregate(tt.policy, tt.sensors)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Aggregate(%v, %v sensors) error = %v, want error %v", tt.policy, len(tt.sensors), err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Aggregate(%v, %v sensors) = %v, want %v", tt.policy, len(tt.sensors), got, tt.want)
+		}
+	}
+}
+
+// newTestController is a controller on simulated hardware, saving its config
+// in a temporary directory
+func newTestController(t *testing.T) *Controller {
+	t.Helper()
+	configFile := ConfigFileName
+	ConfigFileName = filepath.Join(t.TempDir(), "config.json")
+	t.Cleanup(func() { ConfigFileName = configFile })
+	OpenSimulated()
+	return NewController()
+}
+
+func writeTemp(t *testing.T, path, temp string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(temp), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRefreshFallback checks that a failing sensor is left out of the
+// reference temperature, and that the last good one is kept when all fail
+func TestRefreshFallback(t *testing.T) {
+	c := newTestController(t)
+	dir := t.TempDir()
+	for _, name := range []string{"salon", "cocina", "dormitorio"} {
+		if err := c.AddSensor(name, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SetSource(name, "file:"+filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.SetAggregation(AggAverage); err != nil {
+		t.Fatal(err)
+	}
+	writeTemp(t, filepath.Join(dir, "salon"), "20")
+	writeTemp(t, filepath.Join(dir, "cocina"), "22")
+	writeTemp(t, filepath.Join(dir, "dormitorio"), "0.5") // Under MinTemp, so an error
+
+	tests := []struct {
+		name        string
+		update      func()
+		want        float64
+		wantError   bool
+		wantFailing map[string]int
+	}{
+		{"one bad reading", func() {}, 21, false, map[string]int{"dormitorio": 1}},
+		{"one missing", func() { os.Remove(filepath.Join(dir, "cocina")) }, 20, false, map[string]int{"cocina": 1, "dormitorio": 2}},
+		{"back again", func() {
+			writeTemp(t, filepath.Join(dir, "cocina"), "23")
+			writeTemp(t, filepath.Join(dir, "dormitorio"), "18")
+		}, 61.0 / 3, false, map[string]int{}},
+		{"all failing", func() {
+			for _, name := range []string{"salon", "cocina", "dormitorio"} {
+				os.Remove(filepath.Join(dir, name))
+			}
+		}, 61.0 / 3, true, map[string]int{"salon": 1, "cocina": 1, "dormitorio": 1}},
+	}
+	for _, tt := range tests {
+		tt.update()
+		st := c.Refresh()
+		if st.ErrorInTemp != tt.wantError {
+			t.Errorf("%v: ErrorInTemp = %v, want %v", tt.name, st.ErrorInTemp, tt.wantError)
+		}
+		if st.CurrentTemp != tt.want {
+			t.Errorf("%v: CurrentTemp = %v, want %v", tt.name, st.CurrentTemp, tt.want)
+		}
+		failing := c.Stats().SensorFailing
+		if len(failing) != len(tt.wantFailing) {
+			t.Errorf("%v: SensorFailing = %v, want %v", tt.name, failing, tt.wantFailing)
+		}
+		for name, n := range tt.wantFailing {
+			if failing[name] != n {
+				t.Errorf("%v: SensorFailing = %v, want %v", tt.name, failing, tt.wantFailing)
+			}
+		}
+		for _, s := range st.Sensors {
+			if s.ErrorInTemp != (tt.wantFailing[s.Name] > 0) {
+				t.Errorf("%v: sensor %v ErrorInTemp = %v", tt.name, s.Name, s.ErrorInTemp)
+			}
+		}
+	}
+}
+
+// TestRefreshConcurrent refreshes while the sensors are being changed and
+// listed, as the console and the web handlers do (run with -race)
+func TestRefreshConcurrent(t *testing.T) {
+	c := newTestController(t)
+	dir := t.TempDir()
+	for _, name := range []string{"salon", "cocina"} {
+		writeTemp(t, filepath.Join(dir, name), "20")
+		if err := c.SetSource(name, "file:"+filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.AddSensor(name, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.SetAggregation(AggAverage); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			c.Refresh()
+		}
+		close(done)
+	}()
+	for i := 0; i < 20; i++ {
+		c.Snapshot()
+		c.AddSensor("dormitorio", float64(i))
+		c.RemoveSensor("dormitorio")
+	}
+	<-done
+
+	st := c.Refresh()
+	if st.ErrorInTemp || st.CurrentTemp != 20 {
+		t.Errorf("read %v (error %v), want 20", st.CurrentTemp, st.ErrorInTemp)
+	}
+}
+
+// TestStatus checks that Status reads the sense lines but no sensor, so
+// showing the state does not count as a reading
+func TestStatus(t *testing.T) {
+	c := newTestController(t)
+	dir := t.TempDir()
+	writeTemp(t, filepath.Join(dir, "salon"), "20")
+	if err := c.SetSource("salon", "file:"+filepath.Join(dir, "salon")); err != nil {
+		t.Fatal(err)
+	}
+	c.Refresh()
+	writeTemp(t, filepath.Join(dir, "salon"), "25")
+	if err := c.SetPower(false); err != nil {
+		t.Fatal(err)
+	}
+
+	st := c.Status()
+	if st.PowerReading || st.CurrentTemp != 20 {
+		t.Errorf("Status power reading %v and temp %v, want false and 20", st.PowerReading, st.CurrentTemp)
+	}
+	if reads := c.Stats().SensorReads["salon"]; reads != 1 {
+		t.Errorf("%v sensor reads, want only the one of Refresh", reads)
+	}
+}
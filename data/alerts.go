@@ -0,0 +1,386 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juliofaura/oilmeter/files"
+)
+
+// Levels of the alerts, a notifier only gets the alerts of its level or above
+const (
+	AlertWarning  = "warning"
+	AlertCritical = "critical"
+)
+
+var AlertLevels = []string{AlertWarning, AlertCritical}
+
+func alertRank(level string) int {
+	for i, l := range AlertLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+var (
+	AlertsFileName      = ".calderaAlerts.json"
+	AlertRepeat         = 24 * time.Hour // A warning still active is sent again after this
+	AlertCriticalRepeat = 6 * time.Hour
+	OilWarningDays      = 21.0 // Days of oil left (at the current consumption) to warn
+	OilCriticalDays     = 7.0
+	OilStale            = 48 * time.Hour // Without oil readings for this long is an alert too
+	OilCheckInterval    = 10 * time.Minute
+	RelayMismatch       = 5 * time.Minute // A relay reading otherwise than set for this long is an alert
+	SensorFailures      = 5               // Failed readings in a row of the temperature or a sensor to alert
+	NotifyRetry         = time.Minute     // After a failed delivery, doubling on each failure up to NotifyRetryMax
+	NotifyRetryMax      = time.Hour
+)
+
+// AlertT is an alert, as kept while active and as sent to the notifiers
+type AlertT struct {
+	Key       string    `json:"key"` // What it is about, there is only one alert per key
+	Level     string    `json:"level"`
+	Title     string    `json:"title"`
+	Message   string    `json:"message"`
+	Since     time.Time `json:"since"`
+	Sent      time.Time `json:"sent"` // When it was last notified (queued to the notifiers)
+	SentLevel string    `json:"sent_level"`
+	Resolved  bool      `json:"resolved,omitempty"` // Only in the notifications
+}
+
+// Notifier delivers the alerts somewhere
+type Notifier interface {
+	Notify(a AlertT) error
+}
+
+type notifierEntryT struct {
+	name     string
+	minLevel string
+	notifier Notifier
+	queue    *notifyQueueT
+}
+
+type queuedAlertT struct {
+	seq   int
+	alert AlertT
+}
+
+// notifyQueueT delivers the alerts to a notifier in the background, so a slow
+// or unreachable one never holds up the control loop. A failed delivery is
+// retried after NotifyRetry, doubling up to NotifyRetryMax. Only the last
+// alert of each key is kept, e.g. its resolution replaces it if still pending
+type notifyQueueT struct {
+	mu       sync.Mutex
+	seq      int
+	pending  []queuedAlertT
+	wake     chan struct{}
+	retry    time.Duration
+	retryMax time.Duration
+}
+
+func newNotifyQueue(name string, n Notifier) *notifyQueueT {
+	q := &notifyQueueT{wake: make(chan struct{}, 1), retry: NotifyRetry, retryMax: NotifyRetryMax}
+	go q.run(name, n)
+	return q
+}
+
+func (q *notifyQueueT) push(a AlertT) {
+	q.mu.Lock()
+	for i, p := range q.pending {
+		if p.alert.Key == a.Key {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	q.seq++
+	q.pending = append(q.pending, queuedAlertT{q.seq, a})
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *notifyQueueT) run(name string, n Notifier) {
+	retry := q.retry
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			<-q.wake
+			continue
+		}
+		next := q.pending[0]
+		q.mu.Unlock()
+
+		err := n.Notify(next.alert)
+		if err != nil {
+			log.Printf("Error sending alert %v with %v (again in %v): %v", next.alert.Key, name, retry, err)
+			time.Sleep(retry)
+			retry = min(2*retry, q.retryMax)
+			continue
+		}
+		retry = q.retry
+		q.mu.Lock()
+		for i, p := range q.pending {
+			if p.seq == next.seq {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		q.mu.Unlock()
+	}
+}
+
+// AlertEngine keeps the active alerts (in a file, so they are not sent again
+// after a restart) and notifies them: when raised, again every AlertRepeat (or
+// AlertCriticalRepeat) while active, at once if they escalate, and when
+// resolved
+type AlertEngine struct {
+	mu        sync.Mutex
+	name      string
+	notifiers []notifierEntryT
+	active    map[string]AlertT
+}
+
+// OpenAlerts reads the active alerts and sets up the notifiers
+func OpenAlerts(name string, configs []NotifierConfigT) (*AlertEngine, error) {
+	e := &AlertEngine{name: name, active: map[string]AlertT{}}
+	for i, c := range configs {
+		n, err := NewNotifier(c)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %v (%v): %w", i+1, c.Type, err)
+		}
+		minLevel := c.MinLevel
+		if minLevel == "" {
+			minLevel = AlertWarning
+		}
+		name := fmt.Sprintf("%v %v", c.Type, i+1)
+		e.notifiers = append(e.notifiers, notifierEntryT{name, minLevel, n, newNotifyQueue(name, n)})
+	}
+	raw, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var alerts []AlertT
+	if err := json.Unmarshal(raw, &alerts); err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	for _, a := range alerts {
+		e.active[a.Key] = a
+	}
+	return e, nil
+}
+
+// save must be called with the lock held
+func (e *AlertEngine) save() {
+	raw, err := json.MarshalIndent(e.list(), "", "  ")
+	if err == nil {
+		err = WriteFileAtomic(e.name, append(raw, '\n'), 0644)
+	}
+	if err != nil {
+		log.Println("Error saving the alerts:", err)
+	}
+}
+
+func (e *AlertEngine) list() []AlertT {
+	alerts := []AlertT{}
+	for _, a := range e.active {
+		alerts = append(alerts, a)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Since.Before(alerts[j].Since) })
+	return alerts
+}
+
+// Active returns the active alerts, oldest first
+func (e *AlertEngine) Active() []AlertT {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.list()
+}
+
+// deliver queues the alert to the notifiers for its level (or, if resolved,
+// to the ones that got it)
+func (e *AlertEngine) deliver(a AlertT, level string) {
+	for _, n := range e.notifiers {
+		if alertRank(level) >= alertRank(n.minLevel) {
+			n.queue.push(a)
+		}
+	}
+}
+
+// Raise sets the alert of key at level, notifying it if new, escalated or due
+// a reminder
+func (e *AlertEngine) Raise(key, level, title, message string, now time.Time) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	a, ok := e.active[key]
+	if !ok {
+		a = AlertT{Key: key, Since: now}
+		log.Printf("Alert %v (%v): %v - %v", key, level, title, message)
+	}
+	changed := !ok || a.Level != level || a.Title != title || a.Message != message
+	a.Level, a.Title, a.Message = level, title, message
+	repeat := AlertRepeat
+	if level == AlertCritical {
+		repeat = AlertCriticalRepeat
+	}
+	if alertRank(level) > alertRank(a.SentLevel) || now.Sub(a.Sent) >= repeat {
+		e.deliver(a, level)
+		a.Sent, a.SentLevel = now, level
+		changed = true
+	}
+	e.active[key] = a
+	if changed {
+		e.save()
+	}
+}
+
+// Resolve ends the alert of key, if active, notifying it
+func (e *AlertEngine) Resolve(key, message string, now time.Time) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	a, ok := e.active[key]
+	if !ok {
+		return
+	}
+	delete(e.active, key)
+	log.Printf("Alert %v resolved: %v", key, message)
+	if a.SentLevel != "" {
+		a.Message, a.Resolved = message, true
+		e.deliver(a, a.SentLevel)
+	}
+	e.save()
+}
+
+// Test sends a test alert to every notifier right away (not queued),
+// returning what failed
+func (e *AlertEngine) Test(now time.Time) error {
+	a := AlertT{Key: "test", Level: AlertCritical, Title: "Prueba de avisos", Message: "Esto es una prueba de los avisos de la caldera", Since: now}
+	var errs []error
+	for _, n := range e.notifiers {
+		if err := n.notifier.Notify(a); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", n.name, err))
+		}
+	}
+	if len(e.notifiers) == 0 {
+		return errors.New("no notifiers configured")
+	}
+	return errors.Join(errs...)
+}
+
+// CheckOil raises (or resolves) the alerts of the oil: the level (against
+// OilWarning and OilCriticalWarning), the days left at the current
+// consumption (against OilWarningDays and OilCriticalDays) and the readings
+// being too old
+func (e *AlertEngine) CheckOil(now time.Time) {
+	last, average, ok := ReadOil()
+	if !ok {
+		e.Raise("oil_data", AlertWarning, "Sin datos del gasóleo", "No se pueden leer los datos del gasóleo de "+files.DataFile, now)
+		return
+	}
+	when := time.Unix(last.Timestamp, 0)
+	if now.Sub(when) > OilStale {
+		e.Raise("oil_data", AlertWarning, "Sin datos del gasóleo", "La última lectura del gasóleo es del "+when.Format("02/01/2006 15:04"), now)
+	} else {
+		e.Resolve("oil_data", "Vuelven a llegar los datos del gasóleo", now)
+	}
+
+	days := math.Inf(1)
+	msg := fmt.Sprintf("Quedan %.0f litros de gasóleo", last.Liters)
+	if average > 0 {
+		days = last.Liters / average
+		msg += fmt.Sprintf(", para unos %.0f días al consumo actual (%.1f litros/día)", days, average)
+	}
+	switch {
+	case last.Liters <= OilCriticalWarning || days <= OilCriticalDays:
+		e.Raise("oil_level", AlertCritical, "Queda muy poco gasóleo", msg, now)
+	case last.Liters <= OilWarning || days <= OilWarningDays:
+		e.Raise("oil_level", AlertWarning, "Queda poco gasóleo", msg, now)
+	default:
+		e.Resolve("oil_level", msg, now)
+	}
+}
+
+// CheckControl raises (or resolves) the alerts of the control loop, which runs
+// it after each step: the power or the burner reading otherwise than set for
+// RelayMismatch, and SensorFailures failed readings in a row of the
+// temperature or, when aggregating, of a sensor
+func (e *AlertEngine) CheckControl(st StateT, stats StatsT, now time.Time) {
+	if e == nil {
+		return
+	}
+	if !stats.PowerMismatch.IsZero() && now.Sub(stats.PowerMismatch) >= RelayMismatch {
+		e.Raise("power_relay", AlertCritical, "La caldera no responde",
+			fmt.Sprintf("La caldera está %v y debería estar %v desde el %v", onOffES(st.PowerReading, "a"), onOffES(st.PowerOn, "a"), stats.PowerMismatch.Format("02/01/2006 15:04")), now)
+	} else if stats.PowerMismatch.IsZero() {
+		e.Resolve("power_relay", "La caldera vuelve a estar "+onOffES(st.PowerReading, "a")+" como debe", now)
+	}
+	if !stats.HeatMismatch.IsZero() && now.Sub(stats.HeatMismatch) >= RelayMismatch {
+		e.Raise("heat_relay", AlertCritical, "El quemador no responde",
+			fmt.Sprintf("El quemador está %v y debería estar %v desde el %v", onOffES(st.HeatReading, "o"), onOffES(st.HeatOn, "o"), stats.HeatMismatch.Format("02/01/2006 15:04")), now)
+	} else if stats.HeatMismatch.IsZero() {
+		e.Resolve("heat_relay", "El quemador vuelve a estar "+onOffES(st.HeatReading, "o")+" como debe", now)
+	}
+
+	if stats.Failures >= SensorFailures {
+		what := "del sensor " + st.Sensor
+		if st.UsesAggregation() {
+			what = "de todos los sensores"
+		}
+		e.Raise("temperature", AlertCritical, "No se puede medir la temperatura",
+			fmt.Sprintf("Fallan al menos %v lecturas seguidas %v, el termostato no puede controlar la calefacción", SensorFailures, what), now)
+	} else if stats.Failures == 0 {
+		e.Resolve("temperature", fmt.Sprintf("Vuelve a medirse la temperatura (%.1f grados)", st.CurrentTemp), now)
+	}
+
+	// With a single sensor the alert of the temperature is enough
+	failing := map[string]bool{}
+	if st.UsesAggregation() {
+		for name, n := range stats.SensorFailing {
+			if n >= SensorFailures {
+				failing[name] = true
+				e.Raise(sensorAlertKey+name, AlertWarning, "Falla el sensor "+name,
+					fmt.Sprintf("Fallan al menos %v lecturas seguidas del sensor %v, no se tiene en cuenta para la temperatura", SensorFailures, name), now)
+			}
+		}
+	}
+	for _, a := range e.Active() {
+		name, ok := strings.CutPrefix(a.Key, sensorAlertKey)
+		if ok && !failing[name] && (stats.SensorFailing[name] == 0 || !st.UsesAggregation()) {
+			e.Resolve(a.Key, "El sensor "+name+" vuelve a funcionar o ya no se usa", now)
+		}
+	}
+}
+
+const sensorAlertKey = "sensor_"
+
+// onOffES is encendido/apagado, ending in o or a
+func onOffES(on bool, ending string) string {
+	if on {
+		return "encendid" + ending
+	}
+	return "apagad" + ending
+}
@@ -0,0 +1,201 @@
+package data
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingNotifier never answers, like a server that accepts the connection
+// and hangs
+type blockingNotifier struct{}
+
+func (blockingNotifier) Notify(a AlertT) error {
+	select {}
+}
+
+// waitQueue waits for the queue to deliver everything
+func waitQueue(t *testing.T, q *notifyQueueT) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		q.mu.Lock()
+		n := len(q.pending)
+		q.mu.Unlock()
+		if n == 0 {
+			return
+		}
+	}
+	t.Fatal("the queue did not empty")
+}
+
+// TestNotifyRetry checks that the alerts are delivered in the background, that
+// a failing webhook gets them again until it takes them, and that a pending
+// alert is replaced by a newer one of its key
+func TestNotifyRetry(t *testing.T) {
+	retry, retryMax := NotifyRetry, NotifyRetryMax
+	NotifyRetry, NotifyRetryMax = 10*time.Millisecond, 20*time.Millisecond
+	t.Cleanup(func() { NotifyRetry, NotifyRetryMax = retry, retryMax })
+
+	var mu sync.Mutex
+	failures, requests := 3, 0
+	received := make(chan AlertT, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if failures > 0 {
+			failures--
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		var a AlertT
+		if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- a
+	}))
+	defer webhook.Close()
+	critical := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("the critical only notifier got a request")
+	}))
+	defer critical.Close()
+
+	e, err := OpenAlerts(filepath.Join(t.TempDir(), "alerts.json"), []NotifierConfigT{
+		{Type: NotifyWebhook, URL: webhook.URL},
+		{Type: NotifyWebhook, URL: critical.URL, MinLevel: AlertCritical},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.notifiers = append(e.notifiers, notifierEntryT{"blocking", AlertWarning, blockingNotifier{}, newNotifyQueue("blocking", blockingNotifier{})})
+
+	now := time.Now()
+	done := make(chan struct{})
+	go func() {
+		e.Raise("oil_level", AlertWarning, "Queda poco gasóleo", "Quedan 900 litros", now)
+		e.Resolve("oil_level", "Quedan 2000 litros", now.Add(time.Minute))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Raise waited for the notifiers")
+	}
+
+	select {
+	case a := <-received:
+		if a.Key != "oil_level" || !a.Resolved || a.Message != "Quedan 2000 litros" {
+			t.Errorf("delivered %+v, want the resolution replacing the alert", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the alert was never delivered")
+	}
+	waitQueue(t, e.notifiers[0].queue)
+	select {
+	case a := <-received:
+		t.Errorf("delivered %+v too, want only the resolution", a)
+	case <-time.After(50 * time.Millisecond):
+	}
+	mu.Lock()
+	if requests != 4 {
+		t.Errorf("the webhook got %v requests, want 3 failed and 1 delivered", requests)
+	}
+	mu.Unlock()
+	if active := e.Active(); len(active) != 0 {
+		t.Errorf("active alerts %+v, want none", active)
+	}
+}
+
+func TestRaiseRepeat(t *testing.T) {
+	e, err := OpenAlerts(filepath.Join(t.TempDir(), "alerts.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	steps := []struct {
+		at       time.Duration
+		level    string
+		wantSent time.Duration
+	}{
+		{0, AlertWarning, 0},
+		{time.Hour, AlertWarning, 0},
+		{2 * time.Hour, AlertCritical, 2 * time.Hour}, // Escalated, at once
+		{2*time.Hour + AlertCriticalRepeat - time.Minute, AlertCritical, 2 * time.Hour},
+		{2*time.Hour + AlertCriticalRepeat, AlertCritical, 2*time.Hour + AlertCriticalRepeat},
+		{3*time.Hour + AlertCriticalRepeat, AlertWarning, 2*time.Hour + AlertCriticalRepeat}, // Not sent again when it lowers
+	}
+	for _, step := range steps {
+		e.Raise("oil_level", step.level, "Queda poco gasóleo", "", now.Add(step.at))
+		a := e.Active()[0]
+		if !a.Sent.Equal(now.Add(step.wantSent)) || a.Level != step.level || !a.Since.Equal(now) {
+			t.Errorf("at %v: sent %v as %v, want sent at %v", step.at, a.Sent.Sub(now), a.Level, step.wantSent)
+		}
+	}
+
+	// Read back after a restart
+	e, err = OpenAlerts(e.name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active := e.Active(); len(active) != 1 || active[0].SentLevel != AlertCritical {
+		t.Errorf("alerts read back = %+v, want the one sent as critical", active)
+	}
+}
+
+func activeKeys(e *AlertEngine) []string {
+	var keys []string
+	for _, a := range e.Active() {
+		keys = append(keys, a.Key+"/"+a.Level)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestCheckControl(t *testing.T) {
+	e, err := OpenAlerts(filepath.Join(t.TempDir(), "alerts.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	st := defaultState()
+	st.Aggregation = AggAverage
+	st.Sensors = []SensorT{{Name: "salon", Weight: 1}, {Name: "cocina", Weight: 1}}
+	st.PowerReading = false // Set on, reading off
+
+	steps := []struct {
+		name  string
+		stats StatsT
+		want  []string
+	}{
+		{"all well", StatsT{}, nil},
+		{"mismatch for a while", StatsT{PowerMismatch: now.Add(-time.Minute)}, nil},
+		{"mismatch too long", StatsT{PowerMismatch: now.Add(-RelayMismatch)}, []string{"power_relay/critical"}},
+		{"a sensor failing", StatsT{PowerMismatch: now.Add(-RelayMismatch), SensorFailing: map[string]int{"cocina": SensorFailures, "salon": 1}},
+			[]string{"power_relay/critical", "sensor_cocina/warning"}},
+		{"no temperature", StatsT{Failures: SensorFailures, SensorFailing: map[string]int{"cocina": SensorFailures + 1, "salon": SensorFailures}},
+			[]string{"sensor_cocina/warning", "sensor_salon/warning", "temperature/critical"}},
+		{"a sensor back", StatsT{Failures: 0, SensorFailing: map[string]int{"salon": SensorFailures + 1}},
+			[]string{"sensor_salon/warning"}},
+		{"all back", StatsT{}, nil},
+	}
+	for _, step := range steps {
+		e.CheckControl(st, step.stats, now)
+		if got := activeKeys(e); !slices.Equal(got, step.want) {
+			t.Errorf("%v: active %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	// With a single sensor only the temperature alert is raised
+	st.Aggregation = AggSingle
+	e.CheckControl(st, StatsT{Failures: SensorFailures, SensorFailing: map[string]int{"salon": SensorFailures}}, now)
+	if got, want := activeKeys(e), []string{"temperature/critical"}; !slices.Equal(got, want) {
+		t.Errorf("single sensor: active %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,232 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sources of the changes in the audit log
+const (
+	SourceConsole  = "console"
+	SourceWeb      = "web"
+	SourceAPI      = "api"
+	SourceMQTT     = "mqtt"
+	SourceSchedule = "schedule" // The weekly program and the away mode, changing the target on their own
+)
+
+var AuditFileName = ".calderaAudit.jsonl"
+
+// ActorT is who makes a change: the web user or API token, or the console or
+// the schedule themselves
+type ActorT struct {
+	Name   string
+	Source string
+	IP     string
+}
+
+// AuditEntryT is one change. Old and New hold the config fields that changed,
+// as field=value separated by commas
+type AuditEntryT struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Source string    `json:"source"`
+	IP     string    `json:"ip,omitempty"`
+	Action string    `json:"action"`
+	Old    string    `json:"old,omitempty"`
+	New    string    `json:"new,omitempty"`
+}
+
+// AuditLog appends the entries to a JSON lines file, which is never rewritten
+type AuditLog struct {
+	mu   sync.Mutex
+	name string
+}
+
+// OpenAudit checks the audit file can be written, creating it if needed
+func OpenAudit(name string) (*AuditLog, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &AuditLog{name: name}, nil
+}
+
+// Record appends an entry. Errors are only logged, a change is not undone
+// because it could not be audited
+func (a *AuditLog) Record(actor ActorT, action, old, new string) {
+	if a == nil {
+		return
+	}
+	e := AuditEntryT{time.Now(), actor.Name, actor.Source, actor.IP, action, old, new}
+	log.Printf("Audit: %v (%v %v) %v: %v -> %v", e.Actor, e.Source, e.IP, e.Action, e.Old, e.New)
+	raw, err := json.Marshal(e)
+	if err != nil {
+		log.Println("Error recording the audit entry:", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(a.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Println("Error recording the audit entry:", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(raw, '\n')); err != nil {
+		log.Println("Error recording the audit entry:", err)
+		return
+	}
+	if err := f.Sync(); err != nil {
+		log.Println("Error recording the audit entry:", err)
+	}
+}
+
+// Query returns the last n entries (all if n is 0), newest first. If match is
+// not empty only the entries with that actor, source or action are returned
+func (a *AuditLog) Query(n int, match string) ([]AuditEntryT, error) {
+	if a == nil {
+		return nil, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.Open(a.name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []AuditEntryT
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e AuditEntryT
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // A line cut by a power failure
+		}
+		if match == "" || e.Actor == match || e.Source == match || e.Action == match {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries, nil
+}
+
+// Changes describes the config fields that differ between the two states
+func Changes(before, after StateT) (old, new string) {
+	var o, n []string
+	b, errB := configFields(before)
+	a, errA := configFields(after)
+	if errB != nil || errA != nil {
+		return "", ""
+	}
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k) // Gone, as the away mode when cancelled
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !bytes.Equal(b[k], a[k]) {
+			o = append(o, fmt.Sprintf("%v=%s", k, orNone(b[k])))
+			n = append(n, fmt.Sprintf("%v=%s", k, orNone(a[k])))
+		}
+	}
+	return strings.Join(o, ", "), strings.Join(n, ", ")
+}
+
+func orNone(raw json.RawMessage) []byte {
+	if raw == nil {
+		return []byte("null")
+	}
+	return raw
+}
+
+// configFields flattens the config into field=JSON value, with the objects
+// (as the schedule) split into their own fields, e.g. schedule.on
+func configFields(s StateT) (map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(s.config())
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := flatten("", raw, fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "version")
+	return fields, nil
+}
+
+func flatten(prefix string, raw json.RawMessage, fields map[string]json.RawMessage) error {
+	if len(raw) == 0 || raw[0] != '{' {
+		fields[prefix] = raw
+		return nil
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return err
+	}
+	for k, v := range object {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+		if err := flatten(k, v, fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetAudit makes the controller record the changes made with Change, and the
+// ones of the schedule, in the audit log
+func (c *Controller) SetAudit(a *AuditLog) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.audit = a
+}
+
+// Change runs f (which should make one change with the setters) and records it
+// in the audit log as done by the actor, with the old and new values. Failed
+// changes are not recorded, unless they changed the state anyway (as when the
+// config could not be written)
+func (c *Controller) Change(actor ActorT, action string, f func() error) error {
+	c.changeMu.Lock()
+	defer c.changeMu.Unlock()
+	before := c.Snapshot()
+	err := f()
+	if errors.Is(err, ErrInvalid) {
+		return err
+	}
+	old, new := Changes(before, c.Snapshot())
+	if err != nil && old == "" && new == "" {
+		return err
+	}
+	c.mu.Lock()
+	audit := c.audit
+	c.mu.Unlock()
+	audit.Record(actor, action, old, new)
+	return err
+}
@@ -0,0 +1,95 @@
+package data
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestAudit(t *testing.T) *AuditLog {
+	t.Helper()
+	a, err := OpenAudit(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestChanges(t *testing.T) {
+	before := defaultState()
+	before.Schedule = []SlotT{{time.Monday, 7 * 60, 21}}
+
+	after := before.copy()
+	after.TargetTemp = 19.5
+	after.ScheduleOn = true
+	after.CurrentTemp = 18 // Not in the config, so not a change
+	after.Away = &AwayT{
+		From:      time.Date(2026, 12, 20, 0, 0, 0, 0, time.UTC),
+		To:        time.Date(2027, 1, 6, 0, 0, 0, 0, time.UTC),
+		FrostTemp: 7,
+	}
+
+	old, new := Changes(before, after)
+	wantOld := "away.from=null, away.frost_temp=null, away.preheat_minutes=null, away.to=null, schedule.on=false, target_temp=21"
+	wantNew := `away.from="2026-12-20T00:00:00Z", away.frost_temp=7, away.preheat_minutes=0, away.to="2027-01-06T00:00:00Z", schedule.on=true, target_temp=19.5`
+	if old != wantOld || new != wantNew {
+		t.Errorf("got\n%v\n%v\nwant\n%v\n%v", old, new, wantOld, wantNew)
+	}
+
+	// And back, with the away mode gone
+	if old, new := Changes(after, before); old != wantNew || new != wantOld {
+		t.Errorf("got back\n%v\n%v", old, new)
+	}
+
+	if old, new := Changes(before, before.copy()); old != "" || new != "" {
+		t.Errorf("no change got %q -> %q", old, new)
+	}
+}
+
+func TestChange(t *testing.T) {
+	c := newTestController(t)
+	a := openTestAudit(t)
+	c.SetAudit(a)
+	ana := ActorT{"ana", SourceWeb, "192.0.2.1"}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+
+	if err := c.Change(ana, "target", func() error { return c.SetTarget(19, now) }); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := a.Query(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := AuditEntryT{Actor: "ana", Source: SourceWeb, IP: "192.0.2.1", Action: "target", Old: "target_temp=21", New: "target_temp=19"}
+	if len(entries) != 1 {
+		t.Fatalf("got %v entries, want 1", len(entries))
+	}
+	got := entries[0]
+	got.Time = time.Time{}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// The failed changes are not recorded
+	if err := c.Change(ana, "target", func() error { return c.SetTarget(99, now) }); !errors.Is(err, ErrInvalid) {
+		t.Errorf("out of range target got %v, want ErrInvalid", err)
+	}
+	failed := errors.New("failed")
+	if err := c.Change(ana, "power", func() error { return failed }); err != failed {
+		t.Errorf("got %v, want %v", err, failed)
+	}
+	if entries, _ := a.Query(0, ""); len(entries) != 1 {
+		t.Errorf("failed changes recorded, got %v entries", len(entries))
+	}
+
+	// But a change that could not be saved holds, so it is
+	ConfigFileName = filepath.Join(t.TempDir(), "missing", "config.json")
+	if err := c.Change(ana, "target", func() error { return c.SetTarget(20, now) }); err == nil {
+		t.Fatal("saving to a missing directory did not fail")
+	}
+	entries, _ = a.Query(1, "")
+	if len(entries) != 1 || entries[0].New != "target_temp=20" {
+		t.Errorf("unsaved change got %+v", entries)
+	}
+}
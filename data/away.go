@@ -0,0 +1,96 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	AwayDateFormat   = "2006-01-02T15:04"
+	DefaultFrostTemp = 7.0
+)
+
+// AwayT is the holiday mode: between From and To the house is only kept above
+// FrostTemp, and if Preheat is not zero the normal target comes back Preheat
+// before To so the house is warm when we arrive
+type AwayT struct {
+	From      time.Time
+	To        time.Time
+	FrostTemp float64
+	Preheat   time.Duration
+}
+
+// ParseAwayDate accepts "now", a date (2006-01-02, meaning midnight) or a date
+// and time (2006-01-02T15:04), all in local time
+func ParseAwayDate(str string, now time.Time) (time.Time, error) {
+	if str == "now" {
+		return now, nil
+	}
+	if t, err := time.ParseInLocation(AwayDateFormat, str, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", str, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New("wrong date " + str + ", should be like 2006-01-02 or 2006-01-02T15:04")
+}
+
+// Validate checks an away period about to be set
+func (away AwayT) Validate(now time.Time) error {
+	if !away.To.After(away.From) {
+		return errors.New("the return date must be after the leaving date")
+	}
+	if !away.To.After(now) {
+		return errors.New("the return date is in the past")
+	}
+	if away.FrostTemp < MinTemp {
+		return fmt.Errorf("frost protection temperature must be at least %v", MinTemp)
+	}
+	if away.Preheat < 0 || away.Preheat > away.To.Sub(away.From) {
+		return errors.New("wrong pre-heat time")
+	}
+	return nil
+}
+
+// AwayActive tells whether we are away right now (pre-heat included)
+func (s StateT) AwayActive(now time.Time) bool {
+	return s.Away != nil && !now.Before(s.Away.From) && now.Before(s.Away.To)
+}
+
+// Preheating tells whether we are away but already heating for the return
+func (s StateT) Preheating(now time.Time) bool {
+	return s.AwayActive(now) && s.Away.Preheat > 0 && !now.Before(s.Away.To.Add(-s.Away.Preheat))
+}
+
+// returnTarget is the target we will want when coming back
+func (s StateT) returnTarget() float64 {
+	if s.ScheduleOn {
+		if slot, ok := s.ActiveSlot(s.Away.To); ok {
+			return slot.Target
+		}
+	}
+	return s.TargetTemp
+}
+
+// EffectiveTarget is the target the thermostat actually controls to
+func (s StateT) EffectiveTarget(now time.Time) float64 {
+	if !s.AwayActive(now) {
+		return s.TargetTemp
+	}
+	if s.Preheating(now) {
+		return s.returnTarget()
+	}
+	return s.Away.FrostTemp
+}
+
+// applyAway ends the away period once we are back, it returns true if it did
+func (s *StateT) applyAway(now time.Time) bool {
+	if s.Away == nil || now.Before(s.Away.To) {
+		return false
+	}
+	log.Println("Away period over, back to normal")
+	s.Away = nil
+	return true
+}
@@ -0,0 +1,106 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+// TestEffectiveTarget checks the target resolution with the away mode on top
+// of the schedule: frost protection while away, the return target while
+// pre-heating, and back to the schedule after
+func TestEffectiveTarget(t *testing.T) {
+	away := &AwayT{
+		From:      at(time.Tuesday, 9, 0),
+		To:        at(time.Thursday, 18, 0),
+		FrostTemp: 7,
+		Preheat:   2 * time.Hour,
+	}
+	tests := []struct {
+		name       string
+		scheduleOn bool
+		now        time.Time
+		want       float64
+		wantAway   bool
+		wantPre    bool
+	}{
+		{"before leaving", true, at(time.Tuesday, 8, 59), 21, false, false},
+		{"just left", true, at(time.Tuesday, 9, 0), 7, true, false},
+		{"away", false, at(time.Wednesday, 12, 0), 7, true, false},
+		{"pre-heating by the schedule", true, at(time.Thursday, 16, 0), 17, true, true}, // Monday 23:00's slot holds on Thursday
+		{"pre-heating without schedule", false, at(time.Thursday, 17, 59), 21, true, true},
+		{"back", true, at(time.Thursday, 18, 0), 21, false, false},
+	}
+	for _, tt := range tests {
+		s := testSchedule()
+		s.ScheduleOn = tt.scheduleOn
+		s.Away = away
+		if got := s.EffectiveTarget(tt.now); got != tt.want {
+			t.Errorf("%v: EffectiveTarget = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := s.AwayActive(tt.now); got != tt.wantAway {
+			t.Errorf("%v: AwayActive = %v, want %v", tt.name, got, tt.wantAway)
+		}
+		if got := s.Preheating(tt.now); got != tt.wantPre {
+			t.Errorf("%v: Preheating = %v, want %v", tt.name, got, tt.wantPre)
+		}
+	}
+}
+
+func TestApplyAway(t *testing.T) {
+	s := defaultState()
+	s.Away = &AwayT{From: at(time.Tuesday, 9, 0), To: at(time.Thursday, 18, 0), FrostTemp: 7}
+	if s.applyAway(at(time.Thursday, 17, 59)) || s.Away == nil {
+		t.Fatal("the away period ended before its end")
+	}
+	if !s.applyAway(at(time.Thursday, 18, 0)) || s.Away != nil {
+		t.Fatal("the away period did not end")
+	}
+	if s.applyAway(at(time.Thursday, 18, 1)) {
+		t.Error("applyAway changed something with no away period")
+	}
+}
+
+func TestAwayValidate(t *testing.T) {
+	now := at(time.Monday, 12, 0)
+	tests := []struct {
+		name    string
+		away    AwayT
+		wantErr bool
+	}{
+		{"ok", AwayT{From: now, To: now.Add(48 * time.Hour), FrostTemp: 7, Preheat: time.Hour}, false},
+		{"return before leaving", AwayT{From: now, To: now.Add(-time.Hour), FrostTemp: 7}, true},
+		{"return in the past", AwayT{From: now.Add(-48 * time.Hour), To: now.Add(-time.Hour), FrostTemp: 7}, true},
+		{"frost too low", AwayT{From: now, To: now.Add(48 * time.Hour), FrostTemp: MinTemp - 1}, true},
+		{"pre-heat too long", AwayT{From: now, To: now.Add(time.Hour), FrostTemp: 7, Preheat: 2 * time.Hour}, true},
+		{"negative pre-heat", AwayT{From: now, To: now.Add(time.Hour), FrostTemp: 7, Preheat: -time.Hour}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.away.Validate(now); (err != nil) != tt.wantErr {
+			t.Errorf("%v: Validate() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseAwayDate(t *testing.T) {
+	now := at(time.Monday, 12, 0)
+	tests := []struct {
+		str     string
+		want    time.Time
+		wantErr bool
+	}{
+		{"now", now, false},
+		{"2026-10-21", time.Date(2026, 10, 21, 0, 0, 0, 0, time.Local), false},
+		{"2026-10-21T18:30", time.Date(2026, 10, 21, 18, 30, 0, 0, time.Local), false},
+		{"21/10/2026", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAwayDate(tt.str, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAwayDate(%q) error = %v, want error %v", tt.str, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseAwayDate(%q) = %v, want %v", tt.str, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	oildata "github.com/juliofaura/oilmeter/data"
+)
+
+var (
+	BurnerFileName = ".calderaBurner.json"
+	BurnerRateDays = 30  // Days back to correlate the burner hours with the oil consumed
+	OilPrice       = 0.0 // Per liter, 0 to leave the costs out
+)
+
+const burnerSaveInterval = 5 * time.Minute // While the burner is on, so a restart loses little
+
+// BurnerLog accumulates the time the burner is on (as read by the heat sense
+// line), by day. The controller updates it on every Refresh
+type BurnerLog struct {
+	mu    sync.Mutex
+	name  string
+	days  map[string]float64 // Seconds on, by day (as in the history files)
+	on    bool               // As last seen
+	last  time.Time          // When last seen
+	saved time.Time
+}
+
+// OpenBurner reads the burner log, creating it if needed
+func OpenBurner(name string) (*BurnerLog, error) {
+	b := &BurnerLog{name: name, days: map[string]float64{}}
+	raw, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &b.days); err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	return b, nil
+}
+
+// save must be called with the lock held
+func (b *BurnerLog) save(now time.Time) {
+	raw, err := json.MarshalIndent(b.days, "", "  ")
+	if err == nil {
+		err = WriteFileAtomic(b.name, append(raw, '\n'), 0644)
+	}
+	if err != nil {
+		log.Println("Error saving the burner log:", err)
+	}
+	b.saved = now
+}
+
+// Update accounts the time since the last update if the burner was on then,
+// split among the days it spans
+func (b *BurnerLog) Update(on bool, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.on && now.After(b.last) {
+		for from := b.last; from.Before(now); {
+			y, m, d := from.Date()
+			to := time.Date(y, m, d+1, 0, 0, 0, 0, from.Location())
+			if to.After(now) {
+				to = now
+			}
+			b.days[from.Format(historyDayFormat)] += to.Sub(from).Seconds()
+			from = to
+		}
+	}
+	switched := on != b.on
+	b.on, b.last = on, now
+	if (switched && !on) || (on && now.Sub(b.saved) >= burnerSaveInterval) {
+		b.save(now)
+	}
+}
+
+// Hours returns the burner hours of the days from from to to (both included)
+func (b *BurnerLog) Hours(from, to time.Time) float64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	seconds := 0.0
+	first := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	for day := first; !day.After(to); day = day.AddDate(0, 0, 1) {
+		seconds += b.days[day.Format(historyDayFormat)]
+	}
+	return seconds / 3600
+}
+
+// First returns the first day with data, false if there are none
+func (b *BurnerLog) First() (time.Time, bool) {
+	if b == nil {
+		return time.Time{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	first := ""
+	for day := range b.days {
+		if first == "" || day < first {
+			first = day
+		}
+	}
+	if first == "" {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(historyDayFormat, first, time.Local)
+	return t, err == nil
+}
+
+// SetBurner makes the controller account the burner time in the log
+func (c *Controller) SetBurner(b *BurnerLog) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.burner = b
+}
+
+// OilConsumed returns the liters burnt between from and to, leaving the
+// refills out (the datums must be sorted and filtered)
+func OilConsumed(datums []oildata.Datapoint, from, to time.Time) float64 {
+	consumed := 0.0
+	for i := 1; i < len(datums); i++ {
+		t := time.Unix(datums[i].Timestamp, 0)
+		if t.Before(from) || t.After(to) || datums[i-1].Timestamp < from.Unix() {
+			continue
+		}
+		if dif := datums[i-1].Liters - datums[i].Liters; math.Abs(dif) < oildata.NewGasThreshold {
+			consumed += dif
+		}
+	}
+	return consumed
+}
+
+// BurnerPeriodT is the burner time of a period, with the liters (estimated
+// from the hours) and their cost. Name is today, week, month or lastMonth
+type BurnerPeriodT struct {
+	Name   string
+	From   time.Time
+	To     time.Time
+	Hours  float64
+	Liters float64
+	Cost   float64
+}
+
+// BurnerReportT is the burner accounting. LitersPerHour is 0 if there are not
+// enough data yet to correlate the hours with the oil
+type BurnerReportT struct {
+	Periods       []BurnerPeriodT
+	RateFrom      time.Time // The hours and liters correlated, see BurnerRateDays
+	RateHours     float64
+	RateLiters    float64
+	LitersPerHour float64
+	MonthLiters   float64 // Estimated for the whole current month
+	MonthCost     float64
+}
+
+// BurnerReport builds the report at now, out of the burner log and the (sorted
+// and filtered) oil datums
+func BurnerReport(b *BurnerLog, datums []oildata.Datapoint, now time.Time) BurnerReportT {
+	var r BurnerReportT
+	r.RateFrom = now.AddDate(0, 0, -BurnerRateDays)
+	if first, ok := b.First(); ok && first.After(r.RateFrom) {
+		r.RateFrom = first
+	}
+	r.RateHours = b.Hours(r.RateFrom, now)
+	r.RateLiters = OilConsumed(datums, r.RateFrom, now)
+	if r.RateHours >= 1 && r.RateLiters > 0 {
+		r.LitersPerHour = r.RateLiters / r.RateHours
+	}
+
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	week := today.AddDate(0, 0, -(int(today.Weekday())+6)%7) // From Monday
+	month := time.Date(y, m, 1, 0, 0, 0, 0, now.Location())
+	lastMonth := month.AddDate(0, -1, 0)
+	for _, p := range []BurnerPeriodT{
+		{Name: "today", From: today, To: now},
+		{Name: "week", From: week, To: now},
+		{Name: "month", From: month, To: now},
+		{Name: "lastMonth", From: lastMonth, To: month.AddDate(0, 0, -1)},
+	} {
+		p.Hours = b.Hours(p.From, p.To)
+		p.Liters = p.Hours * r.LitersPerHour
+		p.Cost = p.Liters * OilPrice
+		r.Periods = append(r.Periods, p)
+	}
+
+	// The month so far, extended to the whole month
+	elapsed := now.Sub(month)
+	whole := month.AddDate(0, 1, 0).Sub(month)
+	if elapsed > 0 {
+		r.MonthLiters = r.Periods[2].Liters * float64(whole) / float64(elapsed)
+		r.MonthCost = r.MonthLiters * OilPrice
+	}
+	return r
+}
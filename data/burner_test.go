@@ -0,0 +1,128 @@
+package data
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	oildata "github.com/juliofaura/oilmeter/data"
+)
+
+func openTestBurner(t *testing.T) *BurnerLog {
+	t.Helper()
+	b, err := OpenBurner(filepath.Join(t.TempDir(), "burner.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// savedSeconds reads the burner file back, as after a restart
+func savedSeconds(t *testing.T, b *BurnerLog, day string) float64 {
+	t.Helper()
+	saved, err := OpenBurner(b.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return saved.days[day]
+}
+
+func TestBurnerUpdate(t *testing.T) {
+	b := openTestBurner(t)
+	start := time.Date(2026, 10, 18, 23, 50, 0, 0, time.Local)
+	steps := []struct {
+		name      string
+		on        bool
+		at        time.Duration
+		wantDays  map[string]float64
+		wantSaved map[string]float64
+	}{
+		{"switched on", true, 0, map[string]float64{}, map[string]float64{}},
+		{"on for a while", true, 2 * time.Minute, map[string]float64{"2026-10-18": 120}, map[string]float64{}},
+		{"saved while on", true, burnerSaveInterval, map[string]float64{"2026-10-18": 300}, map[string]float64{"2026-10-18": 300}},
+		{"past midnight", true, 15 * time.Minute, map[string]float64{"2026-10-18": 600, "2026-10-19": 300}, map[string]float64{"2026-10-18": 600, "2026-10-19": 300}},
+		{"switched off", false, 16 * time.Minute, map[string]float64{"2026-10-18": 600, "2026-10-19": 360}, map[string]float64{"2026-10-18": 600, "2026-10-19": 360}},
+		{"off", false, time.Hour, map[string]float64{"2026-10-18": 600, "2026-10-19": 360}, map[string]float64{"2026-10-18": 600, "2026-10-19": 360}},
+	}
+	for _, step := range steps {
+		b.Update(step.on, start.Add(step.at))
+		for _, day := range []string{"2026-10-18", "2026-10-19"} {
+			if got := b.days[day]; got != step.wantDays[day] {
+				t.Errorf("%v: %v has %v s, want %v", step.name, day, got, step.wantDays[day])
+			}
+			if got := savedSeconds(t, b, day); got != step.wantSaved[day] {
+				t.Errorf("%v: %v has %v s saved, want %v", step.name, day, got, step.wantSaved[day])
+			}
+		}
+	}
+	if got, want := b.Hours(start, start.Add(time.Hour)), 960.0/3600; got != want {
+		t.Errorf("Hours = %v, want %v", got, want)
+	}
+	if first, ok := b.First(); !ok || !first.Equal(time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("First = %v %v", first, ok)
+	}
+}
+
+// oilDatums is the tank going down liters a day from 2000, with a refill
+func oilDatums(from time.Time, days int, liters float64) []oildata.Datapoint {
+	var datums []oildata.Datapoint
+	level := 2000.0
+	for i := 0; i <= days; i++ {
+		if i == days/2 {
+			level += 1000 // Refilled, not consumption
+		}
+		datums = append(datums, oildata.Datapoint{Timestamp: from.AddDate(0, 0, i).Unix(), Liters: level})
+		level -= liters
+	}
+	return datums
+}
+
+func TestBurnerReport(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local) // A Sunday
+	from := now.AddDate(0, 0, -BurnerRateDays)
+	datums := oilDatums(from, BurnerRateDays, 10)
+	price := OilPrice
+	OilPrice = 1.2
+	t.Cleanup(func() { OilPrice = price })
+
+	// Less than an hour of burner is not enough to tell the L/h
+	b := openTestBurner(t)
+	b.days = map[string]float64{"2026-10-17": 3000}
+	if r := BurnerReport(b, datums, now); r.LitersPerHour != 0 || r.Periods[1].Liters != 0 {
+		t.Errorf("with %v hours got %v L/h", r.RateHours, r.LitersPerHour)
+	}
+	b.days["2026-10-17"] = 3600
+	if r := BurnerReport(b, datums, now); r.LitersPerHour != r.RateLiters {
+		t.Errorf("with an hour got %v L/h, want %v", r.LitersPerHour, r.RateLiters)
+	}
+
+	// Two hours a day
+	b.days = map[string]float64{}
+	for day := from; !day.After(now); day = day.AddDate(0, 0, 1) {
+		b.days[day.Format(historyDayFormat)] = 2 * 3600
+	}
+	r := BurnerReport(b, datums, now)
+	if !r.RateFrom.Equal(from) {
+		t.Errorf("RateFrom = %v, want %v", r.RateFrom, from)
+	}
+	if r.RateLiters != 10*float64(BurnerRateDays-1) || r.RateHours != 2*float64(BurnerRateDays+1) {
+		t.Errorf("rate of %v L in %v h, want the refill left out", r.RateLiters, r.RateHours)
+	}
+	rate := r.RateLiters / r.RateHours
+	if r.LitersPerHour != rate {
+		t.Errorf("LitersPerHour = %v, want %v", r.LitersPerHour, rate)
+	}
+	want := map[string]float64{"today": 2, "week": 14, "month": 36, "lastMonth": 26} // The log starts on the 18th of September
+	for _, p := range r.Periods {
+		if p.Hours != want[p.Name] {
+			t.Errorf("%v: %v hours, want %v", p.Name, p.Hours, want[p.Name])
+		}
+		if math.Abs(p.Liters-p.Hours*rate) > 1e-9 || math.Abs(p.Cost-p.Liters*1.2) > 1e-9 {
+			t.Errorf("%v: %v L for %v, want %v L/h at 1.2", p.Name, p.Liters, p.Cost, rate)
+		}
+	}
+	if r.MonthLiters <= r.Periods[2].Liters || math.Abs(r.MonthCost-r.MonthLiters*1.2) > 1e-9 {
+		t.Errorf("month estimated at %v L for %v, with %v L so far", r.MonthLiters, r.MonthCost, r.Periods[2].Liters)
+	}
+}
@@ -0,0 +1,519 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigVersion is the version of the config file format written by this
+// build. Bump it on incompatible changes, and have readConfig bring the older
+// versions up to date
+const ConfigVersion = 1
+
+var ConfigFileName = ".calderaConfig.json"
+
+type ConfigT struct {
+	Version      int               `json:"version"`
+	PowerOn      bool              `json:"power_on"`
+	ThermostatOn bool              `json:"thermostat_on"`
+	HeatOn       bool              `json:"heat_on"`
+	Sensor       string            `json:"sensor"`
+	TargetTemp   float64           `json:"target_temp"`
+	Hysteresis   float64           `json:"hysteresis"`
+	Aggregation  string            `json:"aggregation"`
+	Sensors      []SensorConfigT   `json:"sensors"`
+	Sources      map[string]string `json:"sources"`
+	Schedule     ScheduleConfigT   `json:"schedule"`
+	Away         *AwayConfigT      `json:"away,omitempty"`
+	Pins         PinsConfigT       `json:"pins"`
+	Oil          OilConfigT        `json:"oil"`
+	Web          WebConfigT        `json:"web"`
+	Thresholds   ThresholdsConfigT `json:"thresholds"`
+	History      HistoryConfigT    `json:"history"`
+	MQTT         MQTTConfigT       `json:"mqtt"`
+	Alerts       AlertsConfigT     `json:"alerts"`
+}
+
+type SensorConfigT struct {
+	Name   string  `json:"name"`
+	Weight float64 `json:"weight"`
+}
+
+type ScheduleConfigT struct {
+	On       bool             `json:"on"`
+	Slots    []SlotConfigT    `json:"slots"`
+	Override *OverrideConfigT `json:"override,omitempty"`
+}
+
+type SlotConfigT struct {
+	Day    string  `json:"day"`
+	Start  string  `json:"start"`
+	Target float64 `json:"target"`
+}
+
+type OverrideConfigT struct {
+	Target float64   `json:"target"`
+	Until  time.Time `json:"until"`
+}
+
+type AwayConfigT struct {
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	FrostTemp      float64   `json:"frost_temp"`
+	PreheatMinutes int       `json:"preheat_minutes"`
+}
+
+type PinsConfigT struct {
+	Power1    int `json:"power1"`
+	Power2    int `json:"power2"`
+	Heat      int `json:"heat"`
+	ReadPower int `json:"read_power"`
+	ReadHeat  int `json:"read_heat"`
+}
+
+type OilConfigT struct {
+	DataFile      string  `json:"data_file"`
+	AverageFile   string  `json:"average_file"`
+	PricePerLiter float64 `json:"price_per_liter"` // For the burner costs, 0 to leave them out
+	OutdoorSensor string  `json:"outdoor_sensor"`  // For the degree days, see OilOutdoorSensor
+	OutdoorFile   string  `json:"outdoor_file"`
+	DegreeDayBase float64 `json:"degree_day_base"`
+}
+
+// WebConfigT is where the web is served. With TLS on, the cert and key are
+// generated (self-signed) if neither exists, and if RedirectPort is set plain
+// HTTP on it is redirected to HTTPS
+type WebConfigT struct {
+	Port         string `json:"port"`
+	TLS          bool   `json:"tls"`
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	RedirectPort string `json:"redirect_port"`
+}
+
+type ThresholdsConfigT struct {
+	MinTemp               float64 `json:"min_temp"`
+	OilWarning            float64 `json:"oil_warning"`
+	OilCriticalWarning    float64 `json:"oil_critical_warning"`
+	IntervalSeconds       int     `json:"interval_seconds"`
+	SensorRetrySeconds    int     `json:"sensor_retry_seconds"`
+	MaxSensorRetrySeconds int     `json:"max_sensor_retry_seconds"`
+}
+
+// HistoryConfigT sets where the history is kept and for how many days each
+// tier is kept (0 for ever)
+type HistoryConfigT struct {
+	Dir         string `json:"dir"`
+	RawDays     int    `json:"raw_days"`
+	QuarterDays int    `json:"quarter_days"`
+	HourlyDays  int    `json:"hourly_days"`
+}
+
+// MQTTConfigT is the MQTT broker the state is published to and the commands
+// taken from, off if Broker is empty. The password (if any) is read from
+// PasswordFile, so it is not in the config
+type MQTTConfigT struct {
+	Broker          string `json:"broker"` // e.g. tcp://localhost:1883
+	ClientID        string `json:"client_id"`
+	Username        string `json:"username"`
+	PasswordFile    string `json:"password_file"`
+	Topic           string `json:"topic"`            // Prefix of the caldera topics
+	DiscoveryPrefix string `json:"discovery_prefix"` // Of Home Assistant, empty for no discovery
+	IntervalSeconds int    `json:"interval_seconds"`
+}
+
+// AlertsConfigT sets when the alerts are sent again while active, the oil
+// alerts (besides oil_warning and oil_critical_warning in the thresholds), the
+// ones of the relays and the sensors, and where the alerts are sent
+type AlertsConfigT struct {
+	RepeatHours         int               `json:"repeat_hours"`
+	CriticalRepeatHours int               `json:"critical_repeat_hours"`
+	OilWarningDays      float64           `json:"oil_warning_days"`
+	OilCriticalDays     float64           `json:"oil_critical_days"`
+	OilStaleHours       int               `json:"oil_stale_hours"`
+	MismatchMinutes     int               `json:"mismatch_minutes"`
+	SensorFailures      int               `json:"sensor_failures"`
+	Notifiers           []NotifierConfigT `json:"notifiers"`
+}
+
+var Notifiers = []NotifierConfigT{}
+
+var (
+	WebPort         = "8050"
+	WebTLS          = false
+	WebCertFile     = ".calderaCert.pem"
+	WebKeyFile      = ".calderaKey.pem"
+	WebRedirectPort = ""
+	OilDataFile     = "/home/pi/Gasoleo/data.txt"
+	OilAverageFile  = "/home/pi/Gasoleo/oilaverage.txt"
+	TimeInterval    = 1 * time.Minute
+	SensorRetry     = 3 * time.Second
+	MaxSensorRetry  = 1 * time.Minute
+)
+
+var (
+	MQTTBroker          = ""
+	MQTTClientID        = "caldera"
+	MQTTUsername        = ""
+	MQTTPasswordFile    = ""
+	MQTTTopic           = "caldera"
+	MQTTDiscoveryPrefix = "homeassistant"
+	MQTTInterval        = 1 * time.Minute
+)
+
+// config collects the config from the state (and the static settings)
+func (s StateT) config() ConfigT {
+	c := ConfigT{
+		Version:      ConfigVersion,
+		PowerOn:      s.PowerOn,
+		ThermostatOn: s.ThermostatOn,
+		HeatOn:       s.HeatOn,
+		Sensor:       s.Sensor,
+		TargetTemp:   s.TargetTemp,
+		Hysteresis:   s.Hysteresis,
+		Aggregation:  s.Aggregation,
+		Sensors:      []SensorConfigT{},
+		Sources:      map[string]string{},
+		Schedule:     ScheduleConfigT{On: s.ScheduleOn, Slots: []SlotConfigT{}},
+		Pins:         PinsConfigT{PowerPin1, PowerPin2, HeatPin, ReadPowerPin, ReadHeatPin},
+		Oil:          OilConfigT{OilDataFile, OilAverageFile, OilPrice, OilOutdoorSensor, OilOutdoorFile, DegreeDayBase},
+		Web:          WebConfigT{WebPort, WebTLS, WebCertFile, WebKeyFile, WebRedirectPort},
+		Thresholds: ThresholdsConfigT{
+			MinTemp:               MinTemp,
+			OilWarning:            OilWarning,
+			OilCriticalWarning:    OilCriticalWarning,
+			IntervalSeconds:       int(TimeInterval / time.Second),
+			SensorRetrySeconds:    int(SensorRetry / time.Second),
+			MaxSensorRetrySeconds: int(MaxSensorRetry / time.Second),
+		},
+		History: HistoryConfigT{HistoryDir, HistoryRawDays, HistoryQuarterDays, HistoryHourlyDays},
+		Alerts: AlertsConfigT{
+			RepeatHours:         int(AlertRepeat / time.Hour),
+			CriticalRepeatHours: int(AlertCriticalRepeat / time.Hour),
+			OilWarningDays:      OilWarningDays,
+			OilCriticalDays:     OilCriticalDays,
+			OilStaleHours:       int(OilStale / time.Hour),
+			MismatchMinutes:     int(RelayMismatch / time.Minute),
+			SensorFailures:      SensorFailures,
+			Notifiers:           append([]NotifierConfigT{}, Notifiers...),
+		},
+		MQTT: MQTTConfigT{MQTTBroker, MQTTClientID, MQTTUsername, MQTTPasswordFile, MQTTTopic, MQTTDiscoveryPrefix, int(MQTTInterval / time.Second)},
+	}
+	for _, v := range s.Sensors {
+		c.Sensors = append(c.Sensors, SensorConfigT{v.Name, v.Weight})
+	}
+	for name, spec := range s.SourceSpecs {
+		c.Sources[name] = spec
+	}
+	for _, v := range s.Schedule {
+		c.Schedule.Slots = append(c.Schedule.Slots, SlotConfigT{DayNames[v.Day], v.StartString(), v.Target})
+	}
+	if s.Override != nil {
+		c.Schedule.Override = &OverrideConfigT{s.Override.Target, s.Override.Until}
+	}
+	if s.Away != nil {
+		c.Away = &AwayConfigT{s.Away.From, s.Away.To, s.Away.FrostTemp, int(s.Away.Preheat / time.Minute)}
+	}
+	return c
+}
+
+// Validate checks the whole config, returning all the problems found
+func (c ConfigT) Validate() error {
+	var errs []error
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+	if c.Version < 1 || c.Version > ConfigVersion {
+		fail("unsupported version %v (this build reads up to %v)", c.Version, ConfigVersion)
+	}
+	if c.Sensor == "" {
+		fail("sensor is empty")
+	}
+	if c.TargetTemp < c.Thresholds.MinTemp || c.TargetTemp > 35 {
+		fail("target_temp %v out of range (%v to 35)", c.TargetTemp, c.Thresholds.MinTemp)
+	}
+	if c.Hysteresis < 0 || c.Hysteresis > 5 {
+		fail("hysteresis %v out of range (0 to 5)", c.Hysteresis)
+	}
+	if !ValidAggregation(c.Aggregation) {
+		fail("unknown aggregation %q", c.Aggregation)
+	}
+	seen := map[string]bool{}
+	for _, s := range c.Sensors {
+		if s.Name == "" || seen[s.Name] {
+			fail("empty or repeated sensor name %q", s.Name)
+		}
+		seen[s.Name] = true
+		if s.Weight < 0 {
+			fail("negative weight for sensor %v", s.Name)
+		}
+	}
+	for name, spec := range c.Sources {
+		if _, err := ParseSource(spec); err != nil {
+			fail("source for sensor %v: %v", name, err)
+		}
+	}
+	for _, s := range c.Schedule.Slots {
+		if _, err := parseDay(s.Day); err != nil {
+			fail("schedule slot: %v", err)
+		}
+		if _, err := ParseHour(s.Start); err != nil {
+			fail("schedule slot: %v", err)
+		}
+	}
+	if c.Schedule.On && len(c.Schedule.Slots) == 0 {
+		fail("schedule is on but has no slots")
+	}
+	if c.Away != nil {
+		if !c.Away.To.After(c.Away.From) {
+			fail("away ends before it starts")
+		}
+		if c.Away.FrostTemp < c.Thresholds.MinTemp {
+			fail("away frost_temp %v below min_temp", c.Away.FrostTemp)
+		}
+		if c.Away.PreheatMinutes < 0 {
+			fail("negative away preheat_minutes")
+		}
+	}
+	pins := []int{c.Pins.Power1, c.Pins.Power2, c.Pins.Heat, c.Pins.ReadPower, c.Pins.ReadHeat}
+	usedPins := map[int]bool{}
+	for _, p := range pins {
+		if p < 0 || p > 27 || usedPins[p] {
+			fail("GPIO pin %v out of range (0 to 27) or used twice", p)
+		}
+		usedPins[p] = true
+	}
+	if c.Oil.DataFile == "" {
+		fail("oil data_file is empty")
+	}
+	if c.Oil.PricePerLiter < 0 {
+		fail("oil price_per_liter is negative")
+	}
+	if c.Oil.DegreeDayBase < 5 || c.Oil.DegreeDayBase > 25 {
+		fail("oil degree_day_base %v out of range (5 to 25)", c.Oil.DegreeDayBase)
+	}
+	if port, err := strconv.Atoi(c.Web.Port); err != nil || port < 1 || port > 65535 {
+		fail("wrong web port %q", c.Web.Port)
+	}
+	if c.Web.TLS && (c.Web.CertFile == "" || c.Web.KeyFile == "") {
+		fail("web tls needs cert_file and key_file")
+	}
+	if c.Web.RedirectPort != "" {
+		if port, err := strconv.Atoi(c.Web.RedirectPort); err != nil || port < 1 || port > 65535 || c.Web.RedirectPort == c.Web.Port {
+			fail("wrong web redirect_port %q", c.Web.RedirectPort)
+		}
+	}
+	t := c.Thresholds
+	if t.MinTemp < -20 || t.MinTemp > 15 {
+		fail("min_temp %v out of range (-20 to 15)", t.MinTemp)
+	}
+	if t.OilCriticalWarning <= 0 || t.OilWarning <= t.OilCriticalWarning {
+		fail("oil thresholds should be 0 < oil_critical_warning < oil_warning")
+	}
+	if t.IntervalSeconds < 1 || t.SensorRetrySeconds < 1 || t.MaxSensorRetrySeconds < t.SensorRetrySeconds {
+		fail("wrong control timings, should be interval and sensor retry >= 1s and max sensor retry >= sensor retry")
+	}
+	h := c.History
+	if h.Dir == "" {
+		fail("history dir is empty")
+	}
+	if h.RawDays < 1 || h.QuarterDays < 0 || h.HourlyDays < 0 {
+		fail("wrong history retention, should be raw_days >= 1 and the rest >= 0 (0 keeps for ever)")
+	}
+	if m := c.MQTT; m.Broker != "" {
+		if u, err := url.Parse(m.Broker); err != nil || u.Host == "" {
+			fail("wrong mqtt broker %q, should be like tcp://host:1883", m.Broker)
+		}
+		if m.ClientID == "" {
+			fail("mqtt client_id is empty")
+		}
+		if m.Topic == "" || strings.ContainsAny(m.Topic, "+#") || strings.ContainsAny(m.DiscoveryPrefix, "+#") {
+			fail("mqtt topic is empty or has wildcards")
+		}
+		if m.IntervalSeconds < 1 {
+			fail("mqtt interval_seconds should be >= 1")
+		}
+	}
+	a := c.Alerts
+	if a.RepeatHours < 1 || a.CriticalRepeatHours < 1 || a.OilStaleHours < 1 {
+		fail("alerts repeat_hours, critical_repeat_hours and oil_stale_hours should be >= 1")
+	}
+	if a.OilCriticalDays < 0 || a.OilWarningDays < a.OilCriticalDays {
+		fail("alerts should be 0 <= oil_critical_days <= oil_warning_days")
+	}
+	if a.MismatchMinutes < 1 || a.SensorFailures < 1 {
+		fail("alerts mismatch_minutes and sensor_failures should be >= 1")
+	}
+	for i, n := range a.Notifiers {
+		if err := n.Validate(); err != nil {
+			fail("alerts notifier %v: %v", i+1, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// state builds the state out of an already validated config, and sets the
+// static settings
+func (c ConfigT) state() StateT {
+	s := defaultState()
+	s.PowerOn = c.PowerOn
+	s.ThermostatOn = c.ThermostatOn
+	s.HeatOn = c.HeatOn
+	s.Sensor = c.Sensor
+	s.TargetTemp = c.TargetTemp
+	s.Hysteresis = c.Hysteresis
+	s.Aggregation = c.Aggregation
+	for _, v := range c.Sensors {
+		s.addSensor(v.Name, v.Weight)
+	}
+	for name, spec := range c.Sources {
+		s.SourceSpecs[name] = spec
+	}
+	s.ScheduleOn = c.Schedule.On
+	for _, v := range c.Schedule.Slots {
+		day, _ := parseDay(v.Day)
+		start, _ := ParseHour(v.Start)
+		s.setSlot(day, start, v.Target)
+	}
+	if c.Schedule.Override != nil {
+		s.Override = &OverrideT{c.Schedule.Override.Target, c.Schedule.Override.Until}
+	}
+	if c.Away != nil {
+		s.Away = &AwayT{c.Away.From, c.Away.To, c.Away.FrostTemp, time.Duration(c.Away.PreheatMinutes) * time.Minute}
+	}
+
+	PowerPin1, PowerPin2, HeatPin = c.Pins.Power1, c.Pins.Power2, c.Pins.Heat
+	ReadPowerPin, ReadHeatPin = c.Pins.ReadPower, c.Pins.ReadHeat
+	OilDataFile, OilAverageFile = c.Oil.DataFile, c.Oil.AverageFile
+	OilPrice = c.Oil.PricePerLiter
+	OilOutdoorSensor, OilOutdoorFile, DegreeDayBase = c.Oil.OutdoorSensor, c.Oil.OutdoorFile, c.Oil.DegreeDayBase
+	WebPort, WebTLS, WebRedirectPort = c.Web.Port, c.Web.TLS, c.Web.RedirectPort
+	WebCertFile, WebKeyFile = c.Web.CertFile, c.Web.KeyFile
+	MinTemp = c.Thresholds.MinTemp
+	OilWarning = c.Thresholds.OilWarning
+	OilCriticalWarning = c.Thresholds.OilCriticalWarning
+	TimeInterval = time.Duration(c.Thresholds.IntervalSeconds) * time.Second
+	SensorRetry = time.Duration(c.Thresholds.SensorRetrySeconds) * time.Second
+	MaxSensorRetry = time.Duration(c.Thresholds.MaxSensorRetrySeconds) * time.Second
+	HistoryDir, HistoryRawDays = c.History.Dir, c.History.RawDays
+	HistoryQuarterDays, HistoryHourlyDays = c.History.QuarterDays, c.History.HourlyDays
+	MQTTBroker, MQTTClientID, MQTTUsername = c.MQTT.Broker, c.MQTT.ClientID, c.MQTT.Username
+	MQTTPasswordFile, MQTTTopic, MQTTDiscoveryPrefix = c.MQTT.PasswordFile, c.MQTT.Topic, c.MQTT.DiscoveryPrefix
+	MQTTInterval = time.Duration(c.MQTT.IntervalSeconds) * time.Second
+	AlertRepeat = time.Duration(c.Alerts.RepeatHours) * time.Hour
+	AlertCriticalRepeat = time.Duration(c.Alerts.CriticalRepeatHours) * time.Hour
+	OilWarningDays, OilCriticalDays = c.Alerts.OilWarningDays, c.Alerts.OilCriticalDays
+	OilStale = time.Duration(c.Alerts.OilStaleHours) * time.Hour
+	RelayMismatch = time.Duration(c.Alerts.MismatchMinutes) * time.Minute
+	SensorFailures = c.Alerts.SensorFailures
+	Notifiers = append([]NotifierConfigT{}, c.Alerts.Notifiers...)
+	return s
+}
+
+// BackupFileName is where the previous good config is kept
+func BackupFileName() string {
+	return ConfigFileName + ".bak"
+}
+
+// parseConfig decodes and validates a config file contents
+func parseConfig(raw []byte) (ConfigT, error) {
+	c := defaultState().config() // So fields missing in the file keep their defaults
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
+
+func readConfigFile(name string) (ConfigT, error) {
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return ConfigT{}, err
+	}
+	c, err := parseConfig(raw)
+	if err != nil {
+		return c, fmt.Errorf("%v: %w", name, err)
+	}
+	return c, nil
+}
+
+// readConfig loads the config file, migrating the old CSV config if there is
+// no config yet. If the config is missing or broken but there is a good backup,
+// the backup is used (and the broken file kept aside). On error the defaults
+// are returned
+func readConfig() (StateT, error) {
+	c, err := readConfigFile(ConfigFileName)
+	if err == nil {
+		return c.state(), nil
+	}
+	_, errBackup := os.Stat(BackupFileName())
+	if errors.Is(err, os.ErrNotExist) && errors.Is(errBackup, os.ErrNotExist) {
+		s := defaultState()
+		migrated, err := migrateLegacyConfig(&s)
+		if err != nil {
+			return defaultState(), fmt.Errorf("migrating the old config: %w", err)
+		}
+		if !migrated {
+			fmt.Println("Config file does not exist")
+		}
+		return s, nil
+	}
+	backup, errBackup := readConfigFile(BackupFileName())
+	if errBackup != nil {
+		return defaultState(), fmt.Errorf("%w (and the backup cannot be used either: %v)", err, errBackup)
+	}
+	msg := fmt.Sprintf("Config unusable (%v), recovered the previous one from %v", err, BackupFileName())
+	if !errors.Is(err, os.ErrNotExist) {
+		aside := ConfigFileName + ".broken-" + time.Now().Format("20060102-150405")
+		if os.Rename(ConfigFileName, aside) == nil {
+			msg += ", the broken file is kept as " + aside
+		}
+	}
+	log.Println(msg)
+	fmt.Println(msg)
+	s := backup.state()
+	return s, writeConfig(s)
+}
+
+// writeConfig saves the config, keeping the one it replaces (if good) as backup
+func writeConfig(s StateT) error {
+	raw, err := json.MarshalIndent(s.config(), "", "  ")
+	if err != nil {
+		log.Println("Error writing the config:", err)
+		return err
+	}
+	if old, err := os.ReadFile(ConfigFileName); err == nil {
+		if _, err := parseConfig(old); err == nil {
+			if err := WriteFileAtomic(BackupFileName(), old, 0644); err != nil {
+				log.Println("Error writing the config backup:", err)
+			}
+		}
+	}
+	if err := WriteFileAtomic(ConfigFileName, append(raw, '\n'), 0644); err != nil {
+		log.Println("Error writing the config:", err)
+		return err
+	}
+	log.Println("Config updated:")
+	log.Println("  - powerOn is", s.PowerOn)
+	log.Println("  - heatOn is", s.HeatOn)
+	log.Println("  - thermostatOn", s.ThermostatOn)
+	log.Println("  - sensor is", s.Sensor)
+	log.Println("  - targetTemp is", s.TargetTemp)
+	log.Println("  - hysteresis is", s.Hysteresis)
+	log.Println("  - aggregation is", s.Aggregation)
+	log.Println("  - sensors are", formatSensors(s.Sensors))
+	log.Println("  - scheduleOn is", s.ScheduleOn)
+	if s.Away != nil {
+		log.Println("  - away from", s.Away.From.Format(AwayDateFormat), "to", s.Away.To.Format(AwayDateFormat), "at", s.Away.FrostTemp)
+	}
+	return nil
+}
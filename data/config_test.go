@@ -0,0 +1,283 @@
+package data
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func configJSON(t *testing.T, c *Controller) string {
+	t.Helper()
+	raw, err := json.Marshal(c.Snapshot().config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	c := newTestController(t)
+	now := at(time.Monday, 12, 0)
+	for _, err := range []error{
+		c.SetThermostat(false, false),
+		c.SetTarget(19.5, now),
+		c.SetHysteresis(0.1),
+		c.SetSource("salon", "file:/tmp/salon.txt"),
+		c.SetAggregation(AggWeighted),
+		c.AddSensor("salon", 2),
+		c.AddSensor("cocina", 0.5),
+		c.SetSlots([]time.Weekday{time.Monday}, 7*60, 21, now),
+		c.SetSlots([]time.Weekday{time.Sunday}, 23*60+30, 17.5, now),
+		c.SetScheduleOn(true, now),
+		c.SetAway(AwayT{From: now, To: now.Add(48 * time.Hour), FrostTemp: 8.5, Preheat: 90 * time.Minute}, now),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := configJSON(t, c)
+
+	loaded := NewController()
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := configJSON(t, loaded); got != want {
+		t.Errorf("read config\n%v\nwant\n%v", got, want)
+	}
+}
+
+// TestLoadWrong checks that a wrong config is refused as a whole, leaving the
+// current state alone
+func TestLoadWrong(t *testing.T) {
+	c := newTestController(t)
+	if err := c.SetTarget(19, at(time.Monday, 12, 0)); err != nil {
+		t.Fatal(err)
+	}
+	want := configJSON(t, c)
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"not json", `power_on: true`},
+		{"unknown field", `{"version": 1, "colour": "blue"}`},
+		{"newer version", `{"version": 2}`},
+		{"target out of range", `{"version": 1, "target_temp": 40}`},
+		{"wrong source", `{"version": 1, "sources": {"salon": "ftp://salon"}}`},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(ConfigFileName, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(BackupFileName())
+		if err := c.Load(); err == nil {
+			t.Errorf("%v: Load() accepted %v", tt.name, tt.config)
+		}
+		if got := configJSON(t, c); got != want {
+			t.Errorf("%v: Load() changed the config to %v", tt.name, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *ConfigT)
+		want   string // Part of the error, empty for none
+	}{
+		{"defaults", func(c *ConfigT) {}, ""},
+		{"old version", func(c *ConfigT) { c.Version = 0 }, "unsupported version"},
+		{"empty sensor", func(c *ConfigT) { c.Sensor = "" }, "sensor is empty"},
+		{"target too low", func(c *ConfigT) { c.TargetTemp = 0 }, "target_temp"},
+		{"target too high", func(c *ConfigT) { c.TargetTemp = 35.5 }, "target_temp"},
+		{"negative hysteresis", func(c *ConfigT) { c.Hysteresis = -0.1 }, "hysteresis"},
+		{"hysteresis too high", func(c *ConfigT) { c.Hysteresis = 6 }, "hysteresis"},
+		{"aggregation", func(c *ConfigT) { c.Aggregation = "mode" }, "unknown aggregation"},
+		{"repeated sensor", func(c *ConfigT) { c.Sensors = []SensorConfigT{{"salon", 1}, {"salon", 2}} }, "repeated sensor"},
+		{"negative weight", func(c *ConfigT) { c.Sensors = []SensorConfigT{{"salon", -1}} }, "negative weight"},
+		{"slot hour", func(c *ConfigT) { c.Schedule.Slots = []SlotConfigT{{"mon", "24:00", 20}} }, "wrong hour"},
+		{"empty schedule on", func(c *ConfigT) { c.Schedule.On = true }, "no slots"},
+		{"away frost", func(c *ConfigT) {
+			c.Away = &AwayConfigT{From: time.Unix(0, 0), To: time.Unix(3600, 0), FrostTemp: 0}
+		}, "frost_temp"},
+		{"pin out of range", func(c *ConfigT) { c.Pins.Heat = 28 }, "GPIO pin 28"},
+		{"pin used twice", func(c *ConfigT) { c.Pins.Heat = c.Pins.Power1 }, "used twice"},
+		{"web port", func(c *ConfigT) { c.Web.Port = "80000" }, "wrong web port"},
+		{"min temp", func(c *ConfigT) { c.Thresholds.MinTemp = 20 }, "min_temp"},
+		{"oil thresholds", func(c *ConfigT) { c.Thresholds.OilWarning = c.Thresholds.OilCriticalWarning }, "oil thresholds"},
+		{"interval", func(c *ConfigT) { c.Thresholds.IntervalSeconds = 0 }, "control timings"},
+	}
+	for _, tt := range tests {
+		c := defaultState().config()
+		tt.change(&c)
+		err := c.Validate()
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%v: Validate() = %v, want no error", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%v: Validate() = %v, want an error with %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestMigrateLegacyConfig(t *testing.T) {
+	c := newTestController(t)
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile(legacyConfigFileName, []byte("true,false,true,dormitorio,20,0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	st := c.Snapshot()
+	if !st.PowerOn || st.ThermostatOn || !st.HeatOn || st.Sensor != "dormitorio" || st.TargetTemp != 20 || st.Hysteresis != 0.2 {
+		t.Errorf("migrated %v, %v, %v, %v, %v, %v, want true, false, true, dormitorio, 20, 0.2", st.PowerOn, st.ThermostatOn, st.HeatOn, st.Sensor, st.TargetTemp, st.Hysteresis)
+	}
+	if _, err := readConfigFile(ConfigFileName); err != nil {
+		t.Errorf("new config not written: %v", err)
+	}
+	if _, err := os.Stat(legacyConfigFileName + migratedSuffix); err != nil {
+		t.Errorf("old config not set aside: %v", err)
+	}
+	if _, err := os.Stat(legacyConfigFileName); err == nil {
+		t.Error("old config still in place")
+	}
+}
+
+func TestMigrateLegacyConfigWrong(t *testing.T) {
+	c := newTestController(t)
+	t.Chdir(t.TempDir())
+	want := configJSON(t, c)
+	for _, config := range []string{
+		"true,false,maybe,dormitorio,20,0.2\n",
+		"true,false,true,dormitorio,20,0.2,average,salon:1\n",
+		"true,false,true,dormitorio,50,0.2\n", // Out of range
+	} {
+		if err := os.WriteFile(legacyConfigFileName, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Load(); err == nil {
+			t.Errorf("migrated %q", config)
+		}
+		if _, err := os.Stat(ConfigFileName); err == nil {
+			t.Errorf("new config written from %q", config)
+			os.Remove(ConfigFileName)
+		}
+		if got := configJSON(t, c); got != want {
+			t.Errorf("config changed to %v from %q", got, config)
+		}
+	}
+}
+
+// TestSaveBackup checks that the replaced config is kept as backup, but only
+// when it is a good one
+func TestSaveBackup(t *testing.T) {
+	c := newTestController(t)
+	now := at(time.Monday, 12, 0)
+	if err := c.SetTarget(19, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(BackupFileName()); err == nil {
+		t.Error("backup written with no previous config")
+	}
+	first := readFile(t, ConfigFileName)
+
+	if err := c.SetTarget(20, now); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, BackupFileName()); got != first {
+		t.Errorf("backup is\n%v\nwant the previous config\n%v", got, first)
+	}
+
+	for _, broken := range []string{first[:len(first)/2], strings.Replace(first, `"target_temp": 19`, `"target_temp": 99`, 1)} {
+		if err := os.WriteFile(ConfigFileName, []byte(broken), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, BackupFileName()); got != first {
+			t.Errorf("backup replaced by a broken config:\n%v", got)
+		}
+	}
+}
+
+// TestLoadRecovery checks that a broken config is replaced by the backup and
+// kept aside, and that nothing changes if the backup is no good either
+func TestLoadRecovery(t *testing.T) {
+	c := newTestController(t)
+	now := at(time.Monday, 12, 0)
+	c.SetTarget(19, now)
+	good := configJSON(t, c)
+	goodFile := readFile(t, ConfigFileName)
+	c.SetTarget(20, now)
+	current := readFile(t, ConfigFileName)
+
+	tests := []struct {
+		name   string
+		config string // Empty for no config at all
+	}{
+		{"truncated", current[:len(current)/2]},
+		{"invalid", strings.Replace(current, `"target_temp": 20`, `"target_temp": 99`, 1)},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		os.Remove(ConfigFileName)
+		if tt.config != "" {
+			if err := os.WriteFile(ConfigFileName, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := WriteFileAtomic(BackupFileName(), []byte(goodFile), 0644); err != nil {
+			t.Fatal(err)
+		}
+		loaded := NewController()
+		if err := loaded.Load(); err != nil {
+			t.Errorf("%v: Load() = %v", tt.name, err)
+			continue
+		}
+		if got := configJSON(t, loaded); got != good {
+			t.Errorf("%v: recovered\n%v\nwant the backup\n%v", tt.name, got, good)
+		}
+		if _, err := readConfigFile(ConfigFileName); err != nil {
+			t.Errorf("%v: the config is still broken: %v", tt.name, err)
+		}
+		broken, _ := filepath.Glob(ConfigFileName + ".broken-*")
+		if tt.config == "" {
+			if len(broken) != 0 {
+				t.Errorf("%v: set aside %v", tt.name, broken)
+			}
+			continue
+		}
+		if len(broken) != 1 || readFile(t, broken[0]) != tt.config {
+			t.Errorf("%v: broken config not set aside, found %v", tt.name, broken)
+		}
+		for _, name := range broken {
+			os.Remove(name)
+		}
+	}
+
+	os.WriteFile(ConfigFileName, []byte(current[:10]), 0644)
+	os.WriteFile(BackupFileName(), []byte(goodFile[:10]), 0644)
+	want := configJSON(t, c)
+	if err := c.Load(); err == nil {
+		t.Error("Load() accepted a broken config and backup")
+	}
+	if got := configJSON(t, c); got != want {
+		t.Errorf("config changed to %v with a broken config and backup", got)
+	}
+	if broken, _ := filepath.Glob(ConfigFileName + ".broken-*"); len(broken) != 0 {
+		t.Errorf("set aside %v with no backup to replace it", broken)
+	}
+}
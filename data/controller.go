@@ -0,0 +1,501 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Controller owns the state of the heating and serialises every access to it,
+// so the thermostat loop, the console and the web handlers can share it. Every
+// mutation is persisted to the config file before returning
+type Controller struct {
+	mu       sync.Mutex
+	state    StateT
+	sources  map[string]TemperatureSource
+	audit    *AuditLog
+	burner   *BurnerLog
+	changeMu sync.Mutex // Held by Change and Control, so the audited changes do not mix
+
+	// Counters, see Stats
+	sensorReads   map[string]uint64
+	sensorErrors  map[string]uint64
+	powerSwitches uint64
+	heatSwitches  uint64
+	failures      int
+	sensorFailing map[string]int // Consecutive failed readings, only of the sensors read in the last Refresh
+	powerMismatch time.Time      // Since when the sense lines disagree with the relays, zero if they do not
+	heatMismatch  time.Time
+}
+
+// ErrInvalid matches (with errors.Is) the errors of the changes rejected by the
+// controller, as opposed to failures saving them
+var ErrInvalid = errors.New("invalid change")
+
+type invalidError string
+
+func (e invalidError) Error() string        { return string(e) }
+func (e invalidError) Is(target error) bool { return target == ErrInvalid }
+
+func invalidf(format string, a ...interface{}) error {
+	return invalidError(fmt.Sprintf(format, a...))
+}
+
+func NewController() *Controller {
+	return &Controller{
+		state:        defaultState(),
+		sources:      map[string]TemperatureSource{},
+		sensorReads:  map[string]uint64{},
+		sensorErrors: map[string]uint64{},
+	}
+}
+
+// Snapshot returns a consistent copy of the current state
+func (c *Controller) Snapshot() StateT {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.copy()
+}
+
+// Status is the Snapshot with the power and heat sense lines read again, for
+// showing the state: unlike Refresh it reads no sensor and counts nothing
+func (c *Controller) Status() StateT {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.PowerReading = PowerInput.Read()
+	c.state.HeatReading = HeatInput.Read()
+	return c.state.copy()
+}
+
+// Load reads the config file into the controller (see readConfig)
+func (c *Controller) Load() error {
+	s, err := readConfig()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = s
+	c.sources = buildSources(s.SourceSpecs)
+	return nil
+}
+
+// Save persists the current state
+func (c *Controller) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return writeConfig(c.state)
+}
+
+// save must be called with the lock held
+func (c *Controller) save() error {
+	return writeConfig(c.state)
+}
+
+// Refresh reads the power and heat sense lines and the temperature. Sensors
+// are read without holding the lock, as they may take a while. It also keeps
+// the failure counters and the burner time, so only the thermostat loop calls
+// it: the rest read the Status or the Snapshot
+func (c *Controller) Refresh() StateT {
+	c.mu.Lock()
+	c.state.PowerReading = PowerInput.Read()
+	c.state.HeatReading = HeatInput.Read()
+	aggregated := c.state.UsesAggregation()
+	names := []string{c.state.Sensor}
+	if aggregated {
+		names = nil
+		for _, s := range c.state.Sensors {
+			names = append(names, s.Name)
+		}
+	}
+	sources := make([]TemperatureSource, len(names))
+	for i, name := range names {
+		sources[i] = sourceFor(c.sources, name)
+	}
+	c.mu.Unlock()
+
+	// Read all the sensors in parallel, so a slow one does not delay the rest,
+	// and give up on the ones still hanging after sensorTimeout
+	type readingT struct {
+		i           int
+		temperature float64
+		err         error
+	}
+	readings := make(chan readingT, len(names))
+	for i := range names {
+		go func(i int) {
+			temperature, err := readSensor(names[i], sources[i])
+			readings <- readingT{i, temperature, err}
+		}(i)
+	}
+	temps := make([]float64, len(names))
+	errs := make([]error, len(names))
+	done := make([]bool, len(names))
+	timeout := time.NewTimer(sensorTimeout)
+	defer timeout.Stop()
+wait:
+	for range names {
+		select {
+		case r := <-readings:
+			temps[r.i], errs[r.i], done[r.i] = r.temperature, r.err, true
+		case <-timeout.C:
+			for i, name := range names {
+				if !done[i] {
+					errs[i] = fmt.Errorf("no reading in %v", sensorTimeout)
+					log.Printf("Error measuring temperature in sensor %v (%v)\n", name, errs[i])
+				}
+			}
+			break wait
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.trackMismatch(now)
+	c.burner.Update(c.state.HeatReading, now)
+	failing := map[string]int{}
+	for i, name := range names {
+		c.sensorReads[name]++
+		if errs[i] != nil {
+			c.sensorErrors[name]++
+			failing[name] = c.sensorFailing[name] + 1
+		}
+	}
+	c.sensorFailing = failing
+	var temperature float64
+	var err error
+	if !aggregated {
+		temperature, err = temps[0], errs[0]
+	} else {
+		// Sensors may have been registered or removed meanwhile, so match them
+		// by name
+		for i, name := range names {
+			for j := range c.state.Sensors {
+				if c.state.Sensors[j].Name == name {
+					c.state.Sensors[j].ErrorInTemp = errs[i] != nil
+					if errs[i] == nil {
+						c.state.Sensors[j].Temp = temps[i]
+					}
+				}
+			}
+		}
+		temperature, err = Aggregate(c.state.Aggregation, c.state.Sensors)
+		if err != nil {
+			log.Printf("Error computing the %v temperature (%v)\n", c.state.Aggregation, err)
+		}
+	}
+	if err != nil {
+		c.state.ErrorInTemp = true
+	} else {
+		c.state.ErrorInTemp = false
+		c.state.CurrentTemp = temperature
+	}
+	return c.state.copy()
+}
+
+// Control runs one step of the thermostat with the last readings: it applies
+// the away mode and the schedule and switches the heat if needed. If the
+// temperature could not be read the heat is stopped (if under control) and
+// false is returned
+func (c *Controller) Control(now time.Time) bool {
+	c.changeMu.Lock()
+	defer c.changeMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &c.state
+	before := s.copy()
+	changed := s.applyAway(now)
+	controlOn := s.ThermostatOn || s.AwayActive(now) // Frost protection works even with the thermostat paused
+	if s.ErrorInTemp {
+		// Oops, there has been an error measuring the temperature
+		if changed {
+			c.auditSchedule(before)
+		}
+		if controlOn && s.HeatOn {
+			c.setHeat(false)
+			changed = true
+		}
+		if changed {
+			c.save()
+		}
+		c.failures++
+		return false
+	}
+	c.failures = 0
+	log.Println("Current temp is ", s.CurrentTemp)
+	if s.applySchedule(now) {
+		changed = true
+	}
+	if changed {
+		c.auditSchedule(before)
+	}
+	target := s.EffectiveTarget(now)
+	if s.PowerReading && controlOn {
+		if s.CurrentTemp <= target-s.Hysteresis && !s.HeatOn {
+			c.setHeat(true)
+			changed = true
+		} else if s.CurrentTemp >= target+s.Hysteresis && s.HeatOn {
+			c.setHeat(false)
+			changed = true
+		}
+	} else if s.PowerReading && !controlOn && s.HeatOn {
+		c.setHeat(false)
+		changed = true
+	}
+	if changed {
+		c.save()
+	}
+	return true
+}
+
+// auditSchedule records the changes made by the schedule or the away mode
+// since before, must be called with the lock held
+func (c *Controller) auditSchedule(before StateT) {
+	if old, new := Changes(before, c.state); old != "" || new != "" {
+		c.audit.Record(ActorT{Name: SourceSchedule, Source: SourceSchedule}, "schedule", old, new)
+	}
+}
+
+// trackMismatch notes since when the sense lines read otherwise than the
+// relays were set. The burner is only expected to follow with the power on.
+// Must be called with the lock held
+func (c *Controller) trackMismatch(now time.Time) {
+	c.powerMismatch = mismatchSince(c.powerMismatch, c.state.PowerOn != c.state.PowerReading, now)
+	c.heatMismatch = mismatchSince(c.heatMismatch, c.state.PowerReading && c.state.HeatOn != c.state.HeatReading, now)
+}
+
+func mismatchSince(since time.Time, mismatch bool, now time.Time) time.Time {
+	if !mismatch {
+		return time.Time{}
+	}
+	if since.IsZero() {
+		return now
+	}
+	return since
+}
+
+func onOff(on bool) string {
+	if on {
+		return ON
+	}
+	return OFF
+}
+
+func (c *Controller) setPower(on bool) {
+	if on != c.state.PowerOn {
+		c.powerSwitches++
+		c.powerMismatch = time.Time{} // Give the new setting its own time to show
+	}
+	PowerRelay1.Set(on)
+	PowerRelay2.Set(on)
+	c.state.PowerOn = on
+	log.Println("Power set to", onOff(on))
+}
+
+func (c *Controller) setHeat(on bool) {
+	if on != c.state.HeatOn {
+		c.heatSwitches++
+		c.heatMismatch = time.Time{}
+	}
+	HeatRelay.Set(on)
+	c.state.HeatOn = on
+	log.Println("Heat set to", onOff(on))
+}
+
+func (c *Controller) SetPower(on bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setPower(on)
+	return c.save()
+}
+
+func (c *Controller) SetHeat(on bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setHeat(on)
+	return c.save()
+}
+
+// SetThermostat enables or disables the thermostat function. Pausing it also
+// stops the heat if stopHeat is set
+func (c *Controller) SetThermostat(on bool, stopHeat bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.ThermostatOn = on
+	if !on && stopHeat {
+		c.setHeat(false)
+	}
+	return c.save()
+}
+
+func validTarget(target float64) error {
+	if target < MinTemp || target > 35 {
+		return invalidf("target temperature %v out of range (%v to 35)", target, MinTemp)
+	}
+	return nil
+}
+
+// SetTarget changes the target temperature by hand. With the schedule on, the
+// new target is an override that lasts until the next slot starts
+func (c *Controller) SetTarget(target float64, now time.Time) error {
+	if err := validTarget(target); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.setTarget(target, now)
+	return c.save()
+}
+
+func (c *Controller) SetHysteresis(hysteresis float64) error {
+	if hysteresis < 0 || hysteresis > 5 {
+		return invalidf("hysteresis %v out of range (0 to 5)", hysteresis)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.Hysteresis = hysteresis
+	return c.save()
+}
+
+// SetSensor changes the reference sensor (the one used with AggSingle)
+func (c *Controller) SetSensor(sensor string) error {
+	if sensor == "" {
+		return invalidf("empty sensor name")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.Sensor = sensor
+	return c.save()
+}
+
+// AddSensor registers a sensor (or changes its weight if already registered)
+func (c *Controller) AddSensor(sensor string, weight float64) error {
+	if sensor == "" {
+		return invalidf("empty sensor name")
+	}
+	if weight < 0 {
+		return invalidf("negative weight %v", weight)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.addSensor(sensor, weight)
+	return c.save()
+}
+
+func (c *Controller) RemoveSensor(sensor string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.state.removeSensor(sensor) {
+		return invalidf("sensor not registered: %v", sensor)
+	}
+	return c.save()
+}
+
+func (c *Controller) SetAggregation(policy string) error {
+	if !ValidAggregation(policy) {
+		return invalidf("unknown aggregation policy %v", policy)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.Aggregation = policy
+	return c.save()
+}
+
+// SetSource configures the backend of a sensor from its spec (see ParseSource)
+func (c *Controller) SetSource(sensor, spec string) error {
+	source, err := ParseSource(spec)
+	if err != nil {
+		return invalidf("%v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sources[sensor] = source
+	c.state.SourceSpecs[sensor] = spec
+	return c.save()
+}
+
+// RemoveSource sends the sensor back to the default ssh backend
+func (c *Controller) RemoveSource(sensor string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.state.SourceSpecs[sensor]; !ok {
+		return invalidf("no backend configured for sensor %v", sensor)
+	}
+	delete(c.sources, sensor)
+	delete(c.state.SourceSpecs, sensor)
+	return c.save()
+}
+
+// SetScheduleOn switches the weekly program on or off, dropping any override
+func (c *Controller) SetScheduleOn(on bool, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if on && len(c.state.Schedule) == 0 {
+		return invalidf("the schedule is empty")
+	}
+	c.state.ScheduleOn = on
+	c.state.Override = nil
+	c.state.applySchedule(now)
+	return c.save()
+}
+
+// SetSlots adds (or changes) the slot starting at start on each of the days
+func (c *Controller) SetSlots(days []time.Weekday, start int, target float64, now time.Time) error {
+	if err := validTarget(target); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, day := range days {
+		c.state.setSlot(day, start, target)
+	}
+	c.state.applySchedule(now)
+	return c.save()
+}
+
+// RemoveSlots removes the slots starting at start on each of the days, it
+// returns how many were removed
+func (c *Controller) RemoveSlots(days []time.Weekday, start int, now time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for _, day := range days {
+		if c.state.removeSlot(day, start) {
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, invalidf("no such slot")
+	}
+	if len(c.state.Schedule) == 0 && c.state.ScheduleOn {
+		c.state.ScheduleOn = false
+		c.state.Override = nil
+		log.Println("Schedule is now empty, turned off")
+	}
+	c.state.applySchedule(now)
+	return removed, c.save()
+}
+
+func (c *Controller) SetAway(away AwayT, now time.Time) error {
+	if err := away.Validate(now); err != nil {
+		return invalidf("%v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.Away = &away
+	log.Printf("Away from %v to %v, frost protection at %.2f, pre-heat %v", away.From.Format(AwayDateFormat), away.To.Format(AwayDateFormat), away.FrostTemp, away.Preheat)
+	return c.save()
+}
+
+func (c *Controller) CancelAway() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state.Away == nil {
+		return invalidf("not away")
+	}
+	c.state.Away = nil
+	return c.save()
+}
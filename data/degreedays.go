@@ -0,0 +1,255 @@
+package data
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	oildata "github.com/juliofaura/oilmeter/data"
+)
+
+// The outdoor temperature comes from a sensor, registered (with weight 0) so
+// it is in the history, and/or a CSV file of daily means (as downloaded from a
+// weather service), with lines like 2006-01-02,7.5. The sensor wins on the
+// days both have
+var (
+	OilOutdoorSensor = ""
+	OilOutdoorFile   = ""
+	DegreeDayBase    = 15.0 // Outdoor temperature under which the heating is needed
+)
+
+// DegreeDays returns the heating degree days of a day with that mean outdoor
+// temperature
+func DegreeDays(temp float64) float64 {
+	return math.Max(0, DegreeDayBase-temp)
+}
+
+// DailyTemps returns the mean temperature of the sensor on each day (as in
+// the history files) from from to to, only of the days with readings. The days
+// over are cached, so only the days not asked for yet are read
+func (h *History) DailyTemps(sensor string, from, to time.Time) (map[string]float64, error) {
+	today := dayStart(time.Now())
+	temps := map[string]float64{}
+	h.mu.Lock()
+	cache, ok := h.daily[sensor]
+	if !ok {
+		cache = map[string]float64{}
+		h.daily[sensor] = cache
+	}
+	missing := dayStart(from)
+	for ; !missing.After(to); missing = missing.AddDate(0, 0, 1) {
+		t, ok := cache[missing.Format(historyDayFormat)]
+		if !ok {
+			break
+		}
+		if !math.IsNaN(t) {
+			temps[missing.Format(historyDayFormat)] = t
+		}
+	}
+	h.mu.Unlock()
+	if missing.After(to) {
+		return temps, nil
+	}
+
+	samples, err := h.Query(missing, to, 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	read := map[string]float64{}
+	for _, s := range samples {
+		if t, ok := s.Sensors[sensor]; ok {
+			read[s.Time.Format(historyDayFormat)] = t
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for day := missing; !day.After(to); day = day.AddDate(0, 0, 1) {
+		key := day.Format(historyDayFormat)
+		t, ok := read[key]
+		if ok {
+			temps[key] = t
+		}
+		if day.Before(today) {
+			if !ok {
+				t = math.NaN()
+			}
+			cache[key] = t
+		}
+	}
+	return temps, nil
+}
+
+// ReadOutdoorFile reads a CSV of daily outdoor temperatures: a date and a
+// temperature per line, separated by a comma or a semicolon. Lines not like
+// that (as a header) are skipped
+func ReadOutdoorFile(name string) (map[string]float64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	temps := map[string]float64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.FieldsFunc(scanner.Text(), func(r rune) bool { return r == ',' || r == ';' || r == '\t' })
+		if len(fields) < 2 {
+			continue
+		}
+		day, err := time.Parse(historyDayFormat, strings.TrimSpace(fields[0]))
+		if err != nil {
+			continue
+		}
+		temp, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil {
+			continue
+		}
+		temps[day.Format(historyDayFormat)] = temp
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(temps) == 0 {
+		return nil, errors.New(name + ": no daily temperatures, the lines should be like 2006-01-02,7.5")
+	}
+	return temps, nil
+}
+
+// OutdoorTemps returns the daily outdoor temperatures from from to to, from
+// the file and the sensor, nil if neither is configured. Errors are only
+// logged, the analytics go on without them
+func OutdoorTemps(h *History, from, to time.Time) map[string]float64 {
+	if OilOutdoorSensor == "" && OilOutdoorFile == "" {
+		return nil
+	}
+	temps := map[string]float64{}
+	if OilOutdoorFile != "" {
+		file, err := ReadOutdoorFile(OilOutdoorFile)
+		if err != nil {
+			log.Println("Error reading the outdoor temperatures:", err)
+		}
+		first, last := from.Format(historyDayFormat), to.Format(historyDayFormat)
+		for day, temp := range file {
+			if day >= first && day <= last {
+				temps[day] = temp
+			}
+		}
+	}
+	if OilOutdoorSensor != "" {
+		sensor, err := h.DailyTemps(OilOutdoorSensor, from, to)
+		if err != nil {
+			log.Println("Error reading the outdoor temperatures:", err)
+		}
+		for day, temp := range sensor {
+			temps[day] = temp
+		}
+	}
+	return temps
+}
+
+// minDegreeDays are the degree days a period needs to have its liters per
+// degree day: with fewer the hot water is most of the consumption, and the
+// ratio means nothing
+const minDegreeDays = 30
+
+// HeatingSeason returns the heating season (October to May) of t, named like
+// 2025/26, and whether t is in it at all (false in the summer months, in which
+// case the season is the one just gone)
+func HeatingSeason(t time.Time) (start time.Time, name string, in bool) {
+	year := t.Year()
+	if t.Month() < time.October {
+		year--
+	}
+	start = time.Date(year, time.October, 1, 0, 0, 0, 0, t.Location())
+	return start, fmt.Sprintf("%d/%02d", year, (year+1)%100), t.Before(start.AddDate(0, 8, 0))
+}
+
+// DegreeDayPeriodT is the consumption of a month or a season against its
+// degree days. Coverage is the fraction of its days with an outdoor
+// temperature, the degree days of the rest are taken as the average
+type DegreeDayPeriodT struct {
+	Name        string
+	From        time.Time
+	To          time.Time
+	Liters      float64
+	DegreeDays  float64
+	Coverage    float64
+	LitersPerDD float64 // 0 if unknown (too few degree days, see minDegreeDays)
+	MeanTemp    float64
+}
+
+// degreeDayPeriod fills the period out of the datums (cut to the datums) and
+// the daily temperatures, false if they do not cover any of it
+func degreeDayPeriod(name string, from, to time.Time, datums []oildata.Datapoint, temps map[string]float64) (DegreeDayPeriodT, bool) {
+	p := DegreeDayPeriodT{Name: name, From: from, To: to}
+	if len(datums) < 2 {
+		return p, false
+	}
+	if first := time.Unix(datums[0].Timestamp, 0); first.After(p.From) {
+		p.From = first
+	}
+	if last := time.Unix(datums[len(datums)-1].Timestamp, 0); last.Before(p.To) {
+		p.To = last
+	}
+	if !p.To.After(p.From) {
+		return p, false
+	}
+	p.Liters = OilConsumed(datums, p.From, p.To)
+	days, known, tempSum := 0, 0, 0.0
+	for day := dayStart(p.From); day.Before(p.To); day = day.AddDate(0, 0, 1) {
+		days++
+		if temp, ok := temps[day.Format(historyDayFormat)]; ok {
+			known++
+			tempSum += temp
+			p.DegreeDays += DegreeDays(temp)
+		}
+	}
+	if known > 0 {
+		p.Coverage = float64(known) / float64(days)
+		p.MeanTemp = tempSum / float64(known)
+		p.DegreeDays /= p.Coverage
+		if p.DegreeDays >= minDegreeDays {
+			p.LitersPerDD = p.Liters / p.DegreeDays
+		}
+	}
+	return p, true
+}
+
+// DegreeDayMonths returns the calendar months covered by the datums, oldest
+// first
+func DegreeDayMonths(datums []oildata.Datapoint, temps map[string]float64) []DegreeDayPeriodT {
+	var months []DegreeDayPeriodT
+	if len(datums) < 2 {
+		return months
+	}
+	first, last := time.Unix(datums[0].Timestamp, 0), time.Unix(datums[len(datums)-1].Timestamp, 0)
+	for m := time.Date(first.Year(), first.Month(), 1, 0, 0, 0, 0, first.Location()); m.Before(last); m = m.AddDate(0, 1, 0) {
+		if p, ok := degreeDayPeriod(m.Format("2006-01"), m, m.AddDate(0, 1, 0), datums, temps); ok {
+			months = append(months, p)
+		}
+	}
+	return months
+}
+
+// DegreeDaySeasons returns the heating seasons covered by the datums, oldest
+// first
+func DegreeDaySeasons(datums []oildata.Datapoint, temps map[string]float64) []DegreeDayPeriodT {
+	var seasons []DegreeDayPeriodT
+	if len(datums) < 2 {
+		return seasons
+	}
+	first, last := time.Unix(datums[0].Timestamp, 0), time.Unix(datums[len(datums)-1].Timestamp, 0)
+	start, _, _ := HeatingSeason(first)
+	for ; start.Before(last); start = start.AddDate(1, 0, 0) {
+		_, name, _ := HeatingSeason(start)
+		if p, ok := degreeDayPeriod(name, start, start.AddDate(0, 8, 0), datums, temps); ok {
+			seasons = append(seasons, p)
+		}
+	}
+	return seasons
+}
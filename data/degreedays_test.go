@@ -0,0 +1,186 @@
+package data
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	oildata "github.com/juliofaura/oilmeter/data"
+)
+
+func TestDegreeDays(t *testing.T) {
+	for temp, want := range map[float64]float64{-2: 17, 0: 15, 7.5: 7.5, 15: 0, 22: 0} {
+		if got := DegreeDays(temp); got != want {
+			t.Errorf("DegreeDays(%v) = %v, want %v", temp, got, want)
+		}
+	}
+}
+
+func TestReadOutdoorFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "outdoor.csv")
+	csv := "fecha,tmed\n" + // A header
+		"2026-01-10,7.5\n" +
+		"2026-01-11; -1.5\n" +
+		"2026-01-12\t3\n" +
+		"\n" +
+		"2026-01-13\n" + // No temperature
+		"13/01/2026,4\n" + // Not a date
+		"2026-01-14,n/d\n" + // Not a temperature
+		"2026-01-15,2,0.5,lluvia\n" // More fields are fine
+	if err := os.WriteFile(name, []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+	temps, err := ReadOutdoorFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"2026-01-10": 7.5, "2026-01-11": -1.5, "2026-01-12": 3, "2026-01-15": 2}
+	if len(temps) != len(want) {
+		t.Errorf("got %v, want %v", temps, want)
+	}
+	for day, temp := range want {
+		if got, ok := temps[day]; !ok || got != temp {
+			t.Errorf("%v: got %v, want %v", day, got, temp)
+		}
+	}
+
+	// Nothing usable is an error, as it must be the wrong file
+	if err := os.WriteFile(name, []byte("fecha,tmed\n13/01/2026,4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadOutdoorFile(name); err == nil {
+		t.Error("a file without temperatures did not fail")
+	}
+	if _, err := ReadOutdoorFile(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Error("a missing file did not fail")
+	}
+}
+
+func TestDailyTemps(t *testing.T) {
+	h, err := OpenHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 1, 10, 0, 0, 0, 0, time.Local)
+	for _, s := range []SampleT{
+		{Time: day.Add(6 * time.Hour), N: 1, Sensors: map[string]float64{"exterior": 2, "salon": 20}},
+		{Time: day.Add(14 * time.Hour), N: 1, Sensors: map[string]float64{"exterior": 8}},
+		{Time: day.Add(34 * time.Hour), N: 1, Sensors: map[string]float64{"salon": 21}}, // No outdoor reading on the 11th
+		{Time: day.Add(60 * time.Hour), N: 1, Sensors: map[string]float64{"exterior": -1}},
+	} {
+		if err := h.Record(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	temps, err := h.DailyTemps("exterior", day, day.AddDate(0, 0, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"2026-01-10": 5, "2026-01-12": -1}
+	if len(temps) != len(want) || temps["2026-01-10"] != 5 || temps["2026-01-12"] != -1 {
+		t.Errorf("got %v, want %v", temps, want)
+	}
+}
+
+func TestDegreeDayPeriod(t *testing.T) {
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+	var datums []oildata.Datapoint
+	for i := 0; i <= 10; i++ {
+		datums = append(datums, oildata.Datapoint{Timestamp: from.AddDate(0, 0, 5+i).Unix(), Liters: 1000 - 20*float64(i)})
+	}
+	temps := map[string]float64{}
+	for i := 5; i < 15; i += 2 {
+		temps[from.AddDate(0, 0, i).Format(historyDayFormat)] = 5 // 10 degree days, every other day
+	}
+
+	p, ok := degreeDayPeriod("2026-01", from, from.AddDate(0, 1, 0), datums, temps)
+	if !ok {
+		t.Fatal("the period was not covered")
+	}
+	if !p.From.Equal(from.AddDate(0, 0, 5)) || !p.To.Equal(from.AddDate(0, 0, 15)) {
+		t.Errorf("period from %v to %v, want cut to the datums", p.From, p.To)
+	}
+	if p.Liters != 200 || p.Coverage != 0.5 || p.DegreeDays != 100 || p.MeanTemp != 5 || p.LitersPerDD != 2 {
+		t.Errorf("got %+v", p)
+	}
+
+	// Too few degree days to tell the liters per degree day
+	for day := range temps {
+		temps[day] = 13
+	}
+	if p, _ := degreeDayPeriod("2026-01", from, from.AddDate(0, 1, 0), datums, temps); p.DegreeDays != 20 || p.LitersPerDD != 0 {
+		t.Errorf("with %v degree days got %v L/DD", p.DegreeDays, p.LitersPerDD)
+	}
+
+	if _, ok := degreeDayPeriod("2025-12", from.AddDate(0, -1, 0), from, datums, temps); ok {
+		t.Error("a period before the datums was covered")
+	}
+}
+
+func TestHeatingSeason(t *testing.T) {
+	tests := []struct {
+		t         time.Time
+		wantStart time.Time
+		wantName  string
+		wantIn    bool
+	}{
+		{time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local), time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local), "2026/27", true},
+		{time.Date(2027, 5, 31, 23, 0, 0, 0, time.Local), time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local), "2026/27", true},
+		{time.Date(2027, 6, 1, 0, 0, 0, 0, time.Local), time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local), "2026/27", false},
+		{time.Date(2026, 9, 30, 23, 0, 0, 0, time.Local), time.Date(2025, 10, 1, 0, 0, 0, 0, time.Local), "2025/26", false},
+		{time.Date(2099, 12, 1, 0, 0, 0, 0, time.Local), time.Date(2099, 10, 1, 0, 0, 0, 0, time.Local), "2099/00", true},
+	}
+	for _, tt := range tests {
+		start, name, in := HeatingSeason(tt.t)
+		if !start.Equal(tt.wantStart) || name != tt.wantName || in != tt.wantIn {
+			t.Errorf("HeatingSeason(%v) = %v %v %v, want %v %v %v", tt.t, start, name, in, tt.wantStart, tt.wantName, tt.wantIn)
+		}
+	}
+}
+
+// TestDailyTempsCache checks that the days over are read once, the ones
+// without readings too (cached as NaN), and that today is always read again
+func TestDailyTempsCache(t *testing.T) {
+	h, err := OpenHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	today := dayStart(now)
+	first := today.AddDate(0, 0, -2)
+	record := func(day time.Time, temp float64) {
+		t.Helper()
+		if err := h.Record(SampleT{Time: day, N: 1, Sensors: map[string]float64{"exterior": temp}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record(first, 4)
+	key := func(day time.Time) string { return day.Format(historyDayFormat) }
+
+	temps, err := h.DailyTemps("exterior", first, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(temps) != 1 || temps[key(first)] != 4 {
+		t.Errorf("got %v, want only %v", temps, key(first))
+	}
+	if cached := h.daily["exterior"][key(first.AddDate(0, 0, 1))]; !math.IsNaN(cached) {
+		t.Errorf("the day without readings cached as %v, want NaN", cached)
+	}
+	if _, ok := h.daily["exterior"][key(today)]; ok {
+		t.Error("today was cached")
+	}
+
+	// Readings showing up late for the days over are not seen, the ones of today are
+	record(first.AddDate(0, 0, 1), 6)
+	record(today, 8)
+	temps, err = h.DailyTemps("exterior", first, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(temps) != 2 || temps[key(first)] != 4 || temps[key(today)] != 8 {
+		t.Errorf("got %v, want the cached day and today", temps)
+	}
+}
@@ -0,0 +1,276 @@
+package data
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	oildata "github.com/juliofaura/oilmeter/data"
+)
+
+var (
+	ForecastDays = 730 // How far the forecast goes
+)
+
+const (
+	forecastMinWeeks = 8    // Weeks of data needed to compute the band, else forecastBand is used
+	forecastBand     = 0.25 // Default band, as a fraction of the consumption up and down
+)
+
+// OilMonthly returns the consumption of each month (January first) in
+// liters/day, out of all the (sorted and filtered) datums, 0 if unknown
+func OilMonthly(datums []oildata.Datapoint) [12]float64 {
+	var liters [12]float64
+	var seconds [12]int64
+	for i := 1; i < len(datums); i++ {
+		dif := datums[i-1].Liters - datums[i].Liters
+		if math.Abs(dif) < oildata.NewGasThreshold {
+			liters[datums[i].Month-1] += dif
+			seconds[datums[i].Month-1] += datums[i].Timestamp - datums[i-1].Timestamp
+		}
+	}
+	var monthly [12]float64
+	for m := range monthly {
+		if seconds[m] > 0 && liters[m] > 0 {
+			monthly[m] = liters[m] / float64(seconds[m]) * 24 * 60 * 60
+		}
+	}
+	return monthly
+}
+
+// oilModelT is the expected consumption (in liters/day) of each day: out of
+// the degree days if there is an outdoor sensor with enough data, else out of
+// the consumption of the month in previous years, else the current average
+type oilModelT struct {
+	monthly  [12]float64
+	average  float64
+	perDD    float64            // Liters per degree day, 0 without outdoor data
+	baseDD   float64            // Liters per day with no degree days
+	dayDD    map[string]float64 // Degree days of the days with readings
+	monthDD  [12]float64        // Mean degree days per day of each month
+	monthDDN [12]int
+}
+
+func (m oilModelT) rate(day time.Time) float64 {
+	if m.perDD > 0 {
+		if dd, ok := m.dayDD[day.Format(historyDayFormat)]; ok {
+			return m.baseDD + m.perDD*dd
+		}
+		if month := day.Month() - 1; m.monthDDN[month] > 0 {
+			return m.baseDD + m.perDD*m.monthDD[month]
+		}
+	}
+	if r := m.monthly[day.Month()-1]; r > 0 {
+		return r
+	}
+	return m.average
+}
+
+// meanRate is the mean expected consumption of the days from from (included)
+// to to (excluded)
+func (m oilModelT) meanRate(from, to time.Time) float64 {
+	total, n := 0.0, 0
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		total += m.rate(day)
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / float64(n)
+}
+
+// weeks calls f with each whole week covered by the datums
+func weeks(datums []oildata.Datapoint, f func(from, to time.Time)) {
+	if len(datums) < 2 {
+		return
+	}
+	first, last := time.Unix(datums[0].Timestamp, 0), time.Unix(datums[len(datums)-1].Timestamp, 0)
+	for from := dayStart(first).AddDate(0, 0, 1); !from.AddDate(0, 0, 7).After(last); from = from.AddDate(0, 0, 7) {
+		f(from, from.AddDate(0, 0, 7))
+	}
+}
+
+func dayStart(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// fitDegreeDays fits the daily consumption as a base (the hot water) plus
+// some liters per degree day, if there are enough weeks with both the oil and
+// the outdoor temperature (on 5 days at least)
+func (m *oilModelT) fitDegreeDays(datums []oildata.Datapoint) {
+	var xs, ys []float64
+	weeks(datums, func(from, to time.Time) {
+		dd, days := 0.0, 0
+		for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+			if v, ok := m.dayDD[day.Format(historyDayFormat)]; ok {
+				dd += v
+				days++
+			}
+		}
+		if days >= 5 {
+			xs = append(xs, dd/float64(days))
+			ys = append(ys, OilConsumed(datums, from, to)/7)
+		}
+	})
+	if len(xs) < forecastMinWeeks/2 {
+		return
+	}
+	var mx, my float64
+	for i := range xs {
+		mx += xs[i]
+		my += ys[i]
+	}
+	mx, my = mx/float64(len(xs)), my/float64(len(xs))
+	var sxy, sxx float64
+	for i := range xs {
+		sxy += (xs[i] - mx) * (ys[i] - my)
+		sxx += (xs[i] - mx) * (xs[i] - mx)
+	}
+	if sxx == 0 || sxy <= 0 {
+		return // The temperature does not explain the consumption
+	}
+	m.perDD = sxy / sxx
+	m.baseDD = math.Max(0, my-m.perDD*mx)
+}
+
+// OilLevelForecastT is when a level is reached: Date as expected, Earliest
+// with the consumption at the top of the band and Latest at the bottom. Zero
+// dates are beyond ForecastDays
+type OilLevelForecastT struct {
+	Name     string // warning, critical or empty
+	Liters   float64
+	Date     time.Time
+	Earliest time.Time
+	Latest   time.Time
+	Reached  bool // Already at the last reading, with the dates set to it
+}
+
+// OilForecastPointT is one day of the forecast, Low being the liters left
+// with the consumption at the top of the band
+type OilForecastPointT struct {
+	Time   time.Time
+	Liters float64
+	Low    float64
+	High   float64
+}
+
+// OilForecastT is the forecast of the oil left from the last reading
+type OilForecastT struct {
+	From     time.Time
+	Liters   float64
+	Rate     float64    // Expected consumption now, liters/day
+	Band     [2]float64 // Bottom and top of the band, relative to the expected consumption
+	Outdoor  bool       // Whether the outdoor temperature was used
+	Levels   []OilLevelForecastT
+	Forecast []OilForecastPointT // Daily, until empty (at the bottom of the band) or ForecastDays
+}
+
+// ForecastOil forecasts when the oil reaches OilWarning, OilCriticalWarning
+// and empty, out of the (sorted and filtered) datums and, if not nil, the
+// daily outdoor temperatures (see DailyTemps). The expected consumption of
+// each day is scaled so that the last days match the current average; the
+// band comes from how much the weekly consumption strayed from the expected
+func ForecastOil(datums []oildata.Datapoint, outdoor map[string]float64) (OilForecastT, bool) {
+	var f OilForecastT
+	if len(datums) == 0 {
+		return f, false
+	}
+	last := datums[len(datums)-1]
+	f.From, f.Liters = time.Unix(last.Timestamp, 0), last.Liters
+	m := oilModelT{monthly: OilMonthly(datums), average: OilAverage(datums), dayDD: map[string]float64{}}
+	for day, temp := range outdoor {
+		m.dayDD[day] = DegreeDays(temp)
+		if t, err := time.Parse(historyDayFormat, day); err == nil {
+			m.monthDD[t.Month()-1] += DegreeDays(temp)
+			m.monthDDN[t.Month()-1]++
+		}
+	}
+	for i := range m.monthDD {
+		if m.monthDDN[i] > 0 {
+			m.monthDD[i] /= float64(m.monthDDN[i])
+		}
+	}
+	m.fitDegreeDays(datums)
+	f.Outdoor = m.perDD > 0
+
+	// Scale to the current consumption
+	start := dayStart(f.From)
+	scale := 1.0
+	if expected := m.meanRate(start.Add(-time.Duration(oildata.TimeForAverage)*time.Second), start); expected > 0 && m.average > 0 {
+		scale = math.Min(4, math.Max(0.25, m.average/expected))
+	}
+
+	// The band, out of the actual against the expected weekly consumption
+	var ratios []float64
+	weeks(datums, func(from, to time.Time) {
+		if expected := m.meanRate(from, to); expected >= 0.5 {
+			ratios = append(ratios, OilConsumed(datums, from, to)/7/expected)
+		}
+	})
+	f.Band = [2]float64{1 - forecastBand, 1 + forecastBand}
+	if len(ratios) >= forecastMinWeeks {
+		sort.Float64s(ratios)
+		if median := percentile(ratios, 0.5); median > 0 {
+			f.Band = [2]float64{math.Min(1, percentile(ratios, 0.1)/median), math.Max(1, percentile(ratios, 0.9)/median)}
+		}
+	}
+
+	f.Rate = m.rate(start) * scale
+	f.Levels = []OilLevelForecastT{
+		{Name: "warning", Liters: OilWarning},
+		{Name: "critical", Liters: OilCriticalWarning},
+		{Name: "empty", Liters: 0},
+	}
+	for j := range f.Levels {
+		if l := &f.Levels[j]; f.Liters <= l.Liters {
+			l.Date, l.Earliest, l.Latest, l.Reached = f.From, f.From, f.From, true
+		}
+	}
+	liters, low, high := f.Liters, f.Liters, f.Liters
+	reached := func(before, after, level float64) bool { return before > level && after <= level }
+	for i := 1; i <= ForecastDays && high > 0; i++ {
+		day := start.AddDate(0, 0, i)
+		rate := m.rate(day.AddDate(0, 0, -1)) * scale
+		next, nextLow, nextHigh := liters-rate, low-rate*f.Band[1], high-rate*f.Band[0]
+		for j := range f.Levels {
+			l := &f.Levels[j]
+			if reached(liters, next, l.Liters) {
+				l.Date = day
+			}
+			if reached(low, nextLow, l.Liters) {
+				l.Earliest = day
+			}
+			if reached(high, nextHigh, l.Liters) {
+				l.Latest = day
+			}
+		}
+		liters, low, high = next, nextLow, nextHigh
+		f.Forecast = append(f.Forecast, OilForecastPointT{day, math.Max(0, liters), math.Max(0, low), math.Max(0, high)})
+	}
+	return f, true
+}
+
+// OilForecast is ForecastOil with the outdoor temperatures, if any (see
+// OutdoorTemps)
+func OilForecast(h *History, datums []oildata.Datapoint, now time.Time) (OilForecastT, bool) {
+	var outdoor map[string]float64
+	if len(datums) > 0 {
+		outdoor = OutdoorTemps(h, time.Unix(datums[0].Timestamp, 0), now)
+	}
+	return ForecastOil(datums, outdoor)
+}
+
+// percentile of the sorted values, interpolating
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := p * float64(len(sorted)-1)
+	i := int(pos)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (sorted[i+1]-sorted[i])*(pos-float64(i))
+}
@@ -0,0 +1,109 @@
+package data
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	oildata "github.com/juliofaura/oilmeter/data"
+)
+
+func datum(t time.Time, liters float64) oildata.Datapoint {
+	return oildata.Datapoint{
+		Timestamp: t.Unix(),
+		Year:      int64(t.Year()),
+		Month:     int64(t.Month()),
+		Day:       int64(t.Day()),
+		Weekday:   int64(t.Weekday()),
+		Hour:      int64(t.Hour()),
+		Minute:    int64(t.Minute()),
+		Liters:    liters,
+	}
+}
+
+// burning is a reading every 6 hours for the given days, starting with liters
+// on from and burning perDay(day) liters each day
+func burning(from time.Time, liters float64, days int, perDay func(day int) float64) []oildata.Datapoint {
+	var datums []oildata.Datapoint
+	for i := 0; i < days*4; i++ {
+		datums = append(datums, datum(from.Add(time.Duration(i)*6*time.Hour), liters))
+		liters -= perDay(i/4) / 4
+	}
+	return datums
+}
+
+func closeDays(a, b time.Time) bool {
+	return math.Abs(a.Sub(b).Hours()) <= 24
+}
+
+func TestForecastOil(t *testing.T) {
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+	datums := burning(from, 3000, 70, func(int) float64 { return 20 })
+	f, ok := ForecastOil(datums, nil)
+	if !ok {
+		t.Fatal("ForecastOil without a forecast")
+	}
+	if math.Abs(f.Rate-20) > 0.1 || f.Outdoor {
+		t.Errorf("Rate = %v (outdoor %v), want 20 out of the oil alone", f.Rate, f.Outdoor)
+	}
+	if f.Band != [2]float64{1, 1} {
+		t.Errorf("Band = %v, want none with a steady consumption", f.Band)
+	}
+	start := dayStart(f.From)
+	for _, l := range f.Levels {
+		want := start.AddDate(0, 0, int((f.Liters-l.Liters)/20))
+		if l.Reached || !closeDays(l.Date, want) || !l.Earliest.Equal(l.Date) || !l.Latest.Equal(l.Date) {
+			t.Errorf("level %v = %+v, want reached on %v", l.Name, l, want)
+		}
+	}
+	if last := f.Forecast[len(f.Forecast)-1]; last.High != 0 || len(f.Forecast) > 100 {
+		t.Errorf("the forecast ends at %+v after %v days, want empty in about 80", last, len(f.Forecast))
+	}
+
+	// Weeks burning 14 and 26 liters a day, so the same on average but a band
+	uneven := burning(from, 3000, 70, func(day int) float64 { return float64(14 + 12*(day/7%2)) })
+	f, _ = ForecastOil(uneven, nil)
+	if f.Band[0] >= 1 || f.Band[1] <= 1 {
+		t.Errorf("Band = %v, want around 1", f.Band)
+	}
+	for _, l := range f.Levels {
+		if !l.Earliest.Before(l.Date) || !l.Date.Before(l.Latest) {
+			t.Errorf("level %v from %v to %v, expected on %v", l.Name, l.Earliest, l.Latest, l.Date)
+		}
+	}
+
+	// Already under the warning
+	low := burning(from, 2200, 70, func(int) float64 { return 20 })
+	f, _ = ForecastOil(low, nil)
+	for _, l := range f.Levels {
+		wantReached := l.Name == "warning"
+		if l.Reached != wantReached || (l.Reached && !l.Date.Equal(f.From)) {
+			t.Errorf("level %v reached %v on %v, want reached %v", l.Name, l.Reached, l.Date, wantReached)
+		}
+	}
+
+	if _, ok := ForecastOil(nil, nil); ok {
+		t.Error("ForecastOil without datums should not forecast")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 4, 8}
+	tests := []struct {
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{sorted, 0, 1},
+		{sorted, 0.5, 3},
+		{sorted, 1, 8},
+		{sorted, 0.9, 6.8},
+		{[]float64{5}, 0.5, 5},
+		{nil, 0.5, 0},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.values, tt.p); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("percentile(%v, %v) = %v, want %v", tt.values, tt.p, got, tt.want)
+		}
+	}
+}
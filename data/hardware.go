@@ -0,0 +1,144 @@
+package data
+
+import (
+	"log"
+	"sync"
+
+	"github.com/stianeikeland/go-rpio"
+)
+
+// Relay is an output line driving one of the boiler relays
+type Relay interface {
+	Set(on bool)
+}
+
+// Input is a sense line, Read returns true when the line is active
+type Input interface {
+	Read() bool
+}
+
+var (
+	PowerPin1    = 14
+	PowerPin2    = 15
+	HeatPin      = 23
+	ReadPowerPin = 27
+	ReadHeatPin  = 17
+)
+
+var (
+	PowerRelay1 Relay
+	PowerRelay2 Relay
+	HeatRelay   Relay
+	PowerInput  Input
+	HeatInput   Input
+	Simulated   = false
+)
+
+///////////////////////////////////////////////////
+// rpio backed hardware
+///////////////////////////////////////////////////
+
+type rpioRelay struct {
+	pin rpio.Pin
+}
+
+func (r rpioRelay) Set(on bool) {
+	if on {
+		r.pin.Write(rpio.High)
+	} else {
+		r.pin.Write(rpio.Low)
+	}
+}
+
+type rpioInput struct {
+	pin       rpio.Pin
+	activeLow bool
+}
+
+func (i rpioInput) Read() bool {
+	if i.activeLow {
+		return i.pin.Read() == rpio.Low
+	}
+	return i.pin.Read() == rpio.High
+}
+
+// OpenRPIO maps the GPIO memory and configures the relay and sense pins
+func OpenRPIO() error {
+	if err := rpio.Open(); err != nil {
+		return err
+	}
+	power1, power2, heat := rpio.Pin(PowerPin1), rpio.Pin(PowerPin2), rpio.Pin(HeatPin)
+	readPower, readHeat := rpio.Pin(ReadPowerPin), rpio.Pin(ReadHeatPin)
+	power1.Output()
+	power2.Output()
+	heat.Output()
+	readPower.Input()
+	readPower.PullUp()
+	readHeat.Input()
+	readHeat.PullUp()
+
+	PowerRelay1 = rpioRelay{power1}
+	PowerRelay2 = rpioRelay{power2}
+	HeatRelay = rpioRelay{heat}
+	PowerInput = rpioInput{readPower, true}
+	HeatInput = rpioInput{readHeat, false}
+	Simulated = false
+	return nil
+}
+
+// CloseRPIO releases the relay pins (back to input) and unmaps the GPIO memory
+func CloseRPIO() {
+	rpio.Pin(PowerPin1).Input()
+	rpio.Pin(PowerPin2).Input()
+	rpio.Pin(HeatPin).Input()
+	rpio.Close()
+}
+
+///////////////////////////////////////////////////
+// Simulated hardware
+///////////////////////////////////////////////////
+
+// SimRelay is an in-memory relay, it just remembers its state
+type SimRelay struct {
+	mu sync.Mutex
+	on bool
+}
+
+func (r *SimRelay) Set(on bool) {
+	r.mu.Lock()
+	r.on = on
+	r.mu.Unlock()
+}
+
+func (r *SimRelay) IsOn() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.on
+}
+
+// SimInput reads as active when all of its relays are on, so the simulated
+// readings follow whatever the controller commands
+type SimInput struct {
+	Relays []*SimRelay
+}
+
+func (i SimInput) Read() bool {
+	for _, r := range i.Relays {
+		if !r.IsOn() {
+			return false
+		}
+	}
+	return true
+}
+
+// OpenSimulated wires in-memory relays and inputs instead of the GPIO pins
+func OpenSimulated() {
+	power1, power2, heat := &SimRelay{}, &SimRelay{}, &SimRelay{}
+	PowerRelay1 = power1
+	PowerRelay2 = power2
+	HeatRelay = heat
+	PowerInput = SimInput{[]*SimRelay{power1, power2}}
+	HeatInput = SimInput{[]*SimRelay{heat}}
+	Simulated = true
+	log.Println("Using simulated relays and inputs")
+}
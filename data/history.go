@@ -0,0 +1,381 @@
+package data
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SampleT is one point of the history. Raw samples are the thermostat ticks,
+// downsampled ones average N raw samples, so the on/off fields are the fraction
+// of the time the line was on (always 0 or 1 in raw samples)
+type SampleT struct {
+	Time        time.Time          `json:"t"`
+	N           int                `json:"n"`
+	TempOK      bool               `json:"ok"` // False if the reference temperature could not be read
+	Temp        float64            `json:"temp,omitempty"`
+	Sensors     map[string]float64 `json:"sensors,omitempty"` // Only the sensors read fine
+	Target      float64            `json:"target"`            // The effective one (away mode and overrides included)
+	Hysteresis  float64            `json:"hyst"`
+	Heat        float64            `json:"heat"`
+	HeatReading float64            `json:"heat_read"`
+	Power       float64            `json:"power"`
+	PowerRead   float64            `json:"power_read"`
+}
+
+func fraction(on bool) float64 {
+	if on {
+		return 1
+	}
+	return 0
+}
+
+// Sample takes a raw sample of the state
+func (s StateT) Sample(now time.Time) SampleT {
+	sample := SampleT{
+		Time:        now,
+		N:           1,
+		TempOK:      !s.ErrorInTemp,
+		Target:      s.EffectiveTarget(now),
+		Hysteresis:  s.Hysteresis,
+		Heat:        fraction(s.HeatOn),
+		HeatReading: fraction(s.HeatReading),
+		Power:       fraction(s.PowerOn),
+		PowerRead:   fraction(s.PowerReading),
+	}
+	if sample.TempOK {
+		sample.Temp = s.CurrentTemp
+	}
+	// Only the sensors actually read for the reference temperature
+	if !s.UsesAggregation() {
+		if sample.TempOK {
+			sample.Sensors = map[string]float64{s.Sensor: s.CurrentTemp}
+		}
+		return sample
+	}
+	for _, sensor := range s.Sensors {
+		if !sensor.ErrorInTemp { // Also set until the first reading
+			if sample.Sensors == nil {
+				sample.Sensors = map[string]float64{}
+			}
+			sample.Sensors[sensor.Name] = sensor.Temp
+		}
+	}
+	return sample
+}
+
+// bucketStart is the start of the bucket of t, on the wall clock of its
+// location: steps of days start at midnight (counted in whole days from the
+// first of January of 1970), shorter ones at midnight plus a multiple of the
+// step
+func bucketStart(t time.Time, step time.Duration) time.Time {
+	y, m, d := t.Date()
+	if step >= 24*time.Hour {
+		days := int(step / (24 * time.Hour))
+		day := int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60))
+		return time.Date(y, m, d-day%days, 0, 0, 0, 0, t.Location())
+	}
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	return midnight.Add(t.Sub(midnight).Truncate(step))
+}
+
+// Downsample averages the samples (which must be sorted) into buckets of the
+// given step, each one stamped with the start of its bucket (see bucketStart)
+func Downsample(samples []SampleT, step time.Duration) []SampleT {
+	var result []SampleT
+	var acc SampleT
+	var tempN int
+	sensorN := map[string]int{}
+	flush := func() {
+		if acc.N == 0 {
+			return
+		}
+		n := float64(acc.N)
+		if tempN > 0 {
+			acc.Temp /= float64(tempN)
+		}
+		acc.TempOK = tempN > 0
+		for name := range acc.Sensors {
+			acc.Sensors[name] /= float64(sensorN[name])
+		}
+		acc.Target /= n
+		acc.Hysteresis /= n
+		acc.Heat /= n
+		acc.HeatReading /= n
+		acc.Power /= n
+		acc.PowerRead /= n
+		result = append(result, acc)
+	}
+	for _, s := range samples {
+		bucket := bucketStart(s.Time, step)
+		if acc.N == 0 || !bucket.Equal(acc.Time) {
+			flush()
+			acc = SampleT{Time: bucket}
+			tempN = 0
+			sensorN = map[string]int{}
+		}
+		// Downsampled samples weigh as many raw ones as they stand for
+		w := float64(s.N)
+		acc.N += s.N
+		if s.TempOK {
+			acc.Temp += s.Temp * w
+			tempN += s.N
+		}
+		for name, temp := range s.Sensors {
+			if acc.Sensors == nil {
+				acc.Sensors = map[string]float64{}
+			}
+			acc.Sensors[name] += temp * w
+			sensorN[name] += s.N
+		}
+		acc.Target += s.Target * w
+		acc.Hysteresis += s.Hysteresis * w
+		acc.Heat += s.Heat * w
+		acc.HeatReading += s.HeatReading * w
+		acc.Power += s.Power * w
+		acc.PowerRead += s.PowerRead * w
+	}
+	flush()
+	return result
+}
+
+// TierT is one level of the history: samples at Resolution (0 for the raw
+// ticks) kept for Keep days (0 for ever)
+type TierT struct {
+	Name       string
+	Resolution time.Duration
+	Keep       int
+}
+
+var (
+	HistoryDir         = ".calderaHistory"
+	HistoryRawDays     = 7
+	HistoryQuarterDays = 90
+	HistoryHourlyDays  = 0
+)
+
+const historyDayFormat = "2006-01-02"
+
+// History is the store of the thermostat ticks. Each tier is a directory with
+// a file of JSON lines per day; once a day is over it is downsampled into the
+// next tier, and files past their tier retention are removed
+type History struct {
+	mu      sync.Mutex
+	dir     string
+	tiers   []TierT
+	lastDay string
+	daily   map[string]map[string]float64 // By sensor and day, of the days over (NaN if no readings), see DailyTemps
+}
+
+// OpenHistory opens (creating it if needed) the history store in dir, with
+// the configured retentions
+func OpenHistory(dir string) (*History, error) {
+	h := &History{
+		dir: dir,
+		tiers: []TierT{
+			{"raw", 0, HistoryRawDays},
+			{"15m", 15 * time.Minute, HistoryQuarterDays},
+			{"1h", time.Hour, HistoryHourlyDays},
+		},
+		daily: map[string]map[string]float64{},
+	}
+	for _, tier := range h.tiers {
+		if err := os.MkdirAll(filepath.Join(dir, tier.Name), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *History) dayFile(tier TierT, day string) string {
+	return filepath.Join(h.dir, tier.Name, day+".jsonl")
+}
+
+// Record appends a raw sample, compacting the store first if the day changed
+func (h *History) Record(sample SampleT) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	day := sample.Time.Format(historyDayFormat)
+	if day != h.lastDay {
+		if err := h.compact(sample.Time); err != nil {
+			log.Println("Error compacting the history:", err)
+		}
+		h.lastDay = day
+	}
+	raw, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.dayFile(h.tiers[0], day), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(raw, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// days lists the days with a file in the tier, sorted
+func (h *History) days(tier TierT) ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(h.dir, tier.Name, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, name := range names {
+		day := strings.TrimSuffix(filepath.Base(name), ".jsonl")
+		if _, err := time.Parse(historyDayFormat, day); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// Compact downsamples the finished days and applies the retentions
+func (h *History) Compact(now time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.compact(now)
+}
+
+func (h *History) compact(now time.Time) error {
+	today := now.Format(historyDayFormat)
+	var errs []error
+	for i := 1; i < len(h.tiers); i++ {
+		days, err := h.days(h.tiers[i-1])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, day := range days {
+			if day >= today {
+				continue
+			}
+			target := h.dayFile(h.tiers[i], day)
+			if _, err := os.Stat(target); err == nil {
+				continue
+			}
+			samples, err := readSamples(h.dayFile(h.tiers[i-1], day))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if err := writeSamples(target, Downsample(samples, h.tiers[i].Resolution)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, tier := range h.tiers {
+		if tier.Keep == 0 {
+			continue
+		}
+		oldest := now.AddDate(0, 0, -tier.Keep).Format(historyDayFormat)
+		days, err := h.days(tier)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, day := range days {
+			if day < oldest {
+				if err := os.Remove(h.dayFile(tier, day)); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func readSamples(name string) ([]SampleT, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var samples []SampleT
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s SampleT
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			// Most likely a line cut by a power failure, skip it
+			continue
+		}
+		samples = append(samples, s)
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	return samples, scanner.Err()
+}
+
+func writeSamples(name string, samples []SampleT) error {
+	var raw []byte
+	for _, s := range samples {
+		line, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		raw = append(append(raw, line...), '\n')
+	}
+	return WriteFileAtomic(name, raw, 0644)
+}
+
+// Query returns the samples between from and to (both included), sorted. Each
+// day comes from the finest tier that still has it. If step is not zero the
+// samples are downsampled to it
+func (h *History) Query(from, to time.Time, step time.Duration) ([]SampleT, error) {
+	if to.Before(from) {
+		return nil, errors.New("the end of the range is before its start")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var samples []SampleT
+	first := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	for day := first; !day.After(to); day = day.AddDate(0, 0, 1) {
+		for _, tier := range h.tiers {
+			daySamples, err := readSamples(h.dayFile(tier, day.Format(historyDayFormat)))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range daySamples {
+				if !s.Time.Before(from) && !s.Time.After(to) {
+					samples = append(samples, s)
+				}
+			}
+			break
+		}
+	}
+	if step > 0 {
+		samples = Downsample(samples, step)
+	}
+	return samples, nil
+}
+
+// ParseHistoryTime accepts "now", a duration back from now (like 90m, 24h or
+// 7d) or a date as in ParseAwayDate
+func ParseHistoryTime(str string, now time.Time) (time.Time, error) {
+	ago := strings.TrimPrefix(str, "-")
+	if days, err := strconv.Atoi(strings.TrimSuffix(ago, "d")); err == nil && strings.HasSuffix(ago, "d") {
+		return now.AddDate(0, 0, -days), nil
+	}
+	if d, err := time.ParseDuration(ago); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := ParseAwayDate(str, now)
+	if err != nil {
+		return t, errors.New("wrong time " + str + ", should be now, a duration back like 24h or 7d, or a date like 2006-01-02 or 2006-01-02T15:04")
+	}
+	return t, nil
+}
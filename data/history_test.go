@@ -0,0 +1,195 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDownsample(t *testing.T) {
+	start := at(time.Monday, 10, 0)
+	samples := []SampleT{
+		{Time: start, N: 1, TempOK: true, Temp: 20, Sensors: map[string]float64{"salon": 20}, Target: 21, Heat: 1},
+		{Time: start.Add(5 * time.Minute), N: 1, TempOK: false, Target: 21, Heat: 1},
+		{Time: start.Add(10 * time.Minute), N: 1, TempOK: true, Temp: 23, Sensors: map[string]float64{"salon": 22, "cocina": 24}, Target: 18},
+		// Already downsampled, weighs as 3
+		{Time: start.Add(15 * time.Minute), N: 3, TempOK: true, Temp: 19, Target: 17, Heat: 1.0 / 3},
+	}
+	got := Downsample(samples, 15*time.Minute)
+	if len(got) != 2 {
+		t.Fatalf("Downsample = %v samples, want 2", len(got))
+	}
+
+	first := got[0]
+	if !first.Time.Equal(start) || first.N != 3 {
+		t.Errorf("first bucket at %v with %v samples, want %v with 3", first.Time, first.N, start)
+	}
+	if !first.TempOK || first.Temp != 21.5 { // The failed reading is left out
+		t.Errorf("first bucket temp = %v (ok %v), want 21.5", first.Temp, first.TempOK)
+	}
+	if first.Sensors["salon"] != 21 || first.Sensors["cocina"] != 24 {
+		t.Errorf("first bucket sensors = %v, want salon 21 and cocina 24", first.Sensors)
+	}
+	if first.Target != 20 || first.Heat != 2.0/3 {
+		t.Errorf("first bucket target %v and heat %v, want 20 and %v", first.Target, first.Heat, 2.0/3)
+	}
+
+	second := got[1]
+	if second.N != 3 || second.Temp != 19 || second.Heat != 1.0/3 {
+		t.Errorf("second bucket = %+v, want the downsampled sample as it was", second)
+	}
+
+	if again := Downsample(got, time.Hour); len(again) != 1 || again[0].N != 6 || again[0].Heat != 0.5 {
+		t.Errorf("Downsample of the buckets = %+v, want one of 6 samples half the time heating", again)
+	}
+	if Downsample(nil, time.Hour) != nil {
+		t.Error("Downsample of nothing should be nothing")
+	}
+}
+
+// TestBucketStart checks that the buckets follow the local wall clock, not
+// UTC, also across the DST changes
+func TestBucketStart(t *testing.T) {
+	zone := func(name string) *time.Location {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Skip("no time zone data:", err)
+		}
+		return loc
+	}
+	tokyo, kolkata, madrid := zone("Asia/Tokyo"), zone("Asia/Kolkata"), zone("Europe/Madrid")
+	tests := []struct {
+		t    time.Time
+		step time.Duration
+		want time.Time
+	}{
+		{time.Date(2026, 10, 18, 6, 0, 0, 0, tokyo), 24 * time.Hour, time.Date(2026, 10, 18, 0, 0, 0, 0, tokyo)},
+		{time.Date(2026, 10, 18, 7, 40, 0, 0, tokyo), time.Hour, time.Date(2026, 10, 18, 7, 0, 0, 0, tokyo)},
+		{time.Date(2026, 10, 18, 7, 40, 0, 0, kolkata), time.Hour, time.Date(2026, 10, 18, 7, 0, 0, 0, kolkata)},
+		{time.Date(2026, 10, 18, 7, 40, 0, 0, kolkata), 15 * time.Minute, time.Date(2026, 10, 18, 7, 30, 0, 0, kolkata)},
+		// The clocks go back an hour at 3:00 on the 25th of October 2026
+		{time.Date(2026, 10, 25, 12, 10, 0, 0, madrid), time.Hour, time.Date(2026, 10, 25, 12, 0, 0, 0, madrid)},
+		{time.Date(2026, 10, 25, 23, 59, 0, 0, madrid), 24 * time.Hour, time.Date(2026, 10, 25, 0, 0, 0, 0, madrid)},
+		{time.Date(2026, 10, 26, 0, 30, 0, 0, madrid), 24 * time.Hour, time.Date(2026, 10, 26, 0, 0, 0, 0, madrid)},
+		// Weeks start on Thursdays, as the 1st of January of 1970
+		{time.Date(2026, 10, 18, 12, 0, 0, 0, madrid), 7 * 24 * time.Hour, time.Date(2026, 10, 15, 0, 0, 0, 0, madrid)},
+	}
+	for _, tt := range tests {
+		if got := bucketStart(tt.t, tt.step); !got.Equal(tt.want) {
+			t.Errorf("bucketStart(%v, %v) = %v, want %v", tt.t, tt.step, got, tt.want)
+		}
+	}
+
+	// A day of samples in Tokyo is one bucket, though it spans two UTC days
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, tokyo)
+	samples := []SampleT{{Time: day.Add(time.Hour), N: 1}, {Time: day.Add(12 * time.Hour), N: 1}, {Time: day.Add(23 * time.Hour), N: 1}}
+	if got := Downsample(samples, 24*time.Hour); len(got) != 1 || !got[0].Time.Equal(day) || got[0].N != 3 {
+		t.Errorf("Downsample of a day in Tokyo = %+v, want one bucket at its midnight", got)
+	}
+}
+
+// TestSample checks that only the sensors read go in the sample, 0 degrees
+// included
+func TestSample(t *testing.T) {
+	s := defaultState()
+	s.Aggregation = AggMin
+	s.addSensor("exterior", 1)
+	s.addSensor("salon", 1)
+	s.addSensor("cocina", 1) // Never read
+	s.Sensors[0].Temp, s.Sensors[0].ErrorInTemp = 0, false
+	s.Sensors[1].Temp, s.Sensors[1].ErrorInTemp = 20, false
+	s.CurrentTemp, s.ErrorInTemp = 0, false
+
+	sample := s.Sample(at(time.Monday, 10, 0))
+	if !sample.TempOK || sample.Temp != 0 {
+		t.Errorf("sample temp %v (ok %v), want 0", sample.Temp, sample.TempOK)
+	}
+	if len(sample.Sensors) != 2 || sample.Sensors["salon"] != 20 {
+		t.Errorf("sample sensors %v, want exterior at 0 and salon at 20", sample.Sensors)
+	}
+	if temp, ok := sample.Sensors["exterior"]; !ok || temp != 0 {
+		t.Errorf("exterior at 0 degrees left out of %v", sample.Sensors)
+	}
+}
+
+// TestHistoryCompact records two days of ticks and checks that the finished
+// day is downsampled, that the retentions apply and that Query reads each day
+// from the finest tier left
+func TestHistoryCompact(t *testing.T) {
+	rawDays := HistoryRawDays
+	HistoryRawDays = 1
+	t.Cleanup(func() { HistoryRawDays = rawDays })
+	h, err := OpenHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	monday := at(time.Monday, 0, 0)
+	for _, day := range []time.Time{monday, monday.AddDate(0, 0, 1)} {
+		for minute := 0; minute < 60; minute++ {
+			sample := SampleT{Time: day.Add(time.Duration(minute) * time.Minute), N: 1, TempOK: true, Temp: float64(minute), Target: 20}
+			if err := h.Record(sample); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Recording on Tuesday compacted Monday, but its raw samples are kept for a day
+	days, err := h.days(h.tiers[0])
+	if err != nil || len(days) != 2 {
+		t.Fatalf("raw days = %v (%v), want Monday and Tuesday", days, err)
+	}
+	samples, err := h.Query(monday, monday.Add(time.Hour), 0)
+	if err != nil || len(samples) != 60 {
+		t.Fatalf("Query of Monday = %v samples (%v), want the 60 raw ones", len(samples), err)
+	}
+
+	if err := h.Compact(monday.AddDate(0, 0, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if days, _ := h.days(h.tiers[0]); len(days) != 1 || days[0] != "2026-10-20" {
+		t.Errorf("raw days after compacting = %v, want only Tuesday", days)
+	}
+	samples, err = h.Query(monday, monday.AddDate(0, 0, 1).Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 4+60 {
+		t.Fatalf("Query of both days = %v samples, want 4 quarters and 60 raw", len(samples))
+	}
+	if samples[0].N != 15 || samples[0].Temp != 7 {
+		t.Errorf("first quarter = %+v, want 15 samples averaging 7", samples[0])
+	}
+	hourly, err := h.Query(monday, monday.Add(time.Hour), time.Hour)
+	if err != nil || len(hourly) != 1 || hourly[0].N != 60 || hourly[0].Temp != 29.5 {
+		t.Errorf("hourly Query = %+v (%v), want one of 60 samples averaging 29.5", hourly, err)
+	}
+
+	if _, err := h.Query(monday.Add(time.Hour), monday, 0); err == nil {
+		t.Error("Query with the end before the start should fail")
+	}
+}
+
+func TestParseHistoryTime(t *testing.T) {
+	now := at(time.Monday, 12, 0)
+	tests := []struct {
+		str     string
+		want    time.Time
+		wantErr bool
+	}{
+		{"now", now, false},
+		{"90m", now.Add(-90 * time.Minute), false},
+		{"-24h", now.Add(-24 * time.Hour), false},
+		{"7d", now.AddDate(0, 0, -7), false},
+		{"2026-10-01", time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local), false},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseHistoryTime(tt.str, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseHistoryTime(%q) error = %v, want error %v", tt.str, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseHistoryTime(%q) = %v, want %v", tt.str, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The CSV config used before the JSON one, only read to migrate it
+const (
+	legacyConfigFileName = ".calderaConfig"
+	migratedSuffix       = ".migrated"
+)
+
+// migrateLegacyConfig reads the old CSV config, writes it as the new config and
+// renames the old file out of the way. It returns false if there was nothing
+// to migrate
+func migrateLegacyConfig(s *StateT) (bool, error) {
+	if _, err := os.Stat(legacyConfigFileName); err != nil {
+		return false, nil
+	}
+	if err := readLegacyConfig(s); err != nil {
+		return false, fmt.Errorf("%v: %w", legacyConfigFileName, err)
+	}
+	if err := s.config().Validate(); err != nil {
+		return false, fmt.Errorf("%v: %w", legacyConfigFileName, err)
+	}
+	if err := writeConfig(*s); err != nil {
+		return false, err
+	}
+	os.Rename(legacyConfigFileName, legacyConfigFileName+migratedSuffix)
+	log.Printf("Old config migrated to %v", ConfigFileName)
+	fmt.Printf("Old config migrated to %v\n", ConfigFileName)
+	return true, nil
+}
+
+func parseLegacyBool(str string) (bool, error) {
+	switch str {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, errors.New("wrong boolean " + str)
+}
+
+// readLegacyConfig parses the single CSV line:
+// PowerOn,ThermostatOn,HeatOn,Sensor,TargetTemp,Hysteresis
+func readLegacyConfig(st *StateT) error {
+	raw, err := os.ReadFile(legacyConfigFileName)
+	if err != nil {
+		return err
+	}
+	s := strings.Split(strings.TrimSpace(string(raw)), ",")
+	if len(s) != 6 {
+		return fmt.Errorf("expected 6 fields, found %v", len(s))
+	}
+	powerOn, err := parseLegacyBool(s[0])
+	if err != nil {
+		return err
+	}
+	thermostatOn, err := parseLegacyBool(s[1])
+	if err != nil {
+		return err
+	}
+	heatOn, err := parseLegacyBool(s[2])
+	if err != nil {
+		return err
+	}
+	targetTemp, err := strconv.ParseFloat(s[4], 64)
+	if err != nil {
+		return err
+	}
+	hysteresis, err := strconv.ParseFloat(s[5], 64)
+	if err != nil {
+		return err
+	}
+	st.PowerOn = powerOn
+	st.ThermostatOn = thermostatOn
+	st.HeatOn = heatOn
+	st.Sensor = s[3]
+	st.TargetTemp = targetTemp
+	st.Hysteresis = hysteresis
+	return nil
+}
@@ -0,0 +1,231 @@
+package data
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Types of notifiers
+const (
+	NotifySMTP     = "smtp"
+	NotifyWebhook  = "webhook"
+	NotifyTelegram = "telegram"
+)
+
+var NotifierTypes = []string{NotifySMTP, NotifyWebhook, NotifyTelegram}
+
+const (
+	notifyTimeout      = 15 * time.Second
+	defaultTelegramAPI = "https://api.telegram.org"
+)
+
+// NotifierConfigT is one notifier. Which fields apply depends on the type:
+//   - smtp: Host (host:port), From, To, and Username and PasswordFile if the
+//     server needs them (STARTTLS is used if offered)
+//   - webhook: URL, which gets the alert POSTed as JSON
+//   - telegram: PasswordFile with the bot token, ChatID, and URL only to use
+//     other than the Telegram API
+type NotifierConfigT struct {
+	Type         string   `json:"type"`
+	MinLevel     string   `json:"min_level,omitempty"` // warning (by default) or critical
+	URL          string   `json:"url,omitempty"`
+	Host         string   `json:"host,omitempty"`
+	From         string   `json:"from,omitempty"`
+	To           []string `json:"to,omitempty"`
+	Username     string   `json:"username,omitempty"`
+	PasswordFile string   `json:"password_file,omitempty"`
+	ChatID       string   `json:"chat_id,omitempty"`
+}
+
+func (c NotifierConfigT) Validate() error {
+	if c.MinLevel != "" && alertRank(c.MinLevel) < 0 {
+		return fmt.Errorf("unknown min_level %q", c.MinLevel)
+	}
+	switch c.Type {
+	case NotifySMTP:
+		if _, _, err := net.SplitHostPort(c.Host); err != nil {
+			return fmt.Errorf("wrong host %q, should be host:port", c.Host)
+		}
+		if c.From == "" || len(c.To) == 0 {
+			return errors.New("from and to are needed")
+		}
+	case NotifyWebhook:
+		if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+			return fmt.Errorf("wrong url %q", c.URL)
+		}
+	case NotifyTelegram:
+		if c.PasswordFile == "" || c.ChatID == "" {
+			return errors.New("password_file (with the bot token) and chat_id are needed")
+		}
+	default:
+		return fmt.Errorf("unknown type %q, should be one of %v", c.Type, strings.Join(NotifierTypes, ", "))
+	}
+	return nil
+}
+
+func readSecret(name string) (string, error) {
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// NewNotifier builds the notifier of a (valid) config, reading its secret
+func NewNotifier(c NotifierConfigT) (Notifier, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var secret string
+	if c.PasswordFile != "" {
+		var err error
+		if secret, err = readSecret(c.PasswordFile); err != nil {
+			return nil, err
+		}
+	}
+	switch c.Type {
+	case NotifySMTP:
+		n := smtpNotifier{host: c.Host, from: c.From, to: c.To}
+		if c.Username != "" {
+			host, _, _ := net.SplitHostPort(c.Host)
+			n.auth = smtp.PlainAuth("", c.Username, secret, host)
+		}
+		return n, nil
+	case NotifyWebhook:
+		return webhookNotifier{c.URL}, nil
+	default:
+		api := defaultTelegramAPI
+		if c.URL != "" {
+			api = strings.TrimSuffix(c.URL, "/")
+		}
+		return telegramNotifier{api + "/bot" + secret + "/sendMessage", c.ChatID}, nil
+	}
+}
+
+var levelNames = map[string]string{AlertWarning: "AVISO", AlertCritical: "CRÍTICO"}
+
+// alertSubject and alertText are the alert for people
+func alertSubject(a AlertT) string {
+	tag := levelNames[a.Level]
+	if a.Resolved {
+		tag = "RESUELTO"
+	}
+	return "[" + tag + "] " + a.Title
+}
+
+func alertText(a AlertT) string {
+	return alertSubject(a) + "\n" + a.Message
+}
+
+type smtpNotifier struct {
+	host string
+	from string
+	to   []string
+	auth smtp.Auth
+}
+
+func (n smtpNotifier) Notify(a AlertT) error {
+	conn, err := net.DialTimeout("tcp", n.host, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+	host, _, _ := net.SplitHostPort(n.host)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.auth != nil {
+		if err := c.Auth(n.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return err
+	}
+	for _, to := range n.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	msg := "From: " + n.from + "\r\n" +
+		"To: " + strings.Join(n.to, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", alertSubject(a)) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n\r\n" +
+		strings.ReplaceAll(a.Message, "\n", "\r\n") + "\r\n"
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+var notifyClient = &http.Client{Timeout: notifyTimeout}
+
+// postJSON posts v, failing if the answer is not a 2xx
+func postJSON(target string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(target, "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+type webhookNotifier struct {
+	url string
+}
+
+func (n webhookNotifier) Notify(a AlertT) error {
+	return postJSON(n.url, a)
+}
+
+type telegramNotifier struct {
+	url    string // Has the token in it, so it must never be logged
+	chatID string
+}
+
+func (n telegramNotifier) Notify(a AlertT) error {
+	err := postJSON(n.url, map[string]string{"chat_id": n.chatID, "text": alertText(a)})
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("telegram: %w", urlErr.Err) // Without the URL
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package data
+
+import (
+	"math"
+
+	oildata "github.com/juliofaura/oilmeter/data"
+	"github.com/juliofaura/oilmeter/files"
+)
+
+// The oil data are written by the oilmeter (see files.DataFile), one reading
+// of the tank per line
+
+// OilFilteringThreshold drops the readings too far (in liters) from their
+// neighbours, which are sensor glitches
+const OilFilteringThreshold = 50
+
+// ReadOil returns the last oil reading and the daily consumption, ok is false
+// if there are no (good) data
+func ReadOil() (last oildata.Datapoint, average float64, ok bool) {
+	datums, err := ReadOilDatums()
+	if err != nil || len(datums) == 0 {
+		return last, 0, false
+	}
+	return datums[len(datums)-1], OilAverage(datums), true
+}
+
+// ReadOilDatums reads the oil data, without the glitches
+func ReadOilDatums() ([]oildata.Datapoint, error) {
+	datums, err := files.ReadDataFile(files.DataFile)
+	if err != nil {
+		return nil, err
+	}
+	return files.FilterDatafile(datums, OilFilteringThreshold), nil
+}
+
+// OilAverage is the daily consumption over the last oildata.TimeForAverage,
+// leaving the refills out
+func OilAverage(datums []oildata.Datapoint) float64 {
+	if len(datums) == 0 {
+		return 0
+	}
+	var average = 0.0
+	firstPointForAverage, endingPointForAverage := datums[len(datums)-1], datums[len(datums)-1]
+	var bigChanges = 0.0
+	for i := len(datums) - 2; i >= 0; i-- {
+		if math.Abs(datums[i].Liters-datums[i+1].Liters) > oildata.NewGasThreshold {
+			bigChanges += datums[i+1].Liters - datums[i].Liters
+		}
+		firstPointForAverage = datums[i]
+		if endingPointForAverage.Timestamp-firstPointForAverage.Timestamp >= int64(oildata.TimeForAverage) {
+			break
+		}
+	}
+
+	if firstPointForAverage.Timestamp != endingPointForAverage.Timestamp {
+		average = -float64(endingPointForAverage.Liters-firstPointForAverage.Liters-bigChanges) / (float64(endingPointForAverage.Timestamp-firstPointForAverage.Timestamp) / (24 * 60 * 60))
+	}
+	return average
+}
@@ -0,0 +1,46 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic replaces the file with the given contents so that, whatever
+// happens (power cut included), the file has either its old or its new
+// contents: it writes a temporary file in the same directory, syncs it to disk
+// and renames it over the old one
+func WriteFileAtomic(name string, raw []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(name)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+	// And the directory, so the rename itself is on disk
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
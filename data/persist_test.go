@@ -0,0 +1,59 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "config.json")
+	for _, contents := range []string{"first", "second, longer than the first"} {
+		if err := WriteFileAtomic(name, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := os.ReadFile(name)
+		if err != nil || string(raw) != contents {
+			t.Errorf("read %q (%v), want %q", raw, err, contents)
+		}
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("permissions are %v, want 0600", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("found %v files, want only the config (no temporary file left)", len(entries))
+	}
+}
+
+// TestWriteFileAtomicFailure checks that a failed write leaves the old file
+// (here a directory, so the rename fails) and no temporary file behind
+func TestWriteFileAtomicFailure(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "config.json")
+	if err := os.Mkdir(name, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(name, "inside"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(name, []byte("new"), 0644); err == nil {
+		t.Fatal("replaced a directory")
+	}
+	if raw, err := os.ReadFile(filepath.Join(name, "inside")); err != nil || string(raw) != "old" {
+		t.Errorf("old contents gone: %q (%v)", raw, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("found %v files, want no temporary file left", len(entries))
+	}
+
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "config.json"), []byte("new"), 0644); err == nil {
+		t.Error("wrote into a missing directory")
+	}
+}
@@ -0,0 +1,193 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	oildata "github.com/juliofaura/oilmeter/data"
+)
+
+var (
+	RefillsFileName = ".calderaRefills.json"
+	RefillMerge     = 12 * time.Hour // Jumps this close are the same refill (readings during the delivery, or the tank settling)
+)
+
+const RefillDayFormat = "2006-01-02" // Refills are known by their day
+
+// RefillT is a delivery of oil, as seen in the oil readings: the tank jumped
+// more than oildata.NewGasThreshold. The price is entered by the user
+type RefillT struct {
+	Time   time.Time `json:"time"` // First reading after the jump
+	Before float64   `json:"before"`
+	After  float64   `json:"after"`
+	Price  float64   `json:"price,omitempty"` // Paid in total, 0 if unknown
+}
+
+func (r RefillT) Day() string {
+	return r.Time.Format(RefillDayFormat)
+}
+
+func (r RefillT) Liters() float64 {
+	return r.After - r.Before
+}
+
+// PricePerLiter is 0 if the price is unknown
+func (r RefillT) PricePerLiter() float64 {
+	if r.Liters() <= 0 {
+		return 0
+	}
+	return r.Price / r.Liters()
+}
+
+// DetectRefills finds the refills in the (sorted and filtered) datums
+func DetectRefills(datums []oildata.Datapoint) []RefillT {
+	var refills []RefillT
+	for i := 1; i < len(datums); i++ {
+		if datums[i].Liters-datums[i-1].Liters <= oildata.NewGasThreshold {
+			continue
+		}
+		t := time.Unix(datums[i].Timestamp, 0)
+		if n := len(refills); n > 0 && t.Sub(refills[n-1].Time) <= RefillMerge {
+			refills[n-1].After = datums[i].Liters
+			continue
+		}
+		refills = append(refills, RefillT{Time: t, Before: datums[i-1].Liters, After: datums[i].Liters})
+	}
+	return refills
+}
+
+// RefillStore keeps the refills found so far, so they (and their prices) are
+// not lost when the old readings are gone from the oil data file
+type RefillStore struct {
+	mu      sync.Mutex
+	name    string
+	refills []RefillT // Oldest first
+}
+
+// OpenRefills reads the refills, the file is created on the first refill
+func OpenRefills(name string) (*RefillStore, error) {
+	s := &RefillStore{name: name}
+	raw, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &s.refills); err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	return s, nil
+}
+
+// save must be called with the lock held
+func (s *RefillStore) save() error {
+	raw, err := json.MarshalIndent(s.refills, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.name, append(raw, '\n'), 0644)
+}
+
+// Update adds the refills detected in the datums that were not known yet, and
+// updates the liters of the known ones (a delivery may have been read half
+// way). It returns the new ones
+func (s *RefillStore) Update(datums []oildata.Datapoint) ([]RefillT, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var added []RefillT
+	changed := false
+	for _, d := range DetectRefills(datums) {
+		known := false
+		for i := range s.refills {
+			r := &s.refills[i]
+			if dif := d.Time.Sub(r.Time); dif >= -RefillMerge && dif <= RefillMerge {
+				known = true
+				if r.Before != d.Before || r.After != d.After {
+					r.Before, r.After = d.Before, d.After
+					changed = true
+				}
+				break
+			}
+		}
+		if !known {
+			s.refills = append(s.refills, d)
+			added = append(added, d)
+			changed = true
+			log.Printf("Refill detected on %v: %.0f liters (%.0f to %.0f)", d.Time.Format("2006-01-02 15:04"), d.Liters(), d.Before, d.After)
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	sort.SliceStable(s.refills, func(i, j int) bool { return s.refills[i].Time.Before(s.refills[j].Time) })
+	return added, s.save()
+}
+
+// List returns the refills, oldest first
+func (s *RefillStore) List() []RefillT {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]RefillT{}, s.refills...)
+}
+
+// SetPrice sets what was paid for the refill of the day (see RefillDayFormat),
+// returning the previous price
+func (s *RefillStore) SetPrice(day string, price float64) (float64, error) {
+	if price < 0 {
+		return 0, invalidf("negative price %v", price)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.refills {
+		if r := &s.refills[i]; r.Day() == day {
+			old := r.Price
+			r.Price = price
+			return old, s.save()
+		}
+	}
+	return 0, invalidf("no refill on %v", day)
+}
+
+// RefillPeriodT is the time from a refill to the next one (or to the last
+// reading): the oil burnt, per day, and its cost at the price of the refill.
+// Complete is false if the oil data do not cover the whole period any more
+type RefillPeriodT struct {
+	Refill   RefillT
+	To       time.Time
+	Days     float64
+	Consumed float64
+	PerDay   float64
+	Cost     float64
+	Complete bool
+}
+
+// RefillPeriods returns the periods of each refill, oldest first
+func RefillPeriods(refills []RefillT, datums []oildata.Datapoint) []RefillPeriodT {
+	var periods []RefillPeriodT
+	if len(datums) == 0 {
+		return periods
+	}
+	first, last := time.Unix(datums[0].Timestamp, 0), time.Unix(datums[len(datums)-1].Timestamp, 0)
+	for i, r := range refills {
+		p := RefillPeriodT{Refill: r, To: last}
+		if i+1 < len(refills) {
+			p.To = refills[i+1].Time.Add(-time.Second) // Without the jump of the next one
+		}
+		p.Complete = !first.After(r.Time)
+		p.Days = p.To.Sub(r.Time).Hours() / 24
+		p.Consumed = OilConsumed(datums, r.Time, p.To)
+		if p.Days > 0 {
+			p.PerDay = p.Consumed / p.Days
+		}
+		p.Cost = p.Consumed * r.PricePerLiter()
+		periods = append(periods, p)
+	}
+	return periods
+}
@@ -0,0 +1,130 @@
+package data
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	oildata "github.com/juliofaura/oilmeter/data"
+)
+
+var refillStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+
+// refillDatums are 20 liters a day, with a refill in two readings on day 10
+// and another one on day 20
+func refillDatums() []oildata.Datapoint {
+	datums := burning(refillStart, 1000, 30, func(int) float64 { return 20 })
+	for i := range datums {
+		switch day := i / 4; {
+		case day >= 20:
+			datums[i].Liters += 1500 + 1000
+		case i == 40:
+			datums[i].Liters += 1000 // Half the delivery read
+		case day >= 10:
+			datums[i].Liters += 1500
+		}
+	}
+	return datums
+}
+
+func TestDetectRefills(t *testing.T) {
+	refills := DetectRefills(refillDatums())
+	if len(refills) != 2 {
+		t.Fatalf("DetectRefills = %+v, want 2 refills", refills)
+	}
+	tests := []struct {
+		day    string
+		liters float64
+	}{
+		{"2026-01-11", 1500},
+		{"2026-01-21", 1000},
+	}
+	for i, tt := range tests {
+		r := refills[i]
+		if r.Day() != tt.day || math.Abs(r.Liters()-tt.liters) > 15 {
+			t.Errorf("refill %v = %v liters on %v, want %v on %v", i, r.Liters(), r.Day(), tt.liters, tt.day)
+		}
+	}
+
+	merge := RefillMerge
+	RefillMerge = time.Hour
+	t.Cleanup(func() { RefillMerge = merge })
+	if refills := DetectRefills(refillDatums()); len(refills) != 3 {
+		t.Errorf("DetectRefills without merging = %v refills, want 3", len(refills))
+	}
+}
+
+func TestRefillStore(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "refills.json")
+	s, err := OpenRefills(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datums := refillDatums()
+	// The first delivery read half way
+	added, err := s.Update(datums[:41])
+	if err != nil || len(added) != 1 || added[0].Liters() > 1100 {
+		t.Fatalf("Update = %+v (%v), want the half refill", added, err)
+	}
+	added, err = s.Update(datums)
+	if err != nil || len(added) != 1 || added[0].Day() != "2026-01-21" {
+		t.Fatalf("Update = %+v (%v), want only the refill of the 21st", added, err)
+	}
+	if added, err := s.Update(datums); added != nil || err != nil {
+		t.Errorf("Update again = %+v (%v), want nothing new", added, err)
+	}
+
+	if _, err := s.SetPrice("2026-01-11", 1500); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetPrice("2026-01-12", 1000); !errors.Is(err, ErrInvalid) {
+		t.Errorf("SetPrice of a day without refill error = %v, want ErrInvalid", err)
+	}
+	if _, err := s.SetPrice("2026-01-21", -1); !errors.Is(err, ErrInvalid) {
+		t.Errorf("SetPrice with a negative price error = %v, want ErrInvalid", err)
+	}
+
+	// Read back, with the whole first delivery and its price
+	s, err = OpenRefills(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refills := s.List()
+	if len(refills) != 2 || math.Abs(refills[0].Liters()-1500) > 15 || refills[0].Price != 1500 {
+		t.Fatalf("refills read back = %+v, want 2 with the first one whole and priced", refills)
+	}
+	if p := refills[0].PricePerLiter(); math.Abs(p-1) > 0.01 {
+		t.Errorf("PricePerLiter = %v, want 1", p)
+	}
+}
+
+func TestRefillPeriods(t *testing.T) {
+	datums := refillDatums()
+	refills := DetectRefills(datums)
+	refills[0].Price = 1500
+	periods := RefillPeriods(refills, datums)
+	if len(periods) != 2 {
+		t.Fatalf("RefillPeriods = %v periods, want 2", len(periods))
+	}
+	for i, p := range periods {
+		if !p.Complete || math.Abs(p.PerDay-20) > 1 {
+			t.Errorf("period %v = %+v, want complete at 20 liters a day", i, p)
+		}
+	}
+	if first := periods[0]; !first.To.Before(refills[1].Time) || math.Abs(first.Cost-first.Consumed) > 5 {
+		t.Errorf("first period to %v costing %v, want up to the next refill at about 1 a liter", first.To, first.Cost)
+	}
+	if periods[1].Cost != 0 {
+		t.Errorf("second period cost %v, want 0 without a price", periods[1].Cost)
+	}
+
+	// Once the readings of the first refill are gone
+	if periods := RefillPeriods(refills, datums[60:]); periods[0].Complete || !periods[1].Complete {
+		t.Errorf("with the first readings gone, complete = %v and %v, want false and true", periods[0].Complete, periods[1].Complete)
+	}
+	if periods := RefillPeriods(refills, nil); len(periods) != 0 {
+		t.Errorf("RefillPeriods without datums = %v, want none", periods)
+	}
+}
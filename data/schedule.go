@@ -0,0 +1,194 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	minutesPerDay  = 24 * 60
+	minutesPerWeek = 7 * minutesPerDay
+)
+
+var DayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// SlotT is a slot of the weekly program, it starts at Day/Start (minutes from
+// midnight) and lasts until the next slot of the week starts
+type SlotT struct {
+	Day    time.Weekday
+	Start  int
+	Target float64
+}
+
+// OverrideT is a manual target that holds until the next slot boundary
+type OverrideT struct {
+	Target float64
+	Until  time.Time
+}
+
+func (s SlotT) weekMinute() int {
+	return int(s.Day)*minutesPerDay + s.Start
+}
+
+func (s SlotT) StartString() string {
+	return fmt.Sprintf("%02d:%02d", s.Start/60, s.Start%60)
+}
+
+func (s SlotT) String() string {
+	return fmt.Sprintf("%v %v %.2f", DayNames[s.Day], s.StartString(), s.Target)
+}
+
+func weekMinuteOf(t time.Time) int {
+	return int(t.Weekday())*minutesPerDay + t.Hour()*60 + t.Minute()
+}
+
+// ParseDays accepts a day (mon), a range (mon-fri), a comma separated list of
+// those, or one of all, weekdays and weekend
+func ParseDays(str string) (days []time.Weekday, err error) {
+	switch str {
+	case "all":
+		return []time.Weekday{0, 1, 2, 3, 4, 5, 6}, nil
+	case "weekdays":
+		return []time.Weekday{1, 2, 3, 4, 5}, nil
+	case "weekend":
+		return []time.Weekday{6, 0}, nil
+	}
+	for _, part := range strings.Split(str, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := parseDay(from)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			if last, err = parseDay(to); err != nil {
+				return nil, err
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days = append(days, d)
+			if d == last {
+				break
+			}
+		}
+	}
+	return
+}
+
+func parseDay(str string) (time.Weekday, error) {
+	for i, v := range DayNames {
+		if v == str {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, errors.New("wrong day " + str)
+}
+
+// ParseHour parses HH:MM into minutes from midnight
+func ParseHour(str string) (int, error) {
+	t, err := time.Parse("15:04", str)
+	if err != nil {
+		return 0, errors.New("wrong hour " + str)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// setSlot adds a slot, replacing the target if there is one already starting
+// at the same time
+func (s *StateT) setSlot(day time.Weekday, start int, target float64) {
+	for i := range s.Schedule {
+		if s.Schedule[i].Day == day && s.Schedule[i].Start == start {
+			s.Schedule[i].Target = target
+			return
+		}
+	}
+	s.Schedule = append(s.Schedule, SlotT{Day: day, Start: start, Target: target})
+	sort.Slice(s.Schedule, func(i, j int) bool { return s.Schedule[i].weekMinute() < s.Schedule[j].weekMinute() })
+}
+
+func (s *StateT) removeSlot(day time.Weekday, start int) bool {
+	for i := range s.Schedule {
+		if s.Schedule[i].Day == day && s.Schedule[i].Start == start {
+			s.Schedule = append(s.Schedule[:i], s.Schedule[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveSlot returns the slot in force at the given time, that is the last one
+// started (wrapping around the end of the week)
+func (s StateT) ActiveSlot(now time.Time) (slot SlotT, ok bool) {
+	if len(s.Schedule) == 0 {
+		return
+	}
+	slot = s.Schedule[len(s.Schedule)-1]
+	m := weekMinuteOf(now)
+	for _, v := range s.Schedule {
+		if v.weekMinute() > m {
+			break
+		}
+		slot = v
+	}
+	return slot, true
+}
+
+// NextBoundary returns when the next slot of the program starts. It is built
+// from the wall clock, so a DST change in between does not move it
+func (s StateT) NextBoundary(now time.Time) (time.Time, bool) {
+	if len(s.Schedule) == 0 {
+		return time.Time{}, false
+	}
+	m := weekMinuteOf(now)
+	next, days := s.Schedule[0], 7 // Next week's first slot, unless there is one later this week
+	for _, v := range s.Schedule {
+		if v.weekMinute() > m {
+			next, days = v, 0
+			break
+		}
+	}
+	days += int(next.Day) - int(now.Weekday())
+	y, mo, d := now.Date()
+	return time.Date(y, mo, d+days, next.Start/60, next.Start%60, 0, 0, now.Location()), true
+}
+
+// setTarget changes the target temperature by hand. With the schedule on, the
+// new target is an override that lasts until the next slot starts
+func (s *StateT) setTarget(target float64, now time.Time) {
+	s.TargetTemp = target
+	if !s.ScheduleOn {
+		return
+	}
+	if until, ok := s.NextBoundary(now); ok {
+		s.Override = &OverrideT{Target: target, Until: until}
+		log.Printf("Target overridden to %.2f until %v", target, until.Format("Mon 15:04"))
+	}
+}
+
+// applySchedule updates the target temperature from the weekly program, it
+// returns true if the target changed
+func (s *StateT) applySchedule(now time.Time) bool {
+	if !s.ScheduleOn {
+		return false
+	}
+	target := s.TargetTemp
+	if s.Override != nil && now.Before(s.Override.Until) {
+		target = s.Override.Target
+	} else if slot, ok := s.ActiveSlot(now); ok {
+		if s.Override != nil {
+			log.Println("Manual override expired")
+			s.Override = nil
+		}
+		target = slot.Target
+	}
+	if target == s.TargetTemp {
+		return false
+	}
+	log.Printf("Schedule changes target temperature from %.2f to %.2f", s.TargetTemp, target)
+	s.TargetTemp = target
+	return true
+}
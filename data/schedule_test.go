@@ -0,0 +1,173 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+// at is a time of the week starting on Sunday 2026-10-18
+func at(day time.Weekday, hour, minute int) time.Time {
+	return time.Date(2026, 10, 18+int(day), hour, minute, 0, 0, time.Local)
+}
+
+func testSchedule() StateT {
+	s := defaultState()
+	s.ScheduleOn = true
+	s.setSlot(time.Monday, 7*60, 21)
+	s.setSlot(time.Monday, 23*60, 17)
+	s.setSlot(time.Saturday, 9*60+30, 22)
+	s.setSlot(time.Saturday, 23*60, 17)
+	return s
+}
+
+func TestActiveSlot(t *testing.T) {
+	s := testSchedule()
+	tests := []struct {
+		now       time.Time
+		want      float64
+		wantStart int
+	}{
+		{at(time.Monday, 7, 0), 21, 7 * 60},
+		{at(time.Monday, 6, 59), 17, 23 * 60}, // Saturday night's, around the end of the week
+		{at(time.Sunday, 12, 0), 17, 23 * 60},
+		{at(time.Wednesday, 12, 0), 17, 23 * 60},
+		{at(time.Saturday, 9, 30), 22, 9*60 + 30},
+		{at(time.Saturday, 22, 59), 22, 9*60 + 30},
+	}
+	for _, tt := range tests {
+		slot, ok := s.ActiveSlot(tt.now)
+		if !ok || slot.Target != tt.want || slot.Start != tt.wantStart {
+			t.Errorf("ActiveSlot(%v) = %v, %v, want %v from %v", tt.now.Format("Mon 15:04"), slot, ok, tt.want, tt.wantStart)
+		}
+	}
+	if _, ok := defaultState().ActiveSlot(at(time.Monday, 12, 0)); ok {
+		t.Error("ActiveSlot without a schedule should be false")
+	}
+}
+
+func TestNextBoundary(t *testing.T) {
+	s := testSchedule()
+	tests := []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{at(time.Monday, 7, 0), at(time.Monday, 23, 0)},
+		{at(time.Monday, 12, 30), at(time.Monday, 23, 0)},
+		{at(time.Wednesday, 12, 0), at(time.Saturday, 9, 30)},
+		{at(time.Saturday, 23, 0), at(time.Monday, 7, 0).AddDate(0, 0, 7)},
+		{at(time.Sunday, 8, 0), at(time.Monday, 7, 0)},
+	}
+	for _, tt := range tests {
+		got, ok := s.NextBoundary(tt.now)
+		if !ok || !got.Equal(tt.want) {
+			t.Errorf("NextBoundary(%v) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+}
+
+// TestScheduleOverride checks that a manual target holds until the next slot
+func TestScheduleOverride(t *testing.T) {
+	s := testSchedule()
+	steps := []struct {
+		now         time.Time
+		setTarget   float64 // 0 for none
+		want        float64
+		wantChanged bool
+	}{
+		{at(time.Sunday, 12, 0), 0, 17, true},
+		{at(time.Monday, 8, 0), 0, 21, true},
+		{at(time.Monday, 9, 0), 0, 21, false},
+		{at(time.Monday, 10, 0), 19.5, 19.5, false},
+		{at(time.Monday, 22, 59), 0, 19.5, false},
+		{at(time.Monday, 23, 0), 0, 17, true},
+		{at(time.Tuesday, 8, 0), 0, 17, false},
+	}
+	for _, step := range steps {
+		if step.setTarget != 0 {
+			s.setTarget(step.setTarget, step.now)
+		}
+		changed := s.applySchedule(step.now)
+		if changed != step.wantChanged || s.TargetTemp != step.want {
+			t.Errorf("at %v: target %v (changed %v), want %v (changed %v)", step.now.Format("Mon 15:04"), s.TargetTemp, changed, step.want, step.wantChanged)
+		}
+	}
+	if s.Override != nil {
+		t.Errorf("override %v should have expired", s.Override)
+	}
+
+	s.ScheduleOn = false
+	s.setTarget(25, at(time.Tuesday, 9, 0))
+	if s.applySchedule(at(time.Tuesday, 9, 0)) || s.TargetTemp != 25 || s.Override != nil {
+		t.Errorf("with the schedule off the target should just be set, got %v (override %v)", s.TargetTemp, s.Override)
+	}
+}
+
+func TestParseDays(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    []time.Weekday
+		wantErr bool
+	}{
+		{"mon", []time.Weekday{time.Monday}, false},
+		{"mon-wed", []time.Weekday{time.Monday, time.Tuesday, time.Wednesday}, false},
+		{"sat,sun", []time.Weekday{time.Saturday, time.Sunday}, false},
+		{"weekend", []time.Weekday{time.Saturday, time.Sunday}, false},
+		{"weekdays", []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}, false},
+		{"fri-mon", []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday}, false}, // Around the end of the week
+		{"mon-", nil, true},
+		{"lunes", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDays(tt.str)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseDays(%q) error = %v, want error %v", tt.str, err, tt.wantErr)
+			continue
+		}
+		if !sameDays(got, tt.want) {
+			t.Errorf("ParseDays(%q) = %v, want %v", tt.str, got, tt.want)
+		}
+	}
+}
+
+func sameDays(a, b []time.Weekday) bool {
+	set := map[time.Weekday]bool{}
+	for _, d := range a {
+		set[d] = true
+	}
+	if len(set) != len(b) {
+		return false
+	}
+	for _, d := range b {
+		if !set[d] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestNextBoundaryDST checks that the slots start at their wall clock time
+// across the DST changes
+func TestNextBoundaryDST(t *testing.T) {
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	s := StateT{Schedule: []SlotT{{time.Sunday, 9 * 60, 20}, {time.Sunday, 23 * 60, 16}}}
+	tests := []struct {
+		now  time.Time
+		want time.Time
+	}{
+		// The clocks go back an hour at 3:00 on the 25th of October 2026
+		{time.Date(2026, 10, 24, 23, 0, 0, 0, madrid), time.Date(2026, 10, 25, 9, 0, 0, 0, madrid)},
+		{time.Date(2026, 10, 25, 1, 30, 0, 0, madrid), time.Date(2026, 10, 25, 9, 0, 0, 0, madrid)},
+		// And forward an hour at 2:00 on the 29th of March 2026
+		{time.Date(2026, 3, 28, 23, 0, 0, 0, madrid), time.Date(2026, 3, 29, 9, 0, 0, 0, madrid)},
+		{time.Date(2026, 3, 22, 23, 30, 0, 0, madrid), time.Date(2026, 3, 29, 9, 0, 0, 0, madrid)},
+	}
+	for _, tt := range tests {
+		got, ok := s.NextBoundary(tt.now)
+		if !ok || !got.Equal(tt.want) {
+			t.Errorf("NextBoundary(%v) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"math"
+	"time"
+
+	oildata "github.com/juliofaura/oilmeter/data"
+)
+
+// SeasonMonths are the months of a heating season, see HeatingSeason
+var SeasonMonths = []time.Month{time.October, time.November, time.December, time.January, time.February, time.March, time.April, time.May}
+
+// OilSeasonT is the oil burnt in a heating season. Cumulative has the liters
+// burnt by the end of each day since the start of the season, up to the last
+// one with data; the days before the first one with data count as zero, so
+// only a Complete season can be compared from its start
+type OilSeasonT struct {
+	Name       string
+	Start      time.Time
+	Liters     []float64 // By month, as in SeasonMonths
+	Days       []int     // Days of each month with oil data
+	Total      float64
+	Cumulative []float64
+	Complete   bool // The oil data start before the season
+}
+
+// daysBetween counts the calendar days from from to to (both at midnight)
+func daysBetween(from, to time.Time) int {
+	return int(math.Round(to.Sub(from).Hours() / 24))
+}
+
+// LastDay is the last day of the season with data
+func (s OilSeasonT) LastDay() time.Time {
+	return s.Start.AddDate(0, 0, len(s.Cumulative)-1)
+}
+
+// OilSeasons returns the heating seasons covered by the (sorted and filtered)
+// datums, oldest first. The refills are left out as in OilConsumed
+func OilSeasons(datums []oildata.Datapoint) []OilSeasonT {
+	var seasons []OilSeasonT
+	if len(datums) < 2 {
+		return seasons
+	}
+	first, last := time.Unix(datums[0].Timestamp, 0), time.Unix(datums[len(datums)-1].Timestamp, 0)
+	start, _, _ := HeatingSeason(first)
+	for ; start.Before(last); start = start.AddDate(1, 0, 0) {
+		_, name, _ := HeatingSeason(start)
+		end := start.AddDate(0, len(SeasonMonths), 0)
+		daily := make([]float64, daysBetween(start, end))
+		firstDay, lastDay := -1, -1
+		for i := 1; i < len(datums); i++ {
+			t := time.Unix(datums[i].Timestamp, 0)
+			if datums[i-1].Timestamp < start.Unix() || !t.Before(end) {
+				continue
+			}
+			day := daysBetween(start, dayStart(t))
+			if firstDay < 0 {
+				firstDay = daysBetween(start, dayStart(time.Unix(datums[i-1].Timestamp, 0)))
+			}
+			lastDay = day
+			if dif := datums[i-1].Liters - datums[i].Liters; math.Abs(dif) < oildata.NewGasThreshold {
+				daily[day] += dif
+			}
+		}
+		if lastDay < 0 {
+			continue
+		}
+		s := OilSeasonT{
+			Name:     name,
+			Start:    start,
+			Liters:   make([]float64, len(SeasonMonths)),
+			Days:     make([]int, len(SeasonMonths)),
+			Complete: first.Before(start),
+		}
+		if s.Complete {
+			firstDay = 0 // The days without readings count too, their oil goes to the next reading
+		}
+		total := 0.0
+		for day := 0; day <= lastDay; day++ {
+			total += daily[day]
+			s.Cumulative = append(s.Cumulative, total)
+			if day >= firstDay {
+				month := monthIndex(start.AddDate(0, 0, day).Month())
+				s.Liters[month] += daily[day]
+				s.Days[month]++
+			}
+		}
+		s.Total = total
+		seasons = append(seasons, s)
+	}
+	return seasons
+}
+
+func monthIndex(m time.Month) int {
+	for i, v := range SeasonMonths {
+		if v == m {
+			return i
+		}
+	}
+	return -1
+}
+
+// CumulativeAt returns the liters burnt from the start of the season to the
+// end of the day (counted from the start), false if the season is not
+// Complete or the day is out of range
+func (s OilSeasonT) CumulativeAt(day int) (float64, bool) {
+	if !s.Complete || day < 0 || day >= len(s.Cumulative) {
+		return 0, false
+	}
+	return s.Cumulative[day], true
+}
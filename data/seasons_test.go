@@ -0,0 +1,109 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	oildata "github.com/juliofaura/oilmeter/data"
+)
+
+// dailyDatums has a reading at noon of every day from from to to, burning 10
+// liters a day, with a refill of 1500 liters on the refill day (if any)
+func dailyDatums(from, to, refill time.Time) []oildata.Datapoint {
+	var datums []oildata.Datapoint
+	level := 3000.0
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		if day.Equal(refill) {
+			level += 1500
+		}
+		noon := day.Add(12 * time.Hour)
+		datums = append(datums, oildata.Datapoint{Timestamp: noon.Unix(), Liters: level})
+		level -= 10
+	}
+	return datums
+}
+
+func date(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+func TestOilSeasons(t *testing.T) {
+	datums := dailyDatums(date(2025, 9, 25), date(2026, 6, 5), date(2026, 1, 15))
+	seasons := OilSeasons(datums)
+	if len(seasons) != 1 {
+		t.Fatalf("got %v seasons, want 1", len(seasons))
+	}
+	s := seasons[0]
+	if s.Name != "2025/26" || !s.Start.Equal(date(2025, 10, 1)) || !s.Complete {
+		t.Errorf("got %v from %v (complete %v), want the complete 2025/26", s.Name, s.Start, s.Complete)
+	}
+	// The last reading in the season is on the 31st of May, the day 242. The
+	// first one counted is on the 2nd of October, after the one of the 1st
+	if !s.LastDay().Equal(date(2026, 5, 31)) || len(s.Cumulative) != 243 {
+		t.Errorf("last day %v with %v days, want the 31st of May", s.LastDay(), len(s.Cumulative))
+	}
+	if s.Total != 2410 { // 242 days, the refill left out
+		t.Errorf("Total = %v, want 2410", s.Total)
+	}
+	wantLiters := []float64{300, 300, 310, 300, 280, 310, 300, 310}
+	wantDays := []int{31, 30, 31, 31, 28, 31, 30, 31}
+	for i := range SeasonMonths {
+		if s.Liters[i] != wantLiters[i] || s.Days[i] != wantDays[i] {
+			t.Errorf("%v: %v liters in %v days, want %v in %v", SeasonMonths[i], s.Liters[i], s.Days[i], wantLiters[i], wantDays[i])
+		}
+	}
+
+	for day, want := range map[int]float64{0: 0, 1: 10, 30: 300, 242: 2410} {
+		if got, ok := s.CumulativeAt(day); !ok || got != want {
+			t.Errorf("CumulativeAt(%v) = %v %v, want %v", day, got, ok, want)
+		}
+	}
+	for _, day := range []int{-1, 243} {
+		if _, ok := s.CumulativeAt(day); ok {
+			t.Errorf("CumulativeAt(%v) out of range is ok", day)
+		}
+	}
+
+	if seasons := OilSeasons(datums[:1]); len(seasons) != 0 {
+		t.Errorf("one reading makes seasons %+v", seasons)
+	}
+}
+
+func TestOilSeasonsPartial(t *testing.T) {
+	seasons := OilSeasons(dailyDatums(date(2026, 10, 10), date(2026, 10, 18), time.Time{}))
+	if len(seasons) != 1 {
+		t.Fatalf("got %v seasons, want 1", len(seasons))
+	}
+	s := seasons[0]
+	if s.Name != "2026/27" || s.Complete {
+		t.Errorf("got %v (complete %v), want the partial 2026/27", s.Name, s.Complete)
+	}
+	if len(s.Cumulative) != 18 || s.Cumulative[8] != 0 || s.Total != 80 {
+		t.Errorf("cumulative %v with total %v, want 80 from the 11th to the 18th", s.Cumulative, s.Total)
+	}
+	if s.Liters[0] != 80 || s.Days[0] != 9 {
+		t.Errorf("October has %v liters in %v days, want 80 in 9", s.Liters[0], s.Days[0])
+	}
+	// It cannot be compared from the start of the season
+	if _, ok := s.CumulativeAt(17); ok {
+		t.Error("CumulativeAt of a partial season is ok")
+	}
+}
+
+// TestOilSeasonsGap checks that a season is complete if the oil data start
+// before it, even without readings in its first days
+func TestOilSeasonsGap(t *testing.T) {
+	datums := append(dailyDatums(date(2026, 9, 25), date(2026, 9, 28), time.Time{}),
+		dailyDatums(date(2026, 10, 3), date(2026, 10, 18), time.Time{})...)
+	seasons := OilSeasons(datums)
+	if len(seasons) != 1 || !seasons[0].Complete {
+		t.Fatalf("got %+v, want the complete 2026/27", seasons)
+	}
+	s := seasons[0]
+	if got, ok := s.CumulativeAt(17); !ok || got != 150 {
+		t.Errorf("CumulativeAt(17) = %v %v, want 150", got, ok)
+	}
+	if s.Days[0] != 18 {
+		t.Errorf("October has %v days, want 18", s.Days[0])
+	}
+}
@@ -0,0 +1,192 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	W1DevicesDir    = "/sys/bus/w1/devices/"
+	httpTempTimeout = 10 * time.Second
+	sshTempTimeout  = 10 * time.Second
+	sensorTimeout   = 15 * time.Second // Refresh gives up on a sensor after this, whatever its backend
+)
+
+// TemperatureSource is anything able to give us the temperature of a room
+type TemperatureSource interface {
+	Temperature() (float64, error)
+}
+
+// sourceFor returns the backend configured for the given sensor, a sensor with
+// no backend configured is read with the legacy ssh gettemp command
+func sourceFor(sources map[string]TemperatureSource, sensor string) TemperatureSource {
+	if source, ok := sources[sensor]; ok {
+		return source
+	}
+	return SSHSource{Host: "pi@" + sensor, Command: gettempBinary}
+}
+
+// buildSources parses all the source specs, which must have been validated
+func buildSources(specs map[string]string) map[string]TemperatureSource {
+	sources := map[string]TemperatureSource{}
+	for name, spec := range specs {
+		if source, err := ParseSource(spec); err == nil {
+			sources[name] = source
+		}
+	}
+	return sources
+}
+
+///////////////////////////////////////////////////
+// Backends
+///////////////////////////////////////////////////
+
+// SSHSource runs a command on a remote host that prints the temperature
+type SSHSource struct {
+	Host    string
+	Command string
+}
+
+func (s SSHSource) Temperature() (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sshTempTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ssh", s.Host, s.Command)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(stdout.String()), 64)
+}
+
+// W1Source reads a DS18B20 probe through the 1-Wire sysfs interface. If Device
+// is empty the first probe found is used
+type W1Source struct {
+	Device string
+}
+
+func (s W1Source) Temperature() (float64, error) {
+	device := s.Device
+	if device == "" {
+		matches, _ := filepath.Glob(W1DevicesDir + "*/w1_slave")
+		if len(matches) == 0 {
+			return 0, errors.New("no 1-Wire temperature probe found in " + W1DevicesDir)
+		}
+		device = filepath.Base(filepath.Dir(matches[0]))
+	}
+	raw, err := os.ReadFile(W1DevicesDir + device + "/w1_slave")
+	if err != nil {
+		return 0, err
+	}
+	// Two lines, the first one ends with YES if the CRC is ok and the second
+	// one ends with t=<millidegrees>
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, fmt.Errorf("bad reading from 1-Wire probe %v", device)
+	}
+	i := strings.LastIndex(lines[1], "t=")
+	if i < 0 {
+		return 0, fmt.Errorf("bad reading from 1-Wire probe %v", device)
+	}
+	milli, err := strconv.ParseFloat(strings.TrimSpace(lines[1][i+2:]), 64)
+	if err != nil {
+		return 0, err
+	}
+	return milli / 1000, nil
+}
+
+// HTTPSource polls a URL returning JSON, either a bare number or an object
+// with the temperature in Field ("temperature" if empty)
+type HTTPSource struct {
+	URL   string
+	Field string
+}
+
+func (s HTTPSource) Temperature() (float64, error) {
+	client := http.Client{Timeout: httpTempTimeout}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%v returned %v", s.URL, resp.Status)
+	}
+	var body interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, err
+	}
+	if temperature, ok := body.(float64); ok {
+		return temperature, nil
+	}
+	field := s.Field
+	if field == "" {
+		field = "temperature"
+	}
+	if object, ok := body.(map[string]interface{}); ok {
+		if temperature, ok := object[field].(float64); ok {
+			return temperature, nil
+		}
+	}
+	return 0, fmt.Errorf("no numeric %q in the response from %v", field, s.URL)
+}
+
+// FileSource reads the temperature from a text file, it is meant for tests and
+// for running simulated (just echo a new value into the file)
+type FileSource struct {
+	Path string
+}
+
+func (s FileSource) Temperature() (float64, error) {
+	raw, err := os.ReadFile(s.Path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(raw)), 64)
+}
+
+///////////////////////////////////////////////////
+// Configuration
+///////////////////////////////////////////////////
+
+// ParseSource builds a backend from its spec, one of:
+//
+//	ssh:<user@host>[:<command>]
+//	w1[:<device id>]
+//	http://... or https://... (optionally followed by #<json field>)
+//	file:<path>
+func ParseSource(spec string) (TemperatureSource, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "ssh":
+		host, command, _ := strings.Cut(arg, ":")
+		if host == "" {
+			return nil, errors.New("missing host in " + spec)
+		}
+		if command == "" {
+			command = gettempBinary
+		}
+		return SSHSource{Host: host, Command: command}, nil
+	case "w1":
+		return W1Source{Device: arg}, nil
+	case "http", "https":
+		url, field, _ := strings.Cut(spec, "#")
+		return HTTPSource{URL: url, Field: field}, nil
+	case "file":
+		if arg == "" {
+			return nil, errors.New("missing path in " + spec)
+		}
+		return FileSource{Path: arg}, nil
+	}
+	return nil, errors.New("unknown temperature source " + spec)
+}
@@ -0,0 +1,104 @@
+package data
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSource(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string // Not written if empty
+		want    float64
+		wantErr bool
+	}{
+		{"reading", "19.5\n", 19.5, false},
+		{"spaces", "  -2.25 \n", -2.25, false},
+		{"garbage", "error\n", 0, true},
+		{"missing", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := FileSource{Path: path}.Temperature()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Temperature() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Temperature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bare", func(w http.ResponseWriter, req *http.Request) { w.Write([]byte("21.5")) })
+	mux.HandleFunc("/object", func(w http.ResponseWriter, req *http.Request) { w.Write([]byte(`{"temperature": 20, "temp": 18.5}`)) })
+	mux.HandleFunc("/text", func(w http.ResponseWriter, req *http.Request) { w.Write([]byte(`{"temperature": "20"}`)) })
+	mux.HandleFunc("/down", func(w http.ResponseWriter, req *http.Request) { http.Error(w, "down", http.StatusServiceUnavailable) })
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		path    string
+		field   string
+		want    float64
+		wantErr bool
+	}{
+		{"/bare", "", 21.5, false},
+		{"/object", "", 20, false},
+		{"/object", "temp", 18.5, false},
+		{"/object", "humidity", 0, true},
+		{"/text", "", 0, true},
+		{"/down", "", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := HTTPSource{URL: server.URL + tt.path, Field: tt.field}.Temperature()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v#%v: error = %v, want error %v", tt.path, tt.field, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%v#%v = %v, want %v", tt.path, tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    TemperatureSource
+		wantErr bool
+	}{
+		{"ssh:pi@salon", SSHSource{Host: "pi@salon", Command: gettempBinary}, false},
+		{"ssh:pi@salon:/usr/bin/temp", SSHSource{Host: "pi@salon", Command: "/usr/bin/temp"}, false},
+		{"ssh:", nil, true},
+		{"w1", W1Source{}, false},
+		{"w1:28-0123", W1Source{Device: "28-0123"}, false},
+		{"http://host/temp", HTTPSource{URL: "http://host/temp"}, false},
+		{"https://host/temp#main.temp", HTTPSource{URL: "https://host/temp", Field: "main.temp"}, false},
+		{"file:/tmp/t.txt", FileSource{Path: "/tmp/t.txt"}, false},
+		{"file:", nil, true},
+		{"ftp://host", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSource(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSource(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSource(%q) = %#v, want %#v", tt.spec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package data
+
+import "time"
+
+// StatsT are the counters of the controller since it started
+type StatsT struct {
+	SensorReads   map[string]uint64 // By sensor name
+	SensorErrors  map[string]uint64
+	PowerSwitches uint64 // Times the relays actually changed
+	HeatSwitches  uint64
+	Failures      int            // Consecutive control steps without a temperature
+	Retry         time.Duration  // Wait before the next step after a failure
+	SensorFailing map[string]int // Consecutive failed readings, by sensor name
+	PowerMismatch time.Time      // Since when the power reads otherwise than set, zero if it does not
+	HeatMismatch  time.Time
+}
+
+// retryDelay is the wait after a number of consecutive failures: it starts at
+// SensorRetry and grows by half each time, up to MaxSensorRetry
+func retryDelay(failures int) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+	retry := SensorRetry
+	for i := 1; i < failures && retry < MaxSensorRetry; i++ {
+		retry = (retry * 3) / 2
+	}
+	if retry > MaxSensorRetry {
+		retry = MaxSensorRetry
+	}
+	return retry
+}
+
+func (c *Controller) Stats() StatsT {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := StatsT{
+		SensorReads:   map[string]uint64{},
+		SensorErrors:  map[string]uint64{},
+		PowerSwitches: c.powerSwitches,
+		HeatSwitches:  c.heatSwitches,
+		Failures:      c.failures,
+		Retry:         retryDelay(c.failures),
+		SensorFailing: map[string]int{},
+		PowerMismatch: c.powerMismatch,
+		HeatMismatch:  c.heatMismatch,
+	}
+	for k, v := range c.sensorReads {
+		stats.SensorReads[k] = v
+	}
+	for k, v := range c.sensorErrors {
+		stats.SensorErrors[k] = v
+	}
+	for k, v := range c.sensorFailing {
+		stats.SensorFailing[k] = v
+	}
+	return stats
+}
+
+// RetryDelay is how long to wait before the next control step, after Control
+// failed
+func (c *Controller) RetryDelay() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return retryDelay(c.failures)
+}
@@ -0,0 +1,154 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scopes of the API tokens
+const (
+	ScopeRead    = "read"    // Status and history, as a viewer
+	ScopeControl = "control" // And also control, as an operator
+)
+
+var Scopes = []string{ScopeRead, ScopeControl}
+
+var TokensFileName = ".calderaTokens.json"
+
+func ValidScope(scope string) bool {
+	return scope == ScopeRead || scope == ScopeControl
+}
+
+// ScopeRole is the user role a token scope stands for
+func ScopeRole(scope string) string {
+	if scope == ScopeControl {
+		return RoleOperator
+	}
+	return RoleViewer
+}
+
+// TokenT is a long lived bearer token for the API. Only the SHA-256 of the
+// secret is kept, the secret itself is shown once when issued
+type TokenT struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Scope   string    `json:"scope"`
+	Created time.Time `json:"created"`
+}
+
+type TokenStore struct {
+	mu     sync.Mutex
+	name   string
+	tokens map[string]TokenT // By name
+}
+
+// OpenTokens reads the tokens file, there are no tokens if it does not exist
+func OpenTokens(name string) (*TokenStore, error) {
+	s := &TokenStore{name: name, tokens: map[string]TokenT{}}
+	raw, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens []TokenT
+	if err := json.Unmarshal(raw, &tokens); err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	for _, t := range tokens {
+		if t.Name == "" || t.Hash == "" || !ValidScope(t.Scope) {
+			return nil, fmt.Errorf("%v: wrong token %q with scope %q", name, t.Name, t.Scope)
+		}
+		s.tokens[t.Name] = t
+	}
+	return s, nil
+}
+
+// save must be called with the lock held
+func (s *TokenStore) save() error {
+	raw, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.name, append(raw, '\n'), 0600)
+}
+
+func (s *TokenStore) list() []TokenT {
+	tokens := []TokenT{}
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens
+}
+
+// List returns the tokens sorted by name
+func (s *TokenStore) List() []TokenT {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list()
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue creates a token, returning its secret
+func (s *TokenStore) Issue(name, scope string, now time.Time) (string, error) {
+	if name == "" {
+		return "", invalidf("empty token name")
+	}
+	if !ValidScope(scope) {
+		return "", invalidf("unknown scope %v", scope)
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(random)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[name]; ok {
+		return "", invalidf("token %v already exists", name)
+	}
+	s.tokens[name] = TokenT{name, hashToken(secret), scope, now}
+	log.Println("Issued API token", name, "with scope", scope)
+	return secret, s.save()
+}
+
+func (s *TokenStore) Revoke(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[name]; !ok {
+		return invalidf("no such token %v", name)
+	}
+	delete(s.tokens, name)
+	log.Println("Revoked API token", name)
+	return s.save()
+}
+
+// Check finds the token with the secret
+func (s *TokenStore) Check(secret string) (TokenT, bool) {
+	hash := []byte(hashToken(secret))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			return t, true
+		}
+	}
+	return TokenT{}, false
+}
@@ -0,0 +1,166 @@
+package data
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestTokens(t *testing.T) *TokenStore {
+	t.Helper()
+	s, err := OpenTokens(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestTokensHashOnly checks that the secrets are not stored, only their hash
+func TestTokensHashOnly(t *testing.T) {
+	s := openTestTokens(t)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+	secret, err := s.Issue("grafana", ScopeRead, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(s.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), secret) {
+		t.Errorf("the tokens file has the secret in clear:\n%s", raw)
+	}
+	if !strings.Contains(string(raw), hashToken(secret)) {
+		t.Errorf("the tokens file does not have the hash of the secret:\n%s", raw)
+	}
+
+	reopened, err := OpenTokens(s.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, ok := reopened.Check(secret)
+	if !ok || token.Name != "grafana" || token.Scope != ScopeRead || !token.Created.Equal(now) {
+		t.Errorf("Check() after reopening = %v, %v", token, ok)
+	}
+	if token, ok := reopened.Check(token.Hash); ok {
+		t.Errorf("Check() accepted the hash as secret: %v", token)
+	}
+}
+
+func TestTokensCheck(t *testing.T) {
+	s := openTestTokens(t)
+	now := time.Now()
+	read, err := s.Issue("grafana", ScopeRead, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	control, err := s.Issue("domotica", ScopeControl, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read == control {
+		t.Fatal("two tokens with the same secret")
+	}
+	tests := []struct {
+		secret   string
+		wantName string // Empty for not found
+		wantRole string
+	}{
+		{read, "grafana", RoleViewer},
+		{control, "domotica", RoleOperator},
+		{read + "x", "", ""},
+		{control[1:], "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		token, ok := s.Check(tt.secret)
+		if ok != (tt.wantName != "") || token.Name != tt.wantName {
+			t.Errorf("Check(%q) = %v, %v, want %q", tt.secret, token, ok, tt.wantName)
+			continue
+		}
+		if ok && ScopeRole(token.Scope) != tt.wantRole {
+			t.Errorf("token %v acts as %v, want %v", token.Name, ScopeRole(token.Scope), tt.wantRole)
+		}
+	}
+	if RoleAllows(ScopeRole(ScopeRead), RoleOperator) {
+		t.Error("a read token can control")
+	}
+}
+
+func TestTokensIssueWrong(t *testing.T) {
+	s := openTestTokens(t)
+	if _, err := s.Issue("grafana", ScopeRead, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ name, scope string }{{"", ScopeRead}, {"otro", "admin"}, {"grafana", ScopeControl}} {
+		if _, err := s.Issue(tt.name, tt.scope, time.Now()); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Issue(%q, %q) = %v, want ErrInvalid", tt.name, tt.scope, err)
+		}
+	}
+	if len(s.List()) != 1 {
+		t.Errorf("tokens are %v, want only grafana", s.List())
+	}
+}
+
+func TestTokensRevoke(t *testing.T) {
+	s := openTestTokens(t)
+	secret, err := s.Issue("grafana", ScopeRead, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.Issue("domotica", ScopeControl, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Revoke("grafana"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Check(secret); ok {
+		t.Error("a revoked token still works")
+	}
+	if _, ok := s.Check(other); !ok {
+		t.Error("revoking a token broke another one")
+	}
+	if err := s.Revoke("grafana"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Revoke() twice = %v, want ErrInvalid", err)
+	}
+
+	reopened, err := OpenTokens(s.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Check(secret); ok {
+		t.Error("a revoked token works again after reopening")
+	}
+	if len(reopened.List()) != 1 {
+		t.Errorf("tokens after reopening are %v, want only domotica", reopened.List())
+	}
+}
+
+// TestOpenTokensWrong checks that a tokens file edited by hand with a wrong
+// scope is refused, instead of making a token that ScopeRole takes as read
+func TestOpenTokensWrong(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "tokens.json")
+	for _, raw := range []string{
+		`[{"name":"grafana","hash":"abc","scope":"admin"}]`,
+		`[{"name":"grafana","hash":"abc","scope":""}]`,
+		`[{"name":"","hash":"abc","scope":"read"}]`,
+		`[{"name":"grafana","hash":"","scope":"read"}]`,
+	} {
+		if err := os.WriteFile(name, []byte(raw), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenTokens(name); err == nil {
+			t.Errorf("OpenTokens(%v) did not fail", raw)
+		}
+	}
+	if err := os.WriteFile(name, []byte(`[{"name":"grafana","hash":"abc","scope":"control"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := OpenTokens(name); err != nil || len(s.List()) != 1 {
+		t.Errorf("OpenTokens of a right file = %v", err)
+	}
+}
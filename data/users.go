@@ -0,0 +1,264 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles of the web users, each one can do everything the previous ones can:
+// viewers only look, operators run the boiler and admins manage the rest
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var Roles = []string{RoleViewer, RoleOperator, RoleAdmin}
+
+const (
+	DefaultLogin      = "admin"
+	DefaultPassword   = "1234"
+	MinPasswordLength = 6
+)
+
+var UsersFileName = ".calderaUsers.json"
+
+func roleLevel(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+func ValidRole(role string) bool {
+	return roleLevel(role) >= 0
+}
+
+// RoleAllows tells whether role has (at least) the rights of needed
+func RoleAllows(role, needed string) bool {
+	return ValidRole(role) && roleLevel(role) >= roleLevel(needed)
+}
+
+type UserT struct {
+	Login              string `json:"login"`
+	Hash               string `json:"hash"` // bcrypt, salt included
+	Role               string `json:"role"`
+	MustChangePassword bool   `json:"must_change_password"` // Set for the default and reset passwords
+}
+
+// UserStore keeps the web users in a file, saving it on every change
+type UserStore struct {
+	mu    sync.Mutex
+	name  string
+	users map[string]UserT
+}
+
+// OpenUsers reads the users file. On first run (no file) it creates the
+// default admin, who will have to change the password on the first login
+func OpenUsers(name string) (*UserStore, error) {
+	s := &UserStore{name: name, users: map[string]UserT{}}
+	raw, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		hash, err := bcrypt.GenerateFromPassword([]byte(DefaultPassword), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		s.users[DefaultLogin] = UserT{DefaultLogin, string(hash), RoleAdmin, true}
+		log.Println("Created the users file with the default admin user")
+		return s, s.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []UserT
+	if err := json.Unmarshal(raw, &users); err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	for _, u := range users {
+		if u.Login == "" || !ValidRole(u.Role) {
+			return nil, fmt.Errorf("%v: wrong user %q with role %q", name, u.Login, u.Role)
+		}
+		s.users[u.Login] = u
+	}
+	return s, nil
+}
+
+// save must be called with the lock held
+func (s *UserStore) save() error {
+	raw, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.name, append(raw, '\n'), 0600)
+}
+
+func (s *UserStore) list() []UserT {
+	users := []UserT{}
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Login < users[j].Login })
+	return users
+}
+
+// List returns the users sorted by login
+func (s *UserStore) List() []UserT {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list()
+}
+
+func (s *UserStore) Get(login string) (UserT, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[login]
+	return u, ok
+}
+
+// dummyHash is compared against for unknown users, so they take as long as
+// the known ones
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+var ErrWrongPassword = errors.New("wrong user or password")
+
+// Authenticate checks the password of the user
+func (s *UserStore) Authenticate(login, password string) (UserT, error) {
+	u, ok := s.Get(login)
+	hash := dummyHash
+	if ok {
+		hash = []byte(u.Hash)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return UserT{}, ErrWrongPassword
+	}
+	return u, nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", invalidf("the password should have at least %v characters", MinPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Add creates a user. The password is temporary, to be changed on first login
+func (s *UserStore) Add(login, password, role string) error {
+	if login == "" {
+		return invalidf("empty login")
+	}
+	if !ValidRole(role) {
+		return invalidf("unknown role %v", role)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[login]; ok {
+		return invalidf("user %v already exists", login)
+	}
+	s.users[login] = UserT{login, hash, role, true}
+	log.Println("Added user", login, "with role", role)
+	return s.save()
+}
+
+// admins counts the admin users, must be called with the lock held
+func (s *UserStore) admins() int {
+	n := 0
+	for _, u := range s.users {
+		if u.Role == RoleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// Remove deletes a user, as long as it is not the last admin
+func (s *UserStore) Remove(login string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[login]
+	if !ok {
+		return invalidf("no such user %v", login)
+	}
+	if u.Role == RoleAdmin && s.admins() == 1 {
+		return invalidf("%v is the last admin", login)
+	}
+	delete(s.users, login)
+	log.Println("Removed user", login)
+	return s.save()
+}
+
+// SetRole changes the role of a user, as long as it is not the last admin
+// losing the admin rights
+func (s *UserStore) SetRole(login, role string) error {
+	if !ValidRole(role) {
+		return invalidf("unknown role %v", role)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[login]
+	if !ok {
+		return invalidf("no such user %v", login)
+	}
+	if u.Role == RoleAdmin && role != RoleAdmin && s.admins() == 1 {
+		return invalidf("%v is the last admin", login)
+	}
+	u.Role = role
+	s.users[login] = u
+	log.Println("Changed the role of user", login, "to", role)
+	return s.save()
+}
+
+// ResetPassword sets a temporary password, to be changed on next login
+func (s *UserStore) ResetPassword(login, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[login]
+	if !ok {
+		return invalidf("no such user %v", login)
+	}
+	u.Hash, u.MustChangePassword = hash, true
+	s.users[login] = u
+	log.Println("Reset the password of user", login)
+	return s.save()
+}
+
+// ChangePassword is the user changing their own password
+func (s *UserStore) ChangePassword(login, old, password string) error {
+	if _, err := s.Authenticate(login, old); err != nil {
+		return invalidf("wrong current password")
+	}
+	if password == old || password == DefaultPassword {
+		return invalidf("the new password should be different")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[login]
+	if !ok {
+		return invalidf("no such user %v", login)
+	}
+	u.Hash, u.MustChangePassword = hash, false
+	s.users[login] = u
+	log.Println("User", login, "changed their password")
+	return s.save()
+}
@@ -0,0 +1,207 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestUsers(t *testing.T) *UserStore {
+	t.Helper()
+	s, err := OpenUsers(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role, needed string
+		want         bool
+	}{
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleOperator, false},
+		{RoleViewer, RoleAdmin, false},
+		{RoleOperator, RoleViewer, true},
+		{RoleOperator, RoleOperator, true},
+		{RoleOperator, RoleAdmin, false},
+		{RoleAdmin, RoleViewer, true},
+		{RoleAdmin, RoleAdmin, true},
+		{"root", RoleViewer, false},
+		{"", RoleViewer, false},
+	}
+	for _, tt := range tests {
+		if got := RoleAllows(tt.role, tt.needed); got != tt.want {
+			t.Errorf("RoleAllows(%q, %q) = %v, want %v", tt.role, tt.needed, got, tt.want)
+		}
+	}
+}
+
+// TestOpenUsersFirstRun checks the default admin created on the first run,
+// stored with a hash only
+func TestOpenUsersFirstRun(t *testing.T) {
+	s := openTestUsers(t)
+	u, err := s.Authenticate(DefaultLogin, DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Role != RoleAdmin || !u.MustChangePassword {
+		t.Errorf("default user is %v, want an admin who must change the password", u)
+	}
+	raw, err := os.ReadFile(s.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), `"`+DefaultPassword+`"`) {
+		t.Errorf("the users file has the password in clear:\n%s", raw)
+	}
+
+	reopened, err := OpenUsers(s.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Authenticate(DefaultLogin, DefaultPassword); err != nil {
+		t.Errorf("the default admin is gone after reopening: %v", err)
+	}
+}
+
+func TestOpenUsersWrong(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "users.json")
+	for _, users := range []string{`{"login": "admin"}`, `[{"login": "", "role": "admin"}]`, `[{"login": "pepe", "role": "root"}]`} {
+		os.WriteFile(name, []byte(users), 0600)
+		if _, err := OpenUsers(name); err == nil {
+			t.Errorf("OpenUsers() accepted %v", users)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := openTestUsers(t)
+	if err := s.Add("pepe", "secreto", RoleOperator); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		login, password string
+		wantErr         bool
+	}{
+		{"pepe", "secreto", false},
+		{"pepe", "Secreto", true},
+		{"pepe", "", true},
+		{"juan", "secreto", true}, // Unknown, checked against dummyHash
+		{"juan", "dummy password", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		u, err := s.Authenticate(tt.login, tt.password)
+		if tt.wantErr {
+			if !errors.Is(err, ErrWrongPassword) || u != (UserT{}) {
+				t.Errorf("Authenticate(%q, %q) = %v, %v, want ErrWrongPassword", tt.login, tt.password, u, err)
+			}
+			continue
+		}
+		if err != nil || u.Login != tt.login || u.Role != RoleOperator {
+			t.Errorf("Authenticate(%q, %q) = %v, %v", tt.login, tt.password, u, err)
+		}
+	}
+}
+
+func TestAddUser(t *testing.T) {
+	s := openTestUsers(t)
+	tests := []struct {
+		login, password, role string
+	}{
+		{"", "secreto", RoleViewer},
+		{"pepe", "secreto", "root"},
+		{"pepe", "12345", RoleViewer}, // Too short
+		{DefaultLogin, "secreto", RoleViewer},
+	}
+	for _, tt := range tests {
+		if err := s.Add(tt.login, tt.password, tt.role); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Add(%q, %q, %q) = %v, want ErrInvalid", tt.login, tt.password, tt.role, err)
+		}
+	}
+	if len(s.List()) != 1 {
+		t.Errorf("users are %v, want only the default admin", s.List())
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	s := openTestUsers(t)
+	if err := s.Add("pepe", "temporal", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, old, password string
+	}{
+		{"wrong old password", "temporall", "secreto"},
+		{"same password", "temporal", "temporal"},
+		{"default password", "temporal", DefaultPassword},
+		{"too short", "temporal", "corta"},
+	}
+	for _, tt := range tests {
+		if err := s.ChangePassword("pepe", tt.old, tt.password); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%v: ChangePassword() = %v, want ErrInvalid", tt.name, err)
+		}
+	}
+	if u, _ := s.Get("pepe"); !u.MustChangePassword {
+		t.Error("a failed change cleared MustChangePassword")
+	}
+
+	if err := s.ChangePassword("pepe", "temporal", "secreto"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate("pepe", "temporal"); err == nil {
+		t.Error("the old password still works")
+	}
+	u, err := s.Authenticate("pepe", "secreto")
+	if err != nil || u.MustChangePassword {
+		t.Errorf("after the change got %v, %v, want the user with no pending change", u, err)
+	}
+
+	if err := s.ResetPassword("pepe", "otravez"); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := s.Authenticate("pepe", "otravez"); err != nil || !u.MustChangePassword {
+		t.Errorf("after a reset got %v, %v, want the user with a pending change", u, err)
+	}
+}
+
+// TestLastAdmin checks that there is always an admin left
+func TestLastAdmin(t *testing.T) {
+	s := openTestUsers(t)
+	if err := s.Remove(DefaultLogin); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Remove() of the last admin = %v, want ErrInvalid", err)
+	}
+	if err := s.SetRole(DefaultLogin, RoleOperator); !errors.Is(err, ErrInvalid) {
+		t.Errorf("SetRole() of the last admin = %v, want ErrInvalid", err)
+	}
+	if u, _ := s.Get(DefaultLogin); u.Role != RoleAdmin {
+		t.Errorf("the last admin is now %v", u.Role)
+	}
+
+	if err := s.Add("pepe", "secreto", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRole("pepe", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRole(DefaultLogin, RoleViewer); err != nil {
+		t.Errorf("SetRole() with another admin left = %v", err)
+	}
+	if err := s.Remove("pepe"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Remove() of the new last admin = %v, want ErrInvalid", err)
+	}
+	if err := s.Remove(DefaultLogin); err != nil {
+		t.Errorf("Remove() of a viewer = %v", err)
+	}
+
+	var saved []UserT
+	raw, _ := os.ReadFile(s.name)
+	if err := json.Unmarshal(raw, &saved); err != nil || len(saved) != 1 || saved[0].Login != "pepe" || saved[0].Role != RoleAdmin {
+		t.Errorf("saved users are %v (%v), want pepe as admin", saved, err)
+	}
+}
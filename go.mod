@@ -3,16 +3,21 @@ module github.com/juliofaura/caldera
 go 1.25.5
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/gorilla/context v1.1.2
+	github.com/gorilla/sessions v1.4.0
 	github.com/juliofaura/oilmeter v0.0.0-20260105113229-250782056005
 	github.com/juliofaura/webutil v0.0.0-20210306173923-ef1d6b29a226
 	github.com/stianeikeland/go-rpio v4.2.0+incompatible
 	github.com/wcharczuk/go-chart/v2 v2.1.2
+	golang.org/x/crypto v0.23.0
 )
 
 require (
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
 	github.com/gorilla/securecookie v1.1.2 // indirect
-	github.com/gorilla/sessions v1.4.0 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
 	golang.org/x/image v0.25.0 // indirect
+	golang.org/x/net v0.25.0 // indirect
+	golang.org/x/sync v0.7.0 // indirect
 )
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juliofaura/caldera/data"
+)
+
+// The JSON API, under /api/v1. Every endpoint answers JSON: the status (after
+// the change, for the control endpoints) or {"error": "..."} with 400 for
+// malformed requests, 422 for changes the controller rejects and 500 if the
+// change could not be saved
+
+const API_PREFIX = "/api/v1/"
+
+type apiLineT struct {
+	Commanded bool `json:"commanded"`
+	Reading   bool `json:"reading"`
+}
+
+type apiSensorT struct {
+	Name   string   `json:"name"`
+	Weight float64  `json:"weight"`
+	Temp   *float64 `json:"temp"` // null if it could not be read
+}
+
+type apiOverrideT struct {
+	Target float64   `json:"target"`
+	Until  time.Time `json:"until"`
+}
+
+type apiAwayT struct {
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	FrostTemp      float64   `json:"frost_temp"`
+	PreheatMinutes int       `json:"preheat_minutes"`
+	Active         bool      `json:"active"`
+}
+
+type apiStatusT struct {
+	Time            time.Time     `json:"time"`
+	Power           apiLineT      `json:"power"`
+	Heat            apiLineT      `json:"heat"`
+	ThermostatOn    bool          `json:"thermostat_on"`
+	Temperature     *float64      `json:"temperature"` // null if it could not be read
+	Reference       string        `json:"reference"`
+	Sensor          string        `json:"sensor"`
+	Aggregation     string        `json:"aggregation"`
+	Sensors         []apiSensorT  `json:"sensors"`
+	TargetTemp      float64       `json:"target_temp"`
+	EffectiveTarget float64       `json:"effective_target"` // What the thermostat controls to, away mode and overrides included
+	Hysteresis      float64       `json:"hysteresis"`
+	ScheduleOn      bool          `json:"schedule_on"`
+	Override        *apiOverrideT `json:"override"`
+	Away            *apiAwayT     `json:"away"`
+}
+
+func apiStatus(st data.StateT, now time.Time) apiStatusT {
+	status := apiStatusT{
+		Time:            now,
+		Power:           apiLineT{st.PowerOn, st.PowerReading},
+		Heat:            apiLineT{st.HeatOn, st.HeatReading},
+		ThermostatOn:    st.ThermostatOn,
+		Reference:       st.Reference(),
+		Sensor:          st.Sensor,
+		Aggregation:     st.Aggregation,
+		Sensors:         []apiSensorT{},
+		TargetTemp:      st.TargetTemp,
+		EffectiveTarget: st.EffectiveTarget(now),
+		Hysteresis:      st.Hysteresis,
+		ScheduleOn:      st.ScheduleOn,
+	}
+	if !st.ErrorInTemp {
+		temp := st.CurrentTemp
+		status.Temperature = &temp
+	}
+	for _, s := range st.Sensors {
+		sensor := apiSensorT{Name: s.Name, Weight: s.Weight}
+		if !s.ErrorInTemp {
+			temp := s.Temp
+			sensor.Temp = &temp
+		}
+		status.Sensors = append(status.Sensors, sensor)
+	}
+	if st.Override != nil {
+		status.Override = &apiOverrideT{st.Override.Target, st.Override.Until}
+	}
+	if st.Away != nil {
+		status.Away = &apiAwayT{st.Away.From, st.Away.To, st.Away.FrostTemp, int(st.Away.Preheat / time.Minute), st.AwayActive(now)}
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+// apiResult answers a control request with the new status, or the error
+func apiResult(w http.ResponseWriter, err error) {
+	if errors.Is(err, data.ErrInvalid) {
+		apiError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, apiStatus(ctl.Status(), time.Now()))
+}
+
+// apiDecode checks the method and decodes the JSON body into v, answering the
+// request if anything is wrong
+func apiDecode(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	if req.Method != http.MethodPut && req.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		apiError(w, http.StatusMethodNotAllowed, "method "+req.Method+" not allowed, use PUT or POST")
+		return false
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<16))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		apiError(w, http.StatusBadRequest, "wrong JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func apiMissing(w http.ResponseWriter, field string) {
+	apiError(w, http.StatusBadRequest, "missing field "+field)
+}
+
+// HandleAPIStatus is GET /api/v1/status
+func HandleAPIStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		apiError(w, http.StatusMethodNotAllowed, "method "+req.Method+" not allowed, use GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, apiStatus(ctl.Status(), time.Now()))
+}
+
+// HandleAPIPower is PUT /api/v1/power {"on": true}
+func HandleAPIPower(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		On *bool `json:"on"`
+	}
+	if !apiDecode(w, req, &body) {
+		return
+	}
+	if body.On == nil {
+		apiMissing(w, "on")
+		return
+	}
+	apiResult(w, change(req, "power", func() error { return ctl.SetPower(*body.On) }))
+}
+
+// HandleAPIThermostat is PUT /api/v1/thermostat {"on": false, "stop_heat": true}
+// (stop_heat is optional, and only used when pausing)
+func HandleAPIThermostat(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		On       *bool `json:"on"`
+		StopHeat bool  `json:"stop_heat"`
+	}
+	if !apiDecode(w, req, &body) {
+		return
+	}
+	if body.On == nil {
+		apiMissing(w, "on")
+		return
+	}
+	apiResult(w, change(req, "thermostat", func() error { return ctl.SetThermostat(*body.On, body.StopHeat) }))
+}
+
+// HandleAPITarget is PUT /api/v1/target {"target": 21.5}. With the schedule on
+// it lasts until the next slot, as when changed by hand
+func HandleAPITarget(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Target *float64 `json:"target"`
+	}
+	if !apiDecode(w, req, &body) {
+		return
+	}
+	if body.Target == nil {
+		apiMissing(w, "target")
+		return
+	}
+	apiResult(w, change(req, "target", func() error { return ctl.SetTarget(*body.Target, time.Now()) }))
+}
+
+// HandleAPIHysteresis is PUT /api/v1/hysteresis {"hysteresis": 0.1}
+func HandleAPIHysteresis(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Hysteresis *float64 `json:"hysteresis"`
+	}
+	if !apiDecode(w, req, &body) {
+		return
+	}
+	if body.Hysteresis == nil {
+		apiMissing(w, "hysteresis")
+		return
+	}
+	apiResult(w, change(req, "hysteresis", func() error { return ctl.SetHysteresis(*body.Hysteresis) }))
+}
+
+// HandleAPISensor is PUT /api/v1/sensor {"sensor": "salon"}
+func HandleAPISensor(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Sensor *string `json:"sensor"`
+	}
+	if !apiDecode(w, req, &body) {
+		return
+	}
+	if body.Sensor == nil {
+		apiMissing(w, "sensor")
+		return
+	}
+	apiResult(w, change(req, "sensor", func() error { return ctl.SetSensor(strings.TrimSpace(*body.Sensor)) }))
+}
+
+// HandleAPINotFound answers anything else under the API prefix
+func HandleAPINotFound(w http.ResponseWriter, req *http.Request) {
+	apiError(w, http.StatusNotFound, "no such endpoint "+req.URL.Path)
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/juliofaura/caldera/data"
+	"github.com/juliofaura/webutil"
+)
+
+// The session keeps the login (and the admin flag webutil shows in the
+// header). The role is looked up on every request, so changes to the users
+// apply at once
+
+// currentUser returns the user logged in the session, if any
+func currentUser(req *http.Request) (data.UserT, bool) {
+	session, err := webutil.Store.Get(req, SESSIONNAME)
+	if err != nil {
+		return data.UserT{}, false
+	}
+	login, ok := session.Values["login"].(string)
+	if !ok {
+		return data.UserT{}, false
+	}
+	return users.Get(login)
+}
+
+// requireRole only lets the users with (at least) the role through to the page
+func requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		u, ok := currentUser(req)
+		if !ok {
+			webutil.Reload(w, req, "/login")
+			return
+		}
+		if u.MustChangePassword {
+			webutil.PushAlert(w, req, webutil.ALERT_WARNING, "Tienes que cambiar la contraseña antes de seguir")
+			webutil.Reload(w, req, "/password")
+			return
+		}
+		if !data.RoleAllows(u.Role, role) {
+			log.Println("User", u.Login, "with role", u.Role, "denied", req.URL.Path)
+			webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Error! - no tienes permiso para hacer esto")
+			webutil.Reload(w, req, "/caldera")
+			return
+		}
+		h(w, withUser(req, u))
+	}
+}
+
+type userKeyT struct{}
+
+// withUser leaves the authenticated user in the request context for actorOf
+func withUser(req *http.Request, u data.UserT) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), userKeyT{}, u.Login))
+}
+
+// actorOf tells who makes the request, for the audit log: the token or the
+// user authenticated by requireRole or requireAPIRole, else the session user.
+// Never the unchecked credentials of the request
+func actorOf(req *http.Request) data.ActorT {
+	actor := data.ActorT{Source: data.SourceWeb, IP: req.RemoteAddr}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		actor.IP = host
+	}
+	if strings.HasPrefix(req.URL.Path, API_PREFIX) {
+		actor.Source = data.SourceAPI
+	}
+	if token, ok := req.Context().Value(tokenKeyT{}).(data.TokenT); ok {
+		actor.Name = "token:" + token.Name
+	} else if login, ok := req.Context().Value(userKeyT{}).(string); ok {
+		actor.Name = login
+	} else if u, ok := currentUser(req); ok {
+		actor.Name = u.Login
+	}
+	return actor
+}
+
+// change makes a change to the controller on behalf of the requester
+func change(req *http.Request, action string, f func() error) error {
+	return ctl.Change(actorOf(req), action, f)
+}
+
+type tokenKeyT struct{}
+
+// tokenAuth checks the bearer tokens of the API requests, leaving the token
+// in the request context for requireAPIRole. Requests without a token go
+// through untouched
+func tokenAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if !strings.HasPrefix(req.URL.Path, API_PREFIX) && req.URL.Path != METRICS_PATH {
+			apiError(w, http.StatusUnauthorized, "tokens are only valid for the API and the metrics")
+			return
+		}
+		token, ok := tokens.Check(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+		if !ok {
+			log.Println("Wrong API token from", req.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="caldera", error="invalid_token"`)
+			apiError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), tokenKeyT{}, token)))
+	})
+}
+
+// requireAPIRole is requireRole for the API, which also takes bearer tokens
+// (see tokenAuth), and answers with JSON errors instead of redirects
+func requireAPIRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if token, ok := req.Context().Value(tokenKeyT{}).(data.TokenT); ok {
+			if !data.RoleAllows(data.ScopeRole(token.Scope), role) {
+				log.Println("Token", token.Name, "with scope", token.Scope, "denied", req.Method, req.URL.Path)
+				apiError(w, http.StatusForbidden, "token scope "+token.Scope+" cannot do this")
+				return
+			}
+			h(w, req)
+			return
+		}
+		u, ok := currentUser(req)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="caldera"`)
+			apiError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if u.MustChangePassword {
+			apiError(w, http.StatusForbidden, "the password of "+u.Login+" must be changed first")
+			return
+		}
+		// Browsers send the session cookie on their own, so it needs the token too
+		if req.Method != http.MethodGet && req.Method != http.MethodHead && !validCSRF(req) {
+			apiError(w, http.StatusForbidden, "missing or wrong X-CSRF-Token")
+			return
+		}
+		if !data.RoleAllows(u.Role, role) {
+			log.Println("User", u.Login, "with role", u.Role, "denied", req.Method, req.URL.Path)
+			apiError(w, http.StatusForbidden, "role "+u.Role+" cannot do this, "+role+" needed")
+			return
+		}
+		h(w, withUser(req, u))
+	}
+}
+
+// getOrPost serves GET with the page and POST with the (CSRF checked) action
+func getOrPost(get, post http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			get(w, req)
+			return
+		}
+		mutating(post)(w, req)
+	}
+}
+
+func HandleLoginPage(w http.ResponseWriter, req *http.Request) {
+	passdata := map[string]interface{}{
+		"csrf": csrfToken(w, req),
+	}
+	webutil.PlaceHeader(w, req)
+	templates.ExecuteTemplate(w, "login.html", passdata)
+}
+
+func HandleLogin(w http.ResponseWriter, req *http.Request) {
+	u, err := users.Authenticate(req.FormValue("login"), req.FormValue("password"))
+	if err != nil {
+		log.Println("Failed login for", req.FormValue("login"), "from", req.RemoteAddr)
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Usuario o contraseña incorrectos")
+		webutil.Reload(w, req, "/login")
+		return
+	}
+	session, err := webutil.Store.Get(req, SESSIONNAME)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	session.Values["login"] = u.Login
+	session.Values["adminrights"] = u.Role == data.RoleAdmin
+	delete(session.Values, "csrf") // A new one for the new session
+	session.Save(req, w)
+	log.Println("User", u.Login, "logged in from", req.RemoteAddr)
+	if u.MustChangePassword {
+		webutil.PushAlert(w, req, webutil.ALERT_WARNING, "Tienes que cambiar la contraseña antes de seguir")
+		webutil.Reload(w, req, "/password")
+		return
+	}
+	webutil.Reload(w, req, "/caldera")
+}
+
+func HandleLogoutPage(w http.ResponseWriter, req *http.Request) {
+	passdata := map[string]interface{}{
+		"csrf": csrfToken(w, req),
+	}
+	webutil.PlaceHeader(w, req)
+	templates.ExecuteTemplate(w, "logout.html", passdata)
+}
+
+func HandleLogout(w http.ResponseWriter, req *http.Request) {
+	session, err := webutil.Store.Get(req, SESSIONNAME)
+	if err == nil {
+		delete(session.Values, "login")
+		delete(session.Values, "adminrights")
+		delete(session.Values, "csrf")
+		session.Save(req, w)
+	}
+	webutil.Reload(w, req, "/login")
+}
+
+func HandlePasswordPage(w http.ResponseWriter, req *http.Request) {
+	u, ok := currentUser(req)
+	if !ok {
+		webutil.Reload(w, req, "/login")
+		return
+	}
+	passdata := map[string]interface{}{
+		"login":     u.Login,
+		"minlength": data.MinPasswordLength,
+		"csrf":      csrfToken(w, req),
+	}
+	webutil.PlaceHeader(w, req)
+	templates.ExecuteTemplate(w, "password.html", passdata)
+}
+
+// HandlePassword lets the logged user change their password
+func HandlePassword(w http.ResponseWriter, req *http.Request) {
+	u, ok := currentUser(req)
+	if !ok {
+		webutil.Reload(w, req, "/login")
+		return
+	}
+	if req.FormValue("newpassword") != req.FormValue("passwordagain") {
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Error! - las contraseñas nuevas no coinciden")
+		webutil.Reload(w, req, "/password")
+		return
+	}
+	err := users.ChangePassword(u.Login, req.FormValue("oldpassword"), req.FormValue("newpassword"))
+	if err == nil {
+		audit.Record(actorOf(req), "changePassword", "", "")
+	}
+	if errors.Is(err, data.ErrInvalid) {
+		reportResult(w, req, err, "", "/password")
+		return
+	}
+	reportResult(w, req, err, "Contraseña cambiada", "/caldera")
+}
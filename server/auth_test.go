@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/juliofaura/caldera/data"
+)
+
+// TestActorOf checks that the audit log gets who was authenticated, not who
+// the request claims to be
+func TestActorOf(t *testing.T) {
+	setupWeb(t)
+	cookies, token := login(t)
+	var got data.ActorT
+	record := func(w http.ResponseWriter, req *http.Request) { got = actorOf(req) }
+
+	req := form(http.MethodPost, "/poweron", url.Values{"csrf": {token}})
+	req.SetBasicAuth("admin", "no es la suya")
+	req.RemoteAddr = "192.0.2.7:4321"
+	serve(requireRole(data.RoleOperator, mutating(record)), req, cookies)
+	if want := (data.ActorT{Name: "ana", Source: data.SourceWeb, IP: "192.0.2.7"}); got != want {
+		t.Errorf("web actor %+v, want %+v", got, want)
+	}
+
+	secret, err := tokens.Issue("domotica", data.ScopeControl, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodPost, API_PREFIX+"power", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	serve(tokenAuth(requireAPIRole(data.RoleOperator, record)), req, nil)
+	if got.Name != "token:domotica" || got.Source != data.SourceAPI {
+		t.Errorf("API actor %+v, want the token", got)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"net/http"
 
 	"github.com/gorilla/context"
+	"github.com/gorilla/sessions"
+	"github.com/juliofaura/caldera/data"
 	"github.com/juliofaura/webutil"
 )
 
@@ -29,6 +31,11 @@ const (
 var (
 	WEBPORT           string = "8050"
 	HEADER_PAGE_TITLE string = "Header page title"
+	WEBTLS            bool   = false
+	WEBCERTFILE       string = ""
+	WEBKEYFILE        string = ""
+	WEBREDIRECTPORT   string = "" // With TLS, plain HTTP on this port is redirected to HTTPS
+	WEBSESSIONKEYS    string = ".calderaSessionKeys.json"
 )
 
 var (
@@ -37,19 +44,43 @@ var (
 	SESSIONALERTS    string
 )
 
-var templates = template.Must(template.ParseFiles(
-	WEB_PATH+"caldera.html",
-	WEB_PATH+"gasoleo.html",
-	WEB_PATH+"temperatura.html",
-	WEB_PATH+"theme.html",
-))
-
-var consoleUsers = map[string]webutil.ConsoleUserT{
-	//TO DO: put this in the DB or at least into a file
-	"admin": {"admin", "1234", true},
+// The templates are parsed in StartWeb, so the package loads (and tests) without the web directory
+var templateFiles = []string{
+	WEB_PATH + "caldera.html",
+	WEB_PATH + "gasoleo.html",
+	WEB_PATH + "temperatura.html",
+	WEB_PATH + "programa.html",
+	WEB_PATH + "login.html",
+	WEB_PATH + "password.html",
+	WEB_PATH + "logout.html",
+	WEB_PATH + "auditoria.html",
+	WEB_PATH + "rellenos.html",
+	WEB_PATH + "theme.html",
 }
 
-func StartWeb() {
+var templates *template.Template
+
+var (
+	ctl     *data.Controller
+	history *data.History
+	users   *data.UserStore
+	tokens  *data.TokenStore
+	audit   *data.AuditLog
+	alerts  *data.AlertEngine
+	burner  *data.BurnerLog
+	refills *data.RefillStore
+)
+
+func StartWeb(c *data.Controller, h *data.History, u *data.UserStore, t *data.TokenStore, a *data.AuditLog, al *data.AlertEngine, b *data.BurnerLog, r *data.RefillStore) {
+	ctl = c
+	history = h
+	users = u
+	tokens = t
+	audit = a
+	alerts = al
+	burner = b
+	refills = r
+	templates = template.Must(template.ParseFiles(templateFiles...))
 
 	SESSIONNAME = SESSIONNAMEPREFIX + WEBPORT
 	SESSIONSTORENAME = SESSIONSTORENAMEPREFIX + WEBPORT
@@ -68,25 +99,82 @@ func StartWeb() {
 		SESSIONNAME,
 		SESSIONSTORENAME,
 		SESSIONALERTS,
-		consoleUsers,
+		map[string]webutil.ConsoleUserT{}, // Not used, the users are in the UserStore
 	)
-	http.Handle("/", http.HandlerFunc(HandleCaldera))
-	http.Handle("/caldera", http.HandlerFunc(HandleCaldera))
-	http.Handle("/gasoleo", http.HandlerFunc(HandleGasoleo))
-	http.Handle("/temperatura", http.HandlerFunc(HandleTemperatura))
-	http.Handle("/poweron", http.HandlerFunc(HandlePowerOn))
-	http.Handle("/poweroff", http.HandlerFunc(HandlePowerOff))
-	http.Handle("/thermostaton", http.HandlerFunc(HandleThermostatOn))
-	http.Handle("/thermostatoff", http.HandlerFunc(HandleThermostatOff))
-	http.Handle("/changetemp", http.HandlerFunc(HandleChangeTemp))
+	// webutil keys the cookies with SESSIONSTORENAME, which is in the source
+	keys, err := sessionKeys(WEBSESSIONKEYS)
+	if err != nil {
+		log.Fatal("Session keys:", err)
+	}
+	webutil.Store = sessions.NewCookieStore(keys.Hash, keys.Block)
+	webutil.Store.Options.HttpOnly = true
+	webutil.Store.Options.SameSite = http.SameSiteLaxMode
+	webutil.Store.Options.Secure = WEBTLS // So the session never goes in clear
+	viewer := func(h http.HandlerFunc) http.Handler { return requireRole(data.RoleViewer, h) }
+	admin := func(h http.HandlerFunc) http.Handler { return requireRole(data.RoleAdmin, h) }
+	operator := func(h http.HandlerFunc) http.Handler { return requireRole(data.RoleOperator, mutating(h)) }
+	apiViewer := func(h http.HandlerFunc) http.Handler { return requireAPIRole(data.RoleViewer, h) }
+	apiOperator := func(h http.HandlerFunc) http.Handler { return requireAPIRole(data.RoleOperator, h) }
+
+	http.Handle("/login", getOrPost(HandleLoginPage, HandleLogin))
+	http.Handle("/logout", getOrPost(HandleLogoutPage, HandleLogout))
+	http.Handle("/password", getOrPost(HandlePasswordPage, HandlePassword))
+	http.Handle("/", viewer(HandleCaldera))
+	http.Handle("/caldera", viewer(HandleCaldera))
+	http.Handle("/gasoleo", viewer(HandleGasoleo))
+	http.Handle("/temporadas.csv", viewer(HandleSeasonsCSV))
+	http.Handle("/temperatura", viewer(HandleTemperatura))
+	http.Handle("/rellenos", viewer(HandleRefills))
+	http.Handle("/rellenoprecio", operator(HandleRefillPrice))
+	http.Handle("/poweron", operator(HandlePowerOn))
+	http.Handle("/poweroff", operator(HandlePowerOff))
+	http.Handle("/thermostaton", operator(HandleThermostatOn))
+	http.Handle("/thermostatoff", operator(HandleThermostatOff))
+	http.Handle("/changetemp", operator(HandleChangeTemp))
+	http.Handle("/away", operator(HandleAway))
+	http.Handle("/awayoff", operator(HandleAwayOff))
+	http.Handle("/programa", viewer(HandleSchedule))
+	http.Handle("/scheduleon", operator(HandleScheduleOn))
+	http.Handle("/scheduleoff", operator(HandleScheduleOff))
+	http.Handle("/addslot", operator(HandleAddSlot))
+	http.Handle("/removeslot", operator(HandleRemoveSlot))
+	http.Handle("/history", viewer(HandleHistory))
+	http.Handle("/auditoria", admin(HandleAudit))
+	http.Handle(API_PREFIX, http.HandlerFunc(HandleAPINotFound))
+	http.Handle(API_PREFIX+"status", apiViewer(HandleAPIStatus))
+	http.Handle(API_PREFIX+"power", apiOperator(HandleAPIPower))
+	http.Handle(API_PREFIX+"thermostat", apiOperator(HandleAPIThermostat))
+	http.Handle(API_PREFIX+"target", apiOperator(HandleAPITarget))
+	http.Handle(API_PREFIX+"hysteresis", apiOperator(HandleAPIHysteresis))
+	http.Handle(API_PREFIX+"sensor", apiOperator(HandleAPISensor))
+	http.Handle(METRICS_PATH, apiViewer(HandleMetrics))
 	// http.Handle("/gasoleo", http.HandlerFunc(HandleGasoleo))
 	// http.Handle("/temperatura", http.HandlerFunc(HandleTemperatura))
-	http.Handle("/theme", http.HandlerFunc(HandleTheme))
+	http.Handle("/theme", viewer(HandleTheme))
 	http.Handle("/resources/", http.StripPrefix("/resources/", http.FileServer(http.Dir(WEB_PATH+"resources"))))
 	//http.Handle("/local_resources/", http.StripPrefix("/local_resources/", http.FileServer(http.Dir("./local_resources"))))
+	if WEBTLS {
+		if err := ensureCertificate(WEBCERTFILE, WEBKEYFILE); err != nil {
+			log.Fatal("Certificate:", err)
+		}
+		if WEBREDIRECTPORT != "" {
+			go func() {
+				err := http.ListenAndServe(":"+WEBREDIRECTPORT, http.HandlerFunc(redirectToHTTPS))
+				if err != nil {
+					log.Fatal("ListenAndServe (redirect):", err)
+				}
+			}()
+		}
+	}
 	go func() {
 		addr := flag.String("addr", ":"+WEBPORT, "http service address")
-		err := http.ListenAndServe(*addr, context.ClearHandler(http.DefaultServeMux))
+		handler := context.ClearHandler(tokenAuth(http.DefaultServeMux))
+		var err error
+		if WEBTLS {
+			err = http.ListenAndServeTLS(*addr, WEBCERTFILE, WEBKEYFILE, handler)
+		} else {
+			err = http.ListenAndServe(*addr, handler)
+		}
 		if err != nil {
 			log.Fatal("ListenAndServe:", err)
 		}
@@ -96,3 +184,13 @@ func StartWeb() {
 func HandleTheme(w http.ResponseWriter, req *http.Request) {
 	templates.ExecuteTemplate(w, "theme.html", "")
 }
+
+// reportResult tells the user how an action went and sends them back to where
+func reportResult(w http.ResponseWriter, req *http.Request, err error, success string, where string) {
+	if err != nil {
+		webutil.PushAlertf(w, req, webutil.ALERT_DANGER, "Error! - %v", err)
+	} else {
+		webutil.PushAlert(w, req, webutil.ALERT_SUCCESS, success)
+	}
+	webutil.Reload(w, req, where)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+
+	"github.com/juliofaura/webutil"
+)
+
+// Every session gets a random CSRF token, which the pages put in their forms
+// (as the csrf field) and the mutating routes check
+
+// csrfToken returns the token of the session, creating it if needed. It must
+// be called before writing anything, as it may set the session cookie
+func csrfToken(w http.ResponseWriter, req *http.Request) string {
+	session, err := webutil.Store.Get(req, SESSIONNAME)
+	if err != nil {
+		return ""
+	}
+	if token, ok := session.Values["csrf"].(string); ok {
+		return token
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	session.Values["csrf"] = token
+	session.Save(req, w)
+	return token
+}
+
+// validCSRF checks the token sent (in the csrf field or the X-CSRF-Token
+// header) against the one of the session
+func validCSRF(req *http.Request) bool {
+	session, err := webutil.Store.Get(req, SESSIONNAME)
+	if err != nil {
+		return false
+	}
+	token, ok := session.Values["csrf"].(string)
+	if !ok || token == "" {
+		return false
+	}
+	sent := req.Header.Get("X-CSRF-Token")
+	if sent == "" {
+		sent = req.PostFormValue("csrf")
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
+
+// mutating only lets POST requests with a valid CSRF token through
+func mutating(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !validCSRF(req) {
+			log.Println("Wrong CSRF token for", req.URL.Path, "from", req.RemoteAddr)
+			webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Error! - el formulario ha caducado, inténtalo otra vez")
+			webutil.Reload(w, req, "/caldera")
+			return
+		}
+		h(w, req)
+	}
+}
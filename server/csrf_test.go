@@ -0,0 +1,174 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/juliofaura/caldera/data"
+	"github.com/juliofaura/webutil"
+)
+
+const testPassword = "una contraseña larga"
+
+// setupWeb sets the session store and a user store with an operator, ana,
+// and a token store, as StartWeb does
+func setupWeb(t *testing.T) {
+	t.Helper()
+	SESSIONNAME = "testSession"
+	SESSIONALERTS = "testAlerts"
+	webutil.SESSIONNAME, webutil.SESSIONALERTS = SESSIONNAME, SESSIONALERTS
+	webutil.Store = sessions.NewCookieStore([]byte("a test key for the session store"))
+	var err error
+	if users, err = data.OpenUsers(filepath.Join(t.TempDir(), "users.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Add("ana", "temporal", data.RoleOperator); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ChangePassword("ana", "temporal", testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if tokens, err = data.OpenTokens(filepath.Join(t.TempDir(), "tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// login returns the cookies of a session of ana, and its CSRF token
+func login(t *testing.T) ([]*http.Cookie, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/login", nil)
+	session, err := webutil.Store.Get(req, SESSIONNAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["login"] = "ana"
+	session.Save(req, w)
+	// csrfToken reads the session from the request, so it goes on a second one
+	req = httptest.NewRequest(http.MethodGet, "/caldera", nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	token := csrfToken(w, req)
+	if token == "" {
+		t.Fatal("no CSRF token")
+	}
+	return w.Result().Cookies(), token
+}
+
+// serve runs h on the request with the cookies, and tells if it reached the
+// handler behind
+func serve(h http.Handler, req *http.Request, cookies []*http.Cookie) (*httptest.ResponseRecorder, bool) {
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w, w.Header().Get("X-Reached") == "yes"
+}
+
+func reached(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-Reached", "yes")
+	w.WriteHeader(http.StatusOK)
+}
+
+func form(method, target string, values url.Values) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestMutating(t *testing.T) {
+	setupWeb(t)
+	cookies, token := login(t)
+	h := mutating(reached)
+
+	header := form(http.MethodPost, "/poweron", url.Values{})
+	header.Header.Set("X-CSRF-Token", token)
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+		wantOK   bool
+	}{
+		{"GET", httptest.NewRequest(http.MethodGet, "/poweron?csrf="+url.QueryEscape(token), nil), http.StatusMethodNotAllowed, false},
+		{"no token", form(http.MethodPost, "/poweron", url.Values{}), http.StatusSeeOther, false},
+		{"wrong token", form(http.MethodPost, "/poweron", url.Values{"csrf": {token + "x"}}), http.StatusSeeOther, false},
+		{"form token", form(http.MethodPost, "/poweron", url.Values{"csrf": {token}}), http.StatusOK, true},
+		{"header token", header, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		w, ok := serve(h, tt.req, cookies)
+		if w.Code != tt.wantCode || ok != tt.wantOK {
+			t.Errorf("%v: got %v (handler called %v), want %v (%v)", tt.name, w.Code, ok, tt.wantCode, tt.wantOK)
+		}
+		if tt.wantCode == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "POST" {
+			t.Errorf("%v: Allow header %q, want POST", tt.name, w.Header().Get("Allow"))
+		}
+	}
+
+	// A token is only good for its own session
+	other, _ := login(t)
+	if w, ok := serve(h, form(http.MethodPost, "/poweron", url.Values{"csrf": {token}}), other); ok {
+		t.Errorf("token of another session accepted with %v", w.Code)
+	}
+}
+
+func TestAPICSRF(t *testing.T) {
+	setupWeb(t)
+	cookies, token := login(t)
+	h := tokenAuth(requireAPIRole(data.RoleOperator, reached))
+	target := API_PREFIX + "power"
+
+	// With the session cookie, only reading goes without the token
+	if w, ok := serve(h, httptest.NewRequest(http.MethodGet, target, nil), cookies); !ok {
+		t.Errorf("session GET got %v", w.Code)
+	}
+	if w, ok := serve(h, httptest.NewRequest(http.MethodPost, target, nil), cookies); ok || w.Code != http.StatusForbidden {
+		t.Errorf("session POST without token got %v (handler called %v), want 403", w.Code, ok)
+	}
+	req := httptest.NewRequest(http.MethodPost, target, nil)
+	req.Header.Set("X-CSRF-Token", token+"x")
+	if w, ok := serve(h, req, cookies); ok || w.Code != http.StatusForbidden {
+		t.Errorf("session POST with wrong token got %v (handler called %v), want 403", w.Code, ok)
+	}
+	req = httptest.NewRequest(http.MethodPost, target, nil)
+	req.Header.Set("X-CSRF-Token", token)
+	if w, ok := serve(h, req, cookies); !ok {
+		t.Errorf("session POST with token got %v", w.Code)
+	}
+
+	// Bearer tokens are not sent by browsers on their own, so they need no CSRF token
+	secret, err := tokens.Issue("domotica", data.ScopeControl, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodPost, target, nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	if w, ok := serve(h, req, nil); !ok {
+		t.Errorf("bearer POST got %v", w.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, target, nil)
+	req.Header.Set("Authorization", "Bearer "+secret+"x")
+	if w, ok := serve(h, req, nil); ok || w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong bearer POST got %v (handler called %v), want 401", w.Code, ok)
+	}
+
+	// HTTP basic auth is not taken, not even with the right password
+	req = httptest.NewRequest(http.MethodPost, target, nil)
+	req.SetBasicAuth("ana", testPassword)
+	w, ok := serve(h, req, nil)
+	if ok || w.Code != http.StatusUnauthorized {
+		t.Errorf("basic auth POST got %v (handler called %v), want 401", w.Code, ok)
+	}
+	if got := w.Header().Values("WWW-Authenticate"); len(got) != 1 || !strings.HasPrefix(got[0], "Bearer ") {
+		t.Errorf("WWW-Authenticate %q, want only Bearer", got)
+	}
+}
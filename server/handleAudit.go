@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/juliofaura/webutil"
+)
+
+const auditPageSize = 100
+
+// HandleAudit shows the last changes, e.g. /auditoria?filtro=web&n=500 (the
+// filter is an actor, a source or an action)
+func HandleAudit(w http.ResponseWriter, req *http.Request) {
+	n, err := strconv.Atoi(req.FormValue("n"))
+	if err != nil || n <= 0 {
+		n = auditPageSize
+	}
+	filter := req.FormValue("filtro")
+	entries, err := audit.Query(n, filter)
+	if err != nil {
+		webutil.PushAlertf(w, req, webutil.ALERT_DANGER, "Error! - al leer la auditoría: %v", err)
+	}
+	passdata := map[string]interface{}{
+		"entries": entries,
+		"filter":  filter,
+		"n":       n,
+	}
+	webutil.PlaceHeader(w, req)
+	templates.ExecuteTemplate(w, "auditoria.html", passdata)
+}
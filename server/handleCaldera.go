@@ -4,111 +4,111 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/juliofaura/caldera/data"
 	"github.com/juliofaura/webutil"
 )
 
 func HandleCaldera(w http.ResponseWriter, req *http.Request) {
-	data.M.Lock()
-	defer data.M.Unlock()
-
 	// webutil.PushAlertf(w, req, webutil.ALERT_SUCCESS, "Success!")
 	// webutil.Reload(w, req, "/")
 
-	data.ReadPower()
-	data.ReadHeat()
-	data.ReadTemp()
+	st := ctl.Status()
+	now := time.Now()
 
-	if data.PowerOn != data.PowerReading {
+	if st.PowerOn != st.PowerReading {
 		msg := "Error! - la caldera está "
-		if data.PowerOn {
+		if st.PowerOn {
 			msg += "encendida"
 		} else {
 			msg += "apagada"
 		}
 		msg += " y debería estar "
-		if data.PowerReading {
+		if st.PowerReading {
 			msg += "encendida"
 		} else {
 			msg += "apgada"
 		}
-		webutil.PushAlertf(w, req, webutil.ALERT_DANGER, msg)
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, msg)
 	}
 
-	if data.HeatOn != data.HeatReading {
+	if st.HeatOn != st.HeatReading {
 		msg := "Error! - el calentador está "
-		if data.HeatReading {
+		if st.HeatReading {
 			msg += "encendido"
 		} else {
 			msg += "apagado"
 		}
 		msg += " y debería estar "
-		if data.HeatOn {
+		if st.HeatOn {
 			msg += "encendido"
 		} else {
 			msg += "apagado"
 		}
-		webutil.PushAlertf(w, req, webutil.ALERT_DANGER, msg)
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, msg)
 	}
 
-	if data.ErrorInTemp {
-		msg := "Error! - error al medir la temperatura del sensor (" + data.Sensor + ")"
-		webutil.PushAlertf(w, req, webutil.ALERT_DANGER, msg)
+	if st.ErrorInTemp {
+		msg := "Error! - error al medir la temperatura del sensor (" + st.Sensor + ")"
+		if st.UsesAggregation() {
+			msg = "Error! - ningún sensor disponible para calcular la temperatura"
+		}
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, msg)
+	} else if st.UsesAggregation() {
+		for _, s := range st.Sensors {
+			if s.ErrorInTemp {
+				webutil.PushAlert(w, req, webutil.ALERT_WARNING, "Aviso - error al medir la temperatura del sensor ("+s.Name+"), no se tiene en cuenta")
+			}
+		}
+	}
 
+	for _, a := range alerts.Active() {
+		level := webutil.ALERT_WARNING
+		if a.Level == data.AlertCritical {
+			level = webutil.ALERT_DANGER
+		}
+		webutil.PushAlert(w, req, level, a.Title+" - "+a.Message)
 	}
 
 	passdata := map[string]interface{}{
-		"power":       data.PowerOn,
-		"thermostat":  data.ThermostatOn,
-		"heater":      data.HeatReading,
-		"sensor":      data.Sensor,
-		"temperature": data.CurrentTemp,
-		"targettemp":  data.TargetTemp,
+		"power":       st.PowerOn,
+		"thermostat":  st.ThermostatOn,
+		"heater":      st.HeatReading,
+		"sensor":      st.Sensor,
+		"aggregation": st.Aggregation,
+		"sensors":     st.Sensors,
+		"temperature": st.CurrentTemp,
+		"targettemp":  st.TargetTemp,
+		"scheduleon":  st.ScheduleOn,
+		"override":    st.Override,
+		"away":        st.Away,
+		"awayactive":  st.AwayActive(now),
+		"effective":   st.EffectiveTarget(now),
+		"frosttemp":   data.DefaultFrostTemp,
+		"csrf":        csrfToken(w, req),
 	}
 	webutil.PlaceHeader(w, req)
 	templates.ExecuteTemplate(w, "caldera.html", passdata)
 }
 
 func HandlePowerOn(w http.ResponseWriter, req *http.Request) {
-	data.M.Lock()
-	defer data.M.Unlock()
-	data.SetPower(data.ON)
-	data.WriteConfig()
-	webutil.PushAlertf(w, req, webutil.ALERT_SUCCESS, "Encendida la caldera")
-	webutil.Reload(w, req, "/caldera")
+	reportResult(w, req, change(req, "power", func() error { return ctl.SetPower(true) }), "Encendida la caldera", "/caldera")
 }
 
 func HandlePowerOff(w http.ResponseWriter, req *http.Request) {
-	data.M.Lock()
-	defer data.M.Unlock()
-	data.SetPower(data.OFF)
-	data.WriteConfig()
-	webutil.PushAlertf(w, req, webutil.ALERT_SUCCESS, "Apagada la caldera")
-	webutil.Reload(w, req, "/caldera")
+	reportResult(w, req, change(req, "power", func() error { return ctl.SetPower(false) }), "Apagada la caldera", "/caldera")
 }
 
 func HandleThermostatOn(w http.ResponseWriter, req *http.Request) {
-	data.M.Lock()
-	defer data.M.Unlock()
-	data.ThermostatOn = true
-	data.WriteConfig()
-	webutil.PushAlertf(w, req, webutil.ALERT_SUCCESS, "Activado el termostato")
-	webutil.Reload(w, req, "/caldera")
+	reportResult(w, req, change(req, "thermostat", func() error { return ctl.SetThermostat(true, false) }), "Activado el termostato", "/caldera")
 }
 
 func HandleThermostatOff(w http.ResponseWriter, req *http.Request) {
-	data.M.Lock()
-	defer data.M.Unlock()
-	data.ThermostatOn = false
-	data.WriteConfig()
-	webutil.PushAlertf(w, req, webutil.ALERT_SUCCESS, "Desactivado el termostato")
-	webutil.Reload(w, req, "/caldera")
+	reportResult(w, req, change(req, "thermostat", func() error { return ctl.SetThermostat(false, false) }), "Desactivado el termostato", "/caldera")
 }
 
 func HandleChangeTemp(w http.ResponseWriter, req *http.Request) {
-	data.M.Lock()
-	defer data.M.Unlock()
 	req.ParseForm()
 	newTempA, oknewtemp := req.Form["newtemp"]
 	if !oknewtemp {
@@ -118,12 +118,47 @@ func HandleChangeTemp(w http.ResponseWriter, req *http.Request) {
 	}
 	newTemp, err := strconv.ParseFloat(newTempA[0], 64)
 	if err != nil {
-		webutil.PushAlertf(w, req, webutil.ALERT_DANGER, "Temperatura incorrecta ("+newTempA[0]+")")
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Temperatura incorrecta ("+newTempA[0]+")")
 		webutil.Reload(w, req, "/")
 		return
 	}
-	data.TargetTemp = newTemp
-	data.WriteConfig()
-	webutil.PushAlertf(w, req, webutil.ALERT_SUCCESS, "Cambiada la temperatura objetivo a "+fmt.Sprint(newTemp))
-	webutil.Reload(w, req, "/caldera")
+	reportResult(w, req, change(req, "target", func() error { return ctl.SetTarget(newTemp, time.Now()) }), "Cambiada la temperatura objetivo a "+fmt.Sprint(newTemp), "/caldera")
+}
+
+func HandleAway(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	now := time.Now()
+	from, err := data.ParseAwayDate(req.FormValue("from"), now)
+	if err != nil {
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Fecha de salida incorrecta ("+req.FormValue("from")+")")
+		webutil.Reload(w, req, "/caldera")
+		return
+	}
+	to, err := data.ParseAwayDate(req.FormValue("to"), now)
+	if err != nil {
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Fecha de vuelta incorrecta ("+req.FormValue("to")+")")
+		webutil.Reload(w, req, "/caldera")
+		return
+	}
+	frostTemp, err := strconv.ParseFloat(req.FormValue("frosttemp"), 64)
+	if err != nil {
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Temperatura antiheladas incorrecta ("+req.FormValue("frosttemp")+")")
+		webutil.Reload(w, req, "/caldera")
+		return
+	}
+	preheatHours := 0.0
+	if req.FormValue("preheat") != "" {
+		preheatHours, err = strconv.ParseFloat(req.FormValue("preheat"), 64)
+		if err != nil {
+			webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Horas de precalentamiento incorrectas ("+req.FormValue("preheat")+")")
+			webutil.Reload(w, req, "/caldera")
+			return
+		}
+	}
+	away := data.AwayT{From: from, To: to, FrostTemp: frostTemp, Preheat: time.Duration(preheatHours * float64(time.Hour))}
+	reportResult(w, req, change(req, "away", func() error { return ctl.SetAway(away, now) }), "Programada la ausencia", "/caldera")
+}
+
+func HandleAwayOff(w http.ResponseWriter, req *http.Request) {
+	reportResult(w, req, change(req, "awayOff", ctl.CancelAway), "Cancelada la ausencia", "/caldera")
 }
@@ -3,9 +3,9 @@ package server
 import (
 	"fmt"
 	"log"
-	"math"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/juliofaura/caldera/data"
@@ -17,13 +17,23 @@ import (
 )
 
 const (
-	timeForGraph          = 61 * 24 * 60 * 60
-	GasFilteringThreshold = 50
+	timeForGraph            = 61 * 24 * 60 * 60
+	forecastForGraph        = 120 // Days of forecast drawn
+	degreeDayMonthsForGraph = 12
 )
 
+var gasoleoM sync.Mutex
+
+var burnerPeriodNames = map[string]string{
+	"today":     "Hoy",
+	"week":      "Esta semana",
+	"month":     "Este mes",
+	"lastMonth": "El mes pasado",
+}
+
 func HandleGasoleo(w http.ResponseWriter, req *http.Request) {
-	data.M.Lock()
-	defer data.M.Unlock()
+	gasoleoM.Lock() // The charts are rendered to fixed files
+	defer gasoleoM.Unlock()
 
 	// webutil.PushAlertf(w, req, webutil.ALERT_SUCCESS, "Success!")
 	// webutil.Reload(w, req, "/")
@@ -35,7 +45,12 @@ func HandleGasoleo(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	datums := files.FilterDatafile(raw_datums, GasFilteringThreshold)
+	datums := files.FilterDatafile(raw_datums, data.OilFilteringThreshold)
+	if len(datums) == 0 {
+		webutil.PushAlert(w, req, webutil.ALERT_WARNING, "Aún no hay datos del gasóleo")
+		webutil.Reload(w, req, "/caldera")
+		return
+	}
 
 	// avgFile, err := os.Open(files.AverageFile)
 	// if err != nil {
@@ -53,18 +68,7 @@ func HandleGasoleo(w http.ResponseWriter, req *http.Request) {
 	var XValues []float64
 	var YValues []float64
 
-	var histData [12]float64
-	var histTime [12]int64
-
-	for i, v := range datums {
-		if i > 0 {
-			thisDif := datums[i-1].Liters - v.Liters
-			thisTime := v.Timestamp - datums[i-1].Timestamp
-			if math.Abs(thisDif) < oildata.NewGasThreshold {
-				histData[v.Month-1] += thisDif
-				histTime[v.Month-1] += thisTime
-			}
-		}
+	for _, v := range datums {
 		if v.Timestamp < datums[len(datums)-1].Timestamp-timeForGraph {
 			continue
 		}
@@ -94,11 +98,9 @@ func HandleGasoleo(w http.ResponseWriter, req *http.Request) {
 		// {Value: 1, Label: "!!"},
 	}
 
-	for i, v := range histTime {
+	for i, v := range data.OilMonthly(datums) {
 		if v > 0 {
-			if histData[i] > 0 {
-				histAvgs[i].Value = (histData[i] / float64(v)) * 24 * 60 * 60
-			}
+			histAvgs[i].Value = v
 		}
 	}
 
@@ -115,22 +117,22 @@ func HandleGasoleo(w http.ResponseWriter, req *http.Request) {
 		labelColor = chart.ColorRed
 	}
 
-	var average = 0.0
-	firstPointForAverage, endingPointForAverage := datums[len(datums)-1], datums[len(datums)-1]
-	var bigChanges = 0.0
-	for i := len(datums) - 2; i >= 0; i-- {
-		if math.Abs(datums[i].Liters-datums[i+1].Liters) > oildata.NewGasThreshold {
-			bigChanges += datums[i+1].Liters - datums[i].Liters
-		}
-		firstPointForAverage = datums[i]
-		if endingPointForAverage.Timestamp-firstPointForAverage.Timestamp >= int64(oildata.TimeForAverage) {
+	average := data.OilAverage(datums)
+
+	// The forecast, its band drawn as the area between the top and the bottom
+	forecast, _ := data.OilForecast(history, datums, time.Now())
+	forecastX, forecastY := []float64{LastX}, []float64{LastY}
+	lowY, highY := []float64{LastY}, []float64{LastY}
+	for _, p := range forecast.Forecast {
+		if p.Time.After(forecast.From.AddDate(0, 0, forecastForGraph)) {
 			break
 		}
+		forecastX = append(forecastX, float64(p.Time.Unix()))
+		forecastY = append(forecastY, p.Liters)
+		lowY = append(lowY, p.Low)
+		highY = append(highY, p.High)
 	}
-
-	if firstPointForAverage.Timestamp != endingPointForAverage.Timestamp {
-		average = -float64(endingPointForAverage.Liters-firstPointForAverage.Liters-bigChanges) / (float64(endingPointForAverage.Timestamp-firstPointForAverage.Timestamp) / (24 * 60 * 60))
-	}
+	bandColor := drawing.ColorFromHex("FFCC80")
 
 	graph1 := chart.Chart{
 		XAxis: chart.XAxis{
@@ -160,6 +162,21 @@ func HandleGasoleo(w http.ResponseWriter, req *http.Request) {
 				XValues: XValues,
 				YValues: YValues,
 			},
+			chart.ContinuousSeries{
+				Style:   chart.Style{StrokeColor: bandColor, FillColor: bandColor.WithAlpha(128), StrokeWidth: 1},
+				XValues: forecastX,
+				YValues: highY,
+			},
+			chart.ContinuousSeries{
+				Style:   chart.Style{StrokeColor: bandColor, FillColor: drawing.ColorWhite, StrokeWidth: 1},
+				XValues: forecastX,
+				YValues: lowY,
+			},
+			chart.ContinuousSeries{
+				Style:   chart.Style{StrokeColor: drawing.ColorFromHex("E65100"), StrokeWidth: 2, StrokeDashArray: []float64{5, 5}},
+				XValues: forecastX,
+				YValues: forecastY,
+			},
 			chart.AnnotationSeries{
 				Annotations: []chart.Value2{
 					{
@@ -201,12 +218,131 @@ func HandleGasoleo(w http.ResponseWriter, req *http.Request) {
 	defer f.Close()
 	graph2.Render(chart.PNG, f)
 
+	// The consumption against the weather, if there is an outdoor temperature
+	temps := data.OutdoorTemps(history, time.Unix(datums[0].Timestamp, 0), time.Now())
+	var ddMonths, ddSeasons []map[string]string
+	ddChart := false
+	if temps != nil {
+		months := data.DegreeDayMonths(datums, temps)
+		if len(months) > degreeDayMonthsForGraph {
+			months = months[len(months)-degreeDayMonthsForGraph:]
+		}
+		var bars []chart.Value
+		for _, p := range months {
+			ddMonths = append(ddMonths, degreeDayRow(p))
+			bars = append(bars, chart.Value{Value: p.LitersPerDD, Style: histStyle, Label: p.From.Format("01/06")})
+			ddChart = ddChart || p.LitersPerDD > 0
+		}
+		for _, p := range data.DegreeDaySeasons(datums, temps) {
+			ddSeasons = append(ddSeasons, degreeDayRow(p))
+		}
+		if ddChart {
+			graph3 := chart.BarChart{
+				Title: fmt.Sprintf("Litros por grado-día (por debajo de %.1f grados)", data.DegreeDayBase),
+				Background: chart.Style{
+					Padding: chart.Box{
+						Top: 40,
+					},
+				},
+				Height:   512,
+				BarWidth: 60,
+				Bars:     bars,
+			}
+			f, _ = os.Create(RESOURCES_DIR + "gradosdia.png")
+			defer f.Close()
+			graph3.Render(chart.PNG, f)
+		}
+	}
+
+	seasons := latestSeasons(datums)
+	seasonsChart := renderSeasonsChart(seasons)
+
+	report := data.BurnerReport(burner, datums, time.Now())
+	var periods []map[string]string
+	for _, p := range report.Periods {
+		periods = append(periods, map[string]string{
+			"name":   burnerPeriodNames[p.Name],
+			"hours":  fmt.Sprintf("%.1f", p.Hours),
+			"liters": fmt.Sprintf("%.1f", p.Liters),
+			"cost":   fmt.Sprintf("%.2f", p.Cost),
+		})
+	}
+
 	passdata := map[string]interface{}{
 		"liters":         fmt.Sprintf("%.1f", datums[len(datums)-1].Liters),
 		"avg":            fmt.Sprintf("%.1f", average),
 		"daysforaverage": oildata.TimeForAverage / (60 * 60 * 24),
 		"datums":         datums,
+		"periods":        periods,
+		"forecast":       forecastRows(forecast),
+		"forecastrate":   fmt.Sprintf("%.1f", forecast.Rate),
+		"forecastband":   fmt.Sprintf("%.0f%% a %.0f%%", forecast.Band[0]*100, forecast.Band[1]*100),
+		"outdoor":        forecast.Outdoor,
+		"degreedays":     temps != nil,
+		"ddchart":        ddChart,
+		"ddmonths":       ddMonths,
+		"ddseasons":      ddSeasons,
+		"ddbase":         fmt.Sprintf("%.1f", data.DegreeDayBase),
+		"rate":           report.LitersPerHour > 0,
+		"litersperhour":  fmt.Sprintf("%.2f", report.LitersPerHour),
+		"ratefrom":       report.RateFrom.Format("02/01/2006"),
+		"ratehours":      fmt.Sprintf("%.1f", report.RateHours),
+		"price":          data.OilPrice > 0,
+		"monthliters":    fmt.Sprintf("%.0f", report.MonthLiters),
+		"monthcost":      fmt.Sprintf("%.2f", report.MonthCost),
+		"seasonschart":   seasonsChart,
 	}
+	seasonsPassdata(passdata, seasons)
 	webutil.PlaceHeader(w, req)
 	templates.ExecuteTemplate(w, "gasoleo.html", passdata)
 }
+
+var forecastLevelNames = map[string]string{
+	"warning":  "Aviso",
+	"critical": "Crítico",
+	"empty":    "Vacío",
+}
+
+// forecastRows are the levels of the forecast for the page
+func forecastRows(f data.OilForecastT) []map[string]string {
+	limit := f.From.AddDate(0, 0, data.ForecastDays)
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return "más allá del " + limit.Format("02/01/2006")
+		}
+		return t.Format("02/01/2006")
+	}
+	var rows []map[string]string
+	for _, l := range f.Levels {
+		if l.Reached {
+			rows = append(rows, map[string]string{"name": forecastLevelNames[l.Name], "liters": fmt.Sprintf("%.0f", l.Liters), "date": "Ya alcanzado"})
+			continue
+		}
+		rows = append(rows, map[string]string{
+			"name":     forecastLevelNames[l.Name],
+			"liters":   fmt.Sprintf("%.0f", l.Liters),
+			"date":     date(l.Date),
+			"earliest": date(l.Earliest),
+			"latest":   date(l.Latest),
+		})
+	}
+	return rows
+}
+
+func degreeDayRow(p data.DegreeDayPeriodT) map[string]string {
+	row := map[string]string{
+		"name":       p.Name,
+		"liters":     fmt.Sprintf("%.0f", p.Liters),
+		"degreedays": fmt.Sprintf("%.0f", p.DegreeDays),
+		"meantemp":   fmt.Sprintf("%.1f", p.MeanTemp),
+		"coverage":   fmt.Sprintf("%.0f%%", p.Coverage*100),
+		"perdd":      "-",
+	}
+	if p.Coverage == 0 {
+		row["degreedays"], row["meantemp"] = "-", "-"
+	}
+	if p.LitersPerDD > 0 {
+		row["perdd"] = fmt.Sprintf("%.2f", p.LitersPerDD)
+	}
+	return row
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/juliofaura/caldera/data"
+)
+
+// HandleHistory serves the samples of a range as JSON, e.g.
+// /history?from=24h&to=now&step=15m (from defaults to 24h, to to now and step
+// to no downsampling)
+func HandleHistory(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	query := req.URL.Query()
+	param := func(name, def string) string {
+		if v := query.Get(name); v != "" {
+			return v
+		}
+		return def
+	}
+	from, err := data.ParseHistoryTime(param("from", "24h"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := data.ParseHistoryTime(param("to", "now"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if query.Get("step") != "" {
+		step, err = time.ParseDuration(query.Get("step"))
+		if err != nil || step < 0 {
+			http.Error(w, "wrong step "+query.Get("step"), http.StatusBadRequest)
+			return
+		}
+	}
+	samples, err := history.Query(from, to, step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if samples == nil {
+		samples = []data.SampleT{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(samples)
+}
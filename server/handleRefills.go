@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/juliofaura/caldera/data"
+	"github.com/juliofaura/webutil"
+)
+
+type refillRow struct {
+	Day           string
+	Date          string
+	Before        string
+	After         string
+	Liters        string
+	Price         string
+	PricePerLiter string
+	Until         string
+	Days          string
+	Consumed      string
+	PerDay        string
+	Cost          string
+	Complete      bool
+}
+
+// HandleRefills lists the refills, newest first, with the oil burnt until the
+// next one and its cost
+func HandleRefills(w http.ResponseWriter, req *http.Request) {
+	datums, err := data.ReadOilDatums()
+	if err != nil {
+		webutil.PushAlertf(w, req, webutil.ALERT_DANGER, "Error leyendo los datos del gasoleo")
+	} else if _, err := refills.Update(datums); err != nil {
+		webutil.PushAlertf(w, req, webutil.ALERT_DANGER, "Error! - al guardar los rellenos: %v", err)
+	}
+	periods := data.RefillPeriods(refills.List(), datums)
+	var rows []refillRow
+	for i := len(periods) - 1; i >= 0; i-- {
+		p := periods[i]
+		row := refillRow{
+			Day:      p.Refill.Day(),
+			Date:     p.Refill.Time.Format("02/01/2006"),
+			Before:   fmt.Sprintf("%.0f", p.Refill.Before),
+			After:    fmt.Sprintf("%.0f", p.Refill.After),
+			Liters:   fmt.Sprintf("%.0f", p.Refill.Liters()),
+			Until:    p.To.Format("02/01/2006"),
+			Days:     fmt.Sprintf("%.0f", p.Days),
+			Consumed: fmt.Sprintf("%.0f", p.Consumed),
+			PerDay:   fmt.Sprintf("%.1f", p.PerDay),
+			Complete: p.Complete,
+		}
+		if p.Refill.Price > 0 {
+			row.Price = fmt.Sprintf("%.2f", p.Refill.Price)
+			row.PricePerLiter = fmt.Sprintf("%.3f", p.Refill.PricePerLiter())
+			row.Cost = fmt.Sprintf("%.2f", p.Cost)
+		}
+		rows = append(rows, row)
+	}
+	passdata := map[string]interface{}{
+		"refills": rows,
+		"csrf":    csrfToken(w, req),
+	}
+	webutil.PlaceHeader(w, req)
+	templates.ExecuteTemplate(w, "rellenos.html", passdata)
+}
+
+// HandleRefillPrice sets what was paid for a refill
+func HandleRefillPrice(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	day := req.FormValue("day")
+	price, err := strconv.ParseFloat(strings.Replace(req.FormValue("price"), ",", ".", 1), 64)
+	if err != nil || price < 0 {
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Precio incorrecto ("+req.FormValue("price")+")")
+		webutil.Reload(w, req, "/rellenos")
+		return
+	}
+	old, err := refills.SetPrice(day, price)
+	if err == nil {
+		audit.Record(actorOf(req), "refillPrice", fmt.Sprintf("refills.%v.price=%v", day, old), fmt.Sprintf("refills.%v.price=%v", day, price))
+	}
+	reportResult(w, req, err, "Guardado el precio del relleno del "+day, "/rellenos")
+}
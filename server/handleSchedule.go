@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/juliofaura/caldera/data"
+	"github.com/juliofaura/webutil"
+)
+
+var dayNamesES = []string{"Domingo", "Lunes", "Martes", "Miércoles", "Jueves", "Viernes", "Sábado"}
+
+type slotRow struct {
+	Day      string
+	DayKey   string
+	Start    string
+	Target   float64
+	IsActive bool
+}
+
+func HandleSchedule(w http.ResponseWriter, req *http.Request) {
+	st := ctl.Snapshot()
+	now := time.Now()
+	active, hasActive := st.ActiveSlot(now)
+	var rows []slotRow
+	for _, s := range st.Schedule {
+		rows = append(rows, slotRow{
+			Day:      dayNamesES[s.Day],
+			DayKey:   data.DayNames[s.Day],
+			Start:    s.StartString(),
+			Target:   s.Target,
+			IsActive: hasActive && s == active,
+		})
+	}
+
+	passdata := map[string]interface{}{
+		"scheduleon": st.ScheduleOn,
+		"slots":      rows,
+		"targettemp": st.TargetTemp,
+		"override":   st.Override,
+		"csrf":       csrfToken(w, req),
+	}
+	webutil.PlaceHeader(w, req)
+	templates.ExecuteTemplate(w, "programa.html", passdata)
+}
+
+func HandleScheduleOn(w http.ResponseWriter, req *http.Request) {
+	reportResult(w, req, change(req, "schedule", func() error { return ctl.SetScheduleOn(true, time.Now()) }), "Activado el programa semanal", "/programa")
+}
+
+func HandleScheduleOff(w http.ResponseWriter, req *http.Request) {
+	reportResult(w, req, change(req, "schedule", func() error { return ctl.SetScheduleOn(false, time.Now()) }), "Desactivado el programa semanal", "/programa")
+}
+
+func HandleAddSlot(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	days, err := data.ParseDays(req.FormValue("days"))
+	if err != nil {
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Días incorrectos ("+req.FormValue("days")+")")
+		webutil.Reload(w, req, "/programa")
+		return
+	}
+	start, err := data.ParseHour(req.FormValue("start"))
+	if err != nil {
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Hora incorrecta ("+req.FormValue("start")+")")
+		webutil.Reload(w, req, "/programa")
+		return
+	}
+	target, err := strconv.ParseFloat(req.FormValue("target"), 64)
+	if err != nil {
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Temperatura incorrecta ("+req.FormValue("target")+")")
+		webutil.Reload(w, req, "/programa")
+		return
+	}
+	reportResult(w, req, change(req, "addSlot", func() error { return ctl.SetSlots(days, start, target, time.Now()) }), "Añadido el tramo", "/programa")
+}
+
+func HandleRemoveSlot(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	days, err := data.ParseDays(req.FormValue("day"))
+	start, err2 := data.ParseHour(req.FormValue("start"))
+	if err != nil || err2 != nil || len(days) != 1 {
+		webutil.PushAlert(w, req, webutil.ALERT_DANGER, "Error al borrar el tramo")
+		webutil.Reload(w, req, "/programa")
+		return
+	}
+	err = change(req, "removeSlot", func() error {
+		_, err := ctl.RemoveSlots(days, start, time.Now())
+		return err
+	})
+	reportResult(w, req, err, "Borrado el tramo", "/programa")
+}
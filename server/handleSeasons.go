@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/juliofaura/caldera/data"
+	oildata "github.com/juliofaura/oilmeter/data"
+	"github.com/juliofaura/webutil"
+	chart "github.com/wcharczuk/go-chart/v2"
+)
+
+const seasonsForTable = 5 // Latest heating seasons compared side by side
+
+var seasonMonthNames = []string{"Oct", "Nov", "Dic", "Ene", "Feb", "Mar", "Abr", "May"}
+
+type seasonRow struct {
+	Month  string
+	Liters []string
+}
+
+// latestSeasons are the heating seasons of the datums, newest first
+func latestSeasons(datums []oildata.Datapoint) []data.OilSeasonT {
+	all := data.OilSeasons(datums)
+	var seasons []data.OilSeasonT
+	for i := len(all) - 1; i >= 0 && len(seasons) < seasonsForTable; i-- {
+		seasons = append(seasons, all[i])
+	}
+	return seasons
+}
+
+// seasonsPassdata fills the season comparison of the gasoleo page: the liters
+// of each month (marked if only some of its days have data), the totals and
+// the newest season against the others up to the same day
+func seasonsPassdata(passdata map[string]interface{}, seasons []data.OilSeasonT) {
+	var names, totals []string
+	rows := make([]seasonRow, len(data.SeasonMonths))
+	for i := range rows {
+		rows[i].Month = seasonMonthNames[i]
+	}
+	for _, s := range seasons {
+		names = append(names, s.Name)
+		totals = append(totals, fmt.Sprintf("%.0f", s.Total))
+		for i := range rows {
+			cell := "-"
+			if s.Days[i] > 0 {
+				cell = fmt.Sprintf("%.0f", s.Liters[i])
+				month := s.Start.AddDate(0, i, 0)
+				if s.Days[i] < int(month.AddDate(0, 1, 0).Sub(month).Hours()/24+0.5) {
+					cell += " *"
+				}
+			}
+			rows[i].Liters = append(rows[i].Liters, cell)
+		}
+	}
+	passdata["seasons"] = names
+	passdata["seasonrows"] = rows
+	passdata["seasontotals"] = totals
+
+	var compare []map[string]string
+	if len(seasons) > 0 && seasons[0].Complete {
+		current := seasons[0]
+		day := len(current.Cumulative) - 1
+		now, _ := current.CumulativeAt(day)
+		passdata["seasonday"] = current.LastDay().Format("02/01")
+		for _, s := range seasons {
+			liters, ok := s.CumulativeAt(day)
+			if !ok {
+				continue
+			}
+			row := map[string]string{"name": s.Name, "liters": fmt.Sprintf("%.0f", liters), "diff": "-"}
+			if s.Name != current.Name && liters > 0 {
+				row["diff"] = fmt.Sprintf("%+.0f%%", (now-liters)/liters*100)
+			}
+			compare = append(compare, row)
+		}
+	}
+	passdata["seasoncompare"] = compare
+}
+
+// renderSeasonsChart draws the liters burnt since the start of each season
+// with data of all of it, false if there is none
+func renderSeasonsChart(seasons []data.OilSeasonT) bool {
+	var series []chart.Series
+	for i := len(seasons) - 1; i >= 0; i-- {
+		s := seasons[i]
+		if !s.Complete {
+			continue
+		}
+		var XValues []float64
+		for day := range s.Cumulative {
+			XValues = append(XValues, float64(day))
+		}
+		width := 2.0
+		if i == 0 {
+			width = 4
+		}
+		series = append(series, chart.ContinuousSeries{
+			Name:    s.Name,
+			Style:   chart.Style{StrokeColor: chart.GetDefaultColor(i), StrokeWidth: width},
+			XValues: XValues,
+			YValues: s.Cumulative,
+		})
+	}
+	if len(series) == 0 {
+		return false
+	}
+	graph := chart.Chart{
+		Title: "Consumo acumulado por temporada",
+		Background: chart.Style{
+			Padding: chart.Box{
+				Top:  40,
+				Left: 20,
+			},
+		},
+		XAxis: chart.XAxis{
+			ValueFormatter: func(v interface{}) string {
+				day := time.Date(2001, time.October, 1+int(v.(float64)), 0, 0, 0, 0, time.Local)
+				return fmt.Sprintf("%d/%d", day.Day(), day.Month())
+			},
+		},
+		YAxis: chart.YAxis{
+			ValueFormatter: func(v interface{}) string {
+				return fmt.Sprintf("%.0f", v.(float64))
+			},
+		},
+		Series: series,
+	}
+	graph.Elements = []chart.Renderable{chart.Legend(&graph)}
+	f, err := os.Create(RESOURCES_DIR + "temporadas.png")
+	if err != nil {
+		log.Println("Error! ", err)
+		return false
+	}
+	defer f.Close()
+	if err := graph.Render(chart.PNG, f); err != nil {
+		log.Println("Error rendering the seasons chart:", err)
+		return false
+	}
+	return true
+}
+
+// HandleSeasonsCSV downloads the season comparison of the gasoleo page
+func HandleSeasonsCSV(w http.ResponseWriter, req *http.Request) {
+	datums, err := data.ReadOilDatums()
+	if err != nil {
+		webutil.PushAlertf(w, req, webutil.ALERT_DANGER, "Error leyendo los datos del gasoleo")
+		webutil.Reload(w, req, "/gasoleo")
+		return
+	}
+	seasons := latestSeasons(datums)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="temporadas.csv"`)
+	out := csv.NewWriter(w)
+	header := []string{"mes"}
+	for _, s := range seasons {
+		header = append(header, s.Name, s.Name+" dias")
+	}
+	out.Write(header)
+	for i, m := range data.SeasonMonths {
+		record := []string{fmt.Sprintf("%02d", int(m))}
+		for _, s := range seasons {
+			record = append(record, fmt.Sprintf("%.1f", s.Liters[i]), fmt.Sprint(s.Days[i]))
+		}
+		out.Write(record)
+	}
+	total := []string{"total"}
+	for _, s := range seasons {
+		days := 0
+		for _, d := range s.Days {
+			days += d
+		}
+		total = append(total, fmt.Sprintf("%.1f", s.Total), fmt.Sprint(days))
+	}
+	out.Write(total)
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Println("Error writing the seasons CSV:", err)
+	}
+}
@@ -1,19 +1,202 @@
 package server
 
 import (
+	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/juliofaura/webutil"
+	chart "github.com/wcharczuk/go-chart/v2"
+	"github.com/wcharczuk/go-chart/v2/drawing"
 )
 
+type temperaturaWindowT struct {
+	Key   string
+	Label string
+	Span  time.Duration
+	Step  time.Duration // The samples are averaged to this, so the charts do not get too crowded
+	Axis  string        // Time format for the X axis
+}
+
+var temperaturaWindows = []temperaturaWindowT{
+	{"24h", "24 horas", 24 * time.Hour, 5 * time.Minute, "15:04"},
+	{"7d", "7 días", 7 * 24 * time.Hour, 30 * time.Minute, "02/01 15h"},
+	{"30d", "30 días", 30 * 24 * time.Hour, 2 * time.Hour, "02/01"},
+}
+
+var temperaturaM sync.Mutex
+
 func HandleTemperatura(w http.ResponseWriter, req *http.Request) {
+	temperaturaM.Lock() // The charts are rendered to fixed files
+	defer temperaturaM.Unlock()
+
+	window := temperaturaWindows[0]
+	for _, v := range temperaturaWindows {
+		if v.Key == req.FormValue("ventana") {
+			window = v
+		}
+	}
+
+	now := time.Now()
+	samples, err := history.Query(now.Add(-window.Span), now, window.Step)
+	if err != nil {
+		webutil.PushAlertf(w, req, webutil.ALERT_DANGER, "Error leyendo el histórico de temperaturas: %v", err)
+		webutil.Reload(w, req, "/caldera")
+		return
+	}
 
-	// webutil.PushAlertf(w, req, webutil.ALERT_SUCCESS, "Success!")
-	// webutil.Reload(w, req, "/")
+	var XValues, TempValues, TargetValues, HeatX, HeatValues []float64
+	sensorX := map[string][]float64{}
+	sensorY := map[string][]float64{}
+	var heat float64
+	var n int
+	for _, v := range samples {
+		x := float64(v.Time.Unix())
+		// Each bucket is drawn as a step, so the shading covers its whole span
+		HeatX = append(HeatX, x, x+window.Step.Seconds())
+		HeatValues = append(HeatValues, v.HeatReading, v.HeatReading)
+		heat += v.HeatReading * float64(v.N)
+		n += v.N
+		if !v.TempOK {
+			continue
+		}
+		XValues = append(XValues, x)
+		TempValues = append(TempValues, v.Temp)
+		TargetValues = append(TargetValues, v.Target)
+		for name, temp := range v.Sensors {
+			sensorX[name] = append(sensorX[name], x)
+			sensorY[name] = append(sensorY[name], temp)
+		}
+	}
 
+	xAxis := chart.XAxis{
+		TickPosition: chart.TickPositionBetweenTicks,
+		ValueFormatter: func(v interface{}) string {
+			return time.Unix(int64(v.(float64)), 0).Format(window.Axis)
+		},
+		Style: chart.Style{
+			TextRotationDegrees: 45,
+		},
+	}
+	yAxis := chart.YAxis{
+		ValueFormatter: func(v interface{}) string {
+			return fmt.Sprintf("%.1f", v.(float64))
+		},
+	}
+
+	nodata := len(XValues) < 2
+	if !nodata {
+		graph1 := chart.Chart{
+			XAxis: xAxis,
+			YAxis: yAxis,
+			YAxisSecondary: chart.YAxis{
+				Style: chart.Hidden(),
+				Range: &chart.ContinuousRange{Min: 0, Max: 1},
+			},
+			Series: []chart.Series{
+				chart.ContinuousSeries{
+					Name:    "Quemador encendido",
+					YAxis:   chart.YAxisSecondary,
+					XValues: HeatX,
+					YValues: HeatValues,
+					Style: chart.Style{
+						StrokeColor: drawing.ColorFromHex("FF9900").WithAlpha(64),
+						FillColor:   drawing.ColorFromHex("FF9900").WithAlpha(64),
+						StrokeWidth: 1,
+					},
+				},
+				chart.ContinuousSeries{
+					Name:    "Temperatura",
+					XValues: XValues,
+					YValues: TempValues,
+					Style: chart.Style{
+						StrokeColor: chart.GetDefaultColor(0),
+						StrokeWidth: 2,
+					},
+				},
+				chart.ContinuousSeries{
+					Name:    "Objetivo",
+					XValues: XValues,
+					YValues: TargetValues,
+					Style: chart.Style{
+						StrokeColor:     chart.ColorRed,
+						StrokeWidth:     2,
+						StrokeDashArray: []float64{5, 5},
+					},
+				},
+			},
+			Title: "Temperatura y objetivo (" + window.Label + ")",
+			Background: chart.Style{
+				Padding: chart.Box{
+					Top: 40,
+				},
+			},
+		}
+		graph1.Elements = []chart.Renderable{chart.Legend(&graph1)}
+		renderChart(&graph1, "temperatura.png")
+	}
+
+	var names []string
+	for name, x := range sensorX {
+		if len(x) >= 2 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		graph2 := chart.Chart{
+			XAxis: xAxis,
+			YAxis: yAxis,
+			Title: "Temperatura por sensor (" + window.Label + ")",
+			Background: chart.Style{
+				Padding: chart.Box{
+					Top: 40,
+				},
+			},
+		}
+		for i, name := range names {
+			graph2.Series = append(graph2.Series, chart.ContinuousSeries{
+				Name:    name,
+				XValues: sensorX[name],
+				YValues: sensorY[name],
+				Style: chart.Style{
+					StrokeColor: chart.GetDefaultColor(i),
+					StrokeWidth: 2,
+				},
+			})
+		}
+		graph2.Elements = []chart.Renderable{chart.Legend(&graph2)}
+		renderChart(&graph2, "sensores.png")
+	}
+
+	heatPercent := 0.0
+	if n > 0 {
+		heatPercent = 100 * heat / float64(n)
+	}
 	passdata := map[string]interface{}{
-		"etc": "etc",
+		"windows":     temperaturaWindows,
+		"window":      window.Key,
+		"nodata":      nodata,
+		"sensors":     len(names) > 0,
+		"heatpercent": fmt.Sprintf("%.1f", heatPercent),
+		"stamp":       now.Unix(), // So the browser does not show cached charts
 	}
 	webutil.PlaceHeader(w, req)
 	templates.ExecuteTemplate(w, "temperatura.html", passdata)
 }
+
+func renderChart(graph *chart.Chart, name string) {
+	f, err := os.Create(RESOURCES_DIR + name)
+	if err != nil {
+		log.Println("Error! ", err)
+		return
+	}
+	defer f.Close()
+	if err := graph.Render(chart.PNG, f); err != nil {
+		log.Println("Error rendering", name, err)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juliofaura/caldera/data"
+)
+
+// The metrics in the Prometheus text format, for scraping with a read token
+// (Authorization: Bearer)
+
+const METRICS_PATH = "/metrics"
+
+// metricsT writes the metrics, each family with its HELP and TYPE
+type metricsT struct {
+	b strings.Builder
+}
+
+func (m *metricsT) family(name, kind, help string) {
+	fmt.Fprintf(&m.b, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+// value writes a sample, labels go in pairs of name and value
+func (m *metricsT) value(name string, v float64, labels ...string) {
+	m.b.WriteString(name)
+	if len(labels) > 0 {
+		var pairs []string
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+		}
+		m.b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	fmt.Fprintf(&m.b, " %v\n", v)
+}
+
+// gauge is a family with a single sample
+func (m *metricsT) gauge(name, help string, v float64) {
+	m.family(name, "gauge", help)
+	m.value(name, v)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// HandleMetrics is GET /metrics
+func HandleMetrics(w http.ResponseWriter, req *http.Request) {
+	st := ctl.Snapshot()
+	stats := ctl.Stats()
+	now := time.Now()
+	m := &metricsT{}
+
+	m.gauge("caldera_temperature_ok", "Whether the reference temperature could be read (1) or not (0)", boolValue(!st.ErrorInTemp))
+	if !st.ErrorInTemp {
+		m.gauge("caldera_temperature_celsius", "Reference temperature, the one the thermostat controls", st.CurrentTemp)
+	}
+	m.family("caldera_sensor_temperature_celsius", "gauge", "Last temperature read from each sensor")
+	if st.UsesAggregation() {
+		for _, s := range st.Sensors {
+			if !s.ErrorInTemp {
+				m.value("caldera_sensor_temperature_celsius", s.Temp, "sensor", s.Name)
+			}
+		}
+	} else if !st.ErrorInTemp {
+		m.value("caldera_sensor_temperature_celsius", st.CurrentTemp, "sensor", st.Sensor)
+	}
+	m.gauge("caldera_target_celsius", "Target temperature as set (by hand or by the schedule)", st.TargetTemp)
+	m.gauge("caldera_effective_target_celsius", "Temperature the thermostat controls to, away mode included", st.EffectiveTarget(now))
+	m.gauge("caldera_hysteresis_celsius", "Hysteresis of the thermostat", st.Hysteresis)
+	m.gauge("caldera_thermostat_on", "Whether the thermostat function is on", boolValue(st.ThermostatOn))
+	m.gauge("caldera_schedule_on", "Whether the weekly program is on", boolValue(st.ScheduleOn))
+	m.gauge("caldera_away_active", "Whether the away mode is active now", boolValue(st.AwayActive(now)))
+
+	m.family("caldera_power", "gauge", "Power of the boiler, as commanded and as read from the sense line")
+	m.value("caldera_power", boolValue(st.PowerOn), "state", "commanded")
+	m.value("caldera_power", boolValue(st.PowerReading), "state", "read")
+	m.family("caldera_heat", "gauge", "Heat (burner) of the boiler, as commanded and as read from the sense line")
+	m.value("caldera_heat", boolValue(st.HeatOn), "state", "commanded")
+	m.value("caldera_heat", boolValue(st.HeatReading), "state", "read")
+
+	m.family("caldera_relay_switches_total", "counter", "Times the relays have been switched since the start")
+	m.value("caldera_relay_switches_total", float64(stats.PowerSwitches), "relay", "power")
+	m.value("caldera_relay_switches_total", float64(stats.HeatSwitches), "relay", "heat")
+	m.family("caldera_sensor_reads_total", "counter", "Reads of each sensor since the start")
+	for _, name := range sortedKeys(stats.SensorReads) {
+		m.value("caldera_sensor_reads_total", float64(stats.SensorReads[name]), "sensor", name)
+	}
+	m.family("caldera_sensor_errors_total", "counter", "Failed reads of each sensor since the start")
+	for _, name := range sortedKeys(stats.SensorReads) {
+		m.value("caldera_sensor_errors_total", float64(stats.SensorErrors[name]), "sensor", name)
+	}
+	m.gauge("caldera_control_failures", "Consecutive thermostat steps without a temperature", float64(stats.Failures))
+	m.gauge("caldera_retry_backoff_seconds", "Wait before the next thermostat step after failures (0 if all is well)", stats.Retry.Seconds())
+
+	last, average, ok := data.ReadOil()
+	m.gauge("caldera_oil_ok", "Whether the oil data could be read (1) or not (0)", boolValue(ok))
+	if ok {
+		m.gauge("caldera_oil_liters", "Oil in the tank", last.Liters)
+		m.gauge("caldera_oil_timestamp_seconds", "When the oil was last measured", float64(last.Timestamp))
+		m.gauge("caldera_oil_daily_consumption_liters", "Average daily oil consumption, refills left out", average)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(m.b.String()))
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juliofaura/caldera/data"
+	"github.com/juliofaura/oilmeter/files"
+)
+
+func TestLabelEscaping(t *testing.T) {
+	m := &metricsT{}
+	m.value("x", 1.5, "sensor", "sa\\l\"ón\nbajo", "state", "read")
+	want := "x{sensor=\"sa\\\\l\\\"ón\\nbajo\",state=\"read\"} 1.5\n"
+	if got := m.b.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	dir := t.TempDir()
+	configFile := data.ConfigFileName
+	data.ConfigFileName = filepath.Join(dir, "config.json")
+	dataFile := files.DataFile
+	files.DataFile = filepath.Join(dir, "missing.csv")
+	t.Cleanup(func() { data.ConfigFileName, files.DataFile = configFile, dataFile })
+	data.OpenSimulated()
+
+	ctl = data.NewController()
+	sensor := `sal"ón`
+	temp := filepath.Join(dir, "temp")
+	if err := os.WriteFile(temp, []byte("19.5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		ctl.SetAggregation(data.AggAverage),
+		ctl.AddSensor(sensor, 1),
+		ctl.SetSource(sensor, "file:"+temp),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctl.Refresh()
+
+	w := httptest.NewRecorder()
+	HandleMetrics(w, httptest.NewRequest(http.MethodGet, METRICS_PATH, nil))
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", got)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"caldera_temperature_ok 1\n",
+		"caldera_temperature_celsius 19.5\n",
+		`caldera_sensor_temperature_celsius{sensor="sal\"ón"} 19.5` + "\n",
+		`caldera_power{state="commanded"} 1` + "\n",
+		`caldera_sensor_reads_total{sensor="sal\"ón"} 1` + "\n",
+		`caldera_sensor_errors_total{sensor="sal\"ón"} 0` + "\n",
+		"caldera_oil_ok 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q", want)
+		}
+	}
+	if strings.Contains(body, "caldera_oil_liters") {
+		t.Error("oil liters without oil data")
+	}
+
+	// Every sample belongs to the family declared (with its HELP and TYPE) before it
+	var family string
+	declared := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			family = strings.Fields(line)[2]
+		case strings.HasPrefix(line, "# TYPE "):
+			fields := strings.Fields(line)
+			if fields[2] != family || (fields[3] != "gauge" && fields[3] != "counter") {
+				t.Errorf("wrong TYPE line %q after the HELP of %v", line, family)
+			}
+			if declared[family] {
+				t.Errorf("family %v declared twice", family)
+			}
+			declared[family] = true
+		default:
+			name, _, _ := strings.Cut(line, " ")
+			name, _, _ = strings.Cut(name, "{")
+			if name != family || !declared[family] {
+				t.Errorf("sample %q out of its family %v", line, family)
+			}
+		}
+	}
+}
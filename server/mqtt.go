@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/juliofaura/caldera/data"
+)
+
+// The MQTT bridge publishes the state (retained) to <topic>/state and takes
+// commands from <topic>/<command>/set, making the changes as the web does. With
+// a discovery prefix it also announces the Home Assistant entities: a climate
+// for the thermostat, a switch for the power and sensors for the burner and
+// the oil
+
+const (
+	mqttCheckInterval = 5 * time.Second // The state is published as soon as it changes, checking this often
+	mqttTimeout       = 10 * time.Second
+)
+
+// mqttStateT is the payload of <topic>/state
+type mqttStateT struct {
+	Temperature     *float64 `json:"temperature"` // null if it could not be read
+	Target          float64  `json:"target"`
+	EffectiveTarget float64  `json:"effective_target"`
+	Hysteresis      float64  `json:"hysteresis"`
+	Mode            string   `json:"mode"`   // heat or off, the thermostat
+	Action          string   `json:"action"` // heating, idle or off, the burner
+	Power           string   `json:"power"`  // ON or OFF, commanded
+	PowerRead       string   `json:"power_read"`
+	Heat            string   `json:"heat"`
+	HeatRead        string   `json:"heat_read"`
+	Thermostat      string   `json:"thermostat"`
+	Schedule        string   `json:"schedule"`
+	Away            string   `json:"away"`
+	OilLiters       *float64 `json:"oil_liters"` // null if there are no oil data
+	OilDaily        *float64 `json:"oil_daily"`
+}
+
+func mqttOnOff(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
+}
+
+func mqttState(st data.StateT, now time.Time, oil *float64, oilDaily *float64) mqttStateT {
+	state := mqttStateT{
+		Target:          st.TargetTemp,
+		EffectiveTarget: st.EffectiveTarget(now),
+		Hysteresis:      st.Hysteresis,
+		Mode:            "off",
+		Action:          "off",
+		Power:           mqttOnOff(st.PowerOn),
+		PowerRead:       mqttOnOff(st.PowerReading),
+		Heat:            mqttOnOff(st.HeatOn),
+		HeatRead:        mqttOnOff(st.HeatReading),
+		Thermostat:      mqttOnOff(st.ThermostatOn),
+		Schedule:        mqttOnOff(st.ScheduleOn),
+		Away:            mqttOnOff(st.AwayActive(now)),
+		OilLiters:       oil,
+		OilDaily:        oilDaily,
+	}
+	if !st.ErrorInTemp {
+		temp := st.CurrentTemp
+		state.Temperature = &temp
+	}
+	if st.ThermostatOn {
+		state.Mode = "heat"
+	}
+	if st.PowerReading {
+		state.Action = "idle"
+		if st.HeatReading {
+			state.Action = "heating"
+		}
+	}
+	return state
+}
+
+type mqttBridgeT struct {
+	client paho.Client
+	topic  string
+
+	mu        sync.Mutex
+	published []byte // Last state published (or being published)
+	built     int    // States built to be published, to tell their order
+	sent      int    // The last of them known to be at the broker
+	oil       *float64
+	oilDaily  *float64
+	oilRead   time.Time
+}
+
+func (b *mqttBridgeT) t(suffix string) string {
+	return b.topic + "/" + suffix
+}
+
+// StartMQTT connects to the broker (retrying in the background until it
+// answers) and starts publishing. It must be called after StartWeb
+func StartMQTT() error {
+	if data.MQTTBroker == "" {
+		return nil
+	}
+	opts := paho.NewClientOptions().
+		AddBroker(data.MQTTBroker).
+		SetClientID(data.MQTTClientID).
+		SetUsername(data.MQTTUsername).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false) // So the handlers can publish
+	if data.MQTTPasswordFile != "" {
+		raw, err := os.ReadFile(data.MQTTPasswordFile)
+		if err != nil {
+			return err
+		}
+		opts.SetPassword(strings.TrimSpace(string(raw)))
+	}
+	b := &mqttBridgeT{topic: data.MQTTTopic}
+	opts.SetWill(b.t("availability"), "offline", 1, true)
+	opts.SetOnConnectHandler(b.onConnect)
+	opts.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		log.Println("MQTT connection lost:", err)
+	})
+	b.client = paho.NewClient(opts)
+	b.client.Connect() // With SetConnectRetry it keeps trying on its own
+	log.Println("MQTT connecting to", data.MQTTBroker)
+	go b.loop()
+	return nil
+}
+
+// onConnect runs on every (re)connection: announces the entities, subscribes
+// to the commands and publishes the state
+func (b *mqttBridgeT) onConnect(c paho.Client) {
+	log.Println("MQTT connected to", data.MQTTBroker)
+	if data.MQTTDiscoveryPrefix != "" {
+		b.announce()
+	}
+	b.publish(b.t("availability"), []byte("online"))
+	commands := map[string]paho.MessageHandler{
+		b.t("target/set"):     b.onTarget,
+		b.t("mode/set"):       b.onMode,
+		b.t("power/set"):      b.onPower,
+		b.t("hysteresis/set"): b.onHysteresis,
+	}
+	for topic, handler := range commands {
+		if token := c.Subscribe(topic, 1, handler); !token.WaitTimeout(mqttTimeout) || token.Error() != nil {
+			log.Println("MQTT error subscribing to", topic, token.Error())
+		}
+	}
+	b.mu.Lock()
+	b.published = nil // Publish it again, the broker may have lost it
+	b.mu.Unlock()
+	b.publishState(true)
+}
+
+func (b *mqttBridgeT) publish(topic string, payload []byte) bool {
+	token := b.client.Publish(topic, 1, true, payload)
+	if !token.WaitTimeout(mqttTimeout) {
+		log.Println("MQTT timeout publishing to", topic)
+		return false
+	}
+	if token.Error() != nil {
+		log.Println("MQTT error publishing to", topic, token.Error())
+		return false
+	}
+	return true
+}
+
+func (b *mqttBridgeT) loop() {
+	for {
+		time.Sleep(mqttCheckInterval)
+		if b.client.IsConnectionOpen() {
+			b.publishState(false)
+		}
+	}
+}
+
+// publishState publishes the state if it changed, rereading the oil every
+// data.MQTTInterval (or now if forced). The state is built with the lock held
+// and published without it, so a slow broker does not hold up the commands
+func (b *mqttBridgeT) publishState(force bool) {
+	now := time.Now()
+	b.mu.Lock()
+	if force || now.Sub(b.oilRead) >= data.MQTTInterval {
+		b.oil, b.oilDaily = nil, nil
+		if last, average, ok := data.ReadOil(); ok {
+			average = math.Round(average*100) / 100
+			b.oil, b.oilDaily = &last.Liters, &average
+		}
+		b.oilRead = now
+	}
+	raw, err := json.Marshal(mqttState(ctl.Snapshot(), now, b.oil, b.oilDaily))
+	if err != nil {
+		b.mu.Unlock()
+		log.Println("MQTT error encoding the state:", err)
+		return
+	}
+	if bytes.Equal(raw, b.published) {
+		b.mu.Unlock()
+		return
+	}
+	b.published = raw
+	b.built++
+	built := b.built
+	b.mu.Unlock()
+
+	ok := b.publish(b.t("state"), raw)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// If it was lost, or got to the broker after a newer state, the broker
+	// does not have the last state: publish it again on the next check
+	if !ok || built < b.sent {
+		b.published = nil
+	}
+	if ok && built > b.sent {
+		b.sent = built
+	}
+}
+
+// command makes the change as the MQTT user and publishes the new state
+func (b *mqttBridgeT) command(msg paho.Message, action string, f func(payload string) error) {
+	payload := strings.TrimSpace(string(msg.Payload()))
+	actor := data.ActorT{Name: data.MQTTUsername, Source: data.SourceMQTT, IP: data.MQTTBroker}
+	if actor.Name == "" {
+		actor.Name = data.MQTTClientID
+	}
+	err := ctl.Change(actor, action, func() error { return f(payload) })
+	if err != nil {
+		log.Println("MQTT command", msg.Topic(), payload, "failed:", err)
+		return
+	}
+	log.Println("MQTT command", msg.Topic(), payload)
+	b.publishState(false)
+}
+
+var errMQTTPayload = fmt.Errorf("%w: wrong payload", data.ErrInvalid)
+
+func parseOnOff(payload string) (bool, error) {
+	switch strings.ToUpper(payload) {
+	case "ON", "1", "TRUE":
+		return true, nil
+	case "OFF", "0", "FALSE":
+		return false, nil
+	}
+	return false, errMQTTPayload
+}
+
+func (b *mqttBridgeT) onTarget(_ paho.Client, msg paho.Message) {
+	b.command(msg, "target", func(payload string) error {
+		target, err := strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return errMQTTPayload
+		}
+		return ctl.SetTarget(target, time.Now())
+	})
+}
+
+func (b *mqttBridgeT) onHysteresis(_ paho.Client, msg paho.Message) {
+	b.command(msg, "hysteresis", func(payload string) error {
+		hysteresis, err := strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return errMQTTPayload
+		}
+		return ctl.SetHysteresis(hysteresis)
+	})
+}
+
+// onMode takes the Home Assistant modes: heat runs the thermostat, off pauses
+// it and stops the heat
+func (b *mqttBridgeT) onMode(_ paho.Client, msg paho.Message) {
+	b.command(msg, "thermostat", func(payload string) error {
+		switch payload {
+		case "heat":
+			return ctl.SetThermostat(true, false)
+		case "off":
+			return ctl.SetThermostat(false, true)
+		}
+		return errMQTTPayload
+	})
+}
+
+func (b *mqttBridgeT) onPower(_ paho.Client, msg paho.Message) {
+	b.command(msg, "power", func(payload string) error {
+		on, err := parseOnOff(payload)
+		if err != nil {
+			return err
+		}
+		return ctl.SetPower(on)
+	})
+}
+
+// announce publishes the Home Assistant discovery configs
+func (b *mqttBridgeT) announce() {
+	node := strings.NewReplacer("/", "_", " ", "_").Replace(b.topic)
+	device := map[string]interface{}{
+		"identifiers":  []string{node},
+		"name":         "Caldera",
+		"manufacturer": "juliofaura",
+		"model":        "caldera",
+	}
+	common := func(name, id string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":               name,
+			"unique_id":          node + "_" + id,
+			"device":             device,
+			"availability_topic": b.t("availability"),
+		}
+	}
+	value := func(field string) string { return "{{ value_json." + field + " }}" }
+
+	climate := common("Termostato", "thermostat")
+	climate["modes"] = []string{"off", "heat"}
+	climate["mode_state_topic"] = b.t("state")
+	climate["mode_state_template"] = value("mode")
+	climate["mode_command_topic"] = b.t("mode/set")
+	climate["current_temperature_topic"] = b.t("state")
+	climate["current_temperature_template"] = value("temperature")
+	climate["temperature_state_topic"] = b.t("state")
+	climate["temperature_state_template"] = value("target")
+	climate["temperature_command_topic"] = b.t("target/set")
+	climate["action_topic"] = b.t("state")
+	climate["action_template"] = value("action")
+	climate["min_temp"] = data.MinTemp
+	climate["max_temp"] = 35
+	climate["temp_step"] = 0.5
+	climate["precision"] = 0.1
+	climate["temperature_unit"] = "C"
+
+	power := common("Caldera", "power")
+	power["state_topic"] = b.t("state")
+	power["value_template"] = value("power")
+	power["command_topic"] = b.t("power/set")
+
+	burner := common("Quemador", "burner")
+	burner["state_topic"] = b.t("state")
+	burner["value_template"] = value("heat_read")
+	burner["device_class"] = "heat"
+
+	oil := common("Gasóleo", "oil")
+	oil["state_topic"] = b.t("state")
+	oil["value_template"] = value("oil_liters")
+	oil["unit_of_measurement"] = "L"
+	oil["device_class"] = "volume_storage"
+	oil["state_class"] = "measurement"
+
+	oilDaily := common("Consumo de gasóleo", "oil_daily")
+	oilDaily["state_topic"] = b.t("state")
+	oilDaily["value_template"] = value("oil_daily")
+	oilDaily["unit_of_measurement"] = "L/d"
+	oilDaily["state_class"] = "measurement"
+
+	configs := map[string]map[string]interface{}{
+		"climate/" + node + "/thermostat":   climate,
+		"switch/" + node + "/power":         power,
+		"binary_sensor/" + node + "/burner": burner,
+		"sensor/" + node + "/oil":           oil,
+		"sensor/" + node + "/oil_daily":     oilDaily,
+	}
+	for topic, config := range configs {
+		raw, err := json.Marshal(config)
+		if err != nil {
+			log.Println("MQTT error encoding the discovery of", topic, err)
+			continue
+		}
+		b.publish(data.MQTTDiscoveryPrefix+"/"+topic+"/config", raw)
+	}
+}
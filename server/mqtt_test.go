@@ -0,0 +1,282 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/juliofaura/caldera/data"
+	"github.com/juliofaura/oilmeter/files"
+)
+
+// fakeToken is an MQTT token already done
+type fakeToken struct{ err error }
+
+func (fakeToken) Wait() bool                     { return true }
+func (fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (t fakeToken) Error() error { return t.err }
+
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 1 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+// fakeClient keeps what is published (the last payload of each topic, as a
+// retained message) and the subscriptions. The publishing waits for hold (if
+// set), and fails if fail is set. The rest of paho.Client is left out,
+// calling it panics
+type fakeClient struct {
+	paho.Client
+
+	mu        sync.Mutex
+	published map[string][]byte
+	count     map[string]int
+	handlers  map[string]paho.MessageHandler
+	hold      chan struct{}
+	fail      bool
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{published: map[string][]byte{}, count: map[string]int{}, handlers: map[string]paho.MessageHandler{}}
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	c.mu.Lock()
+	hold := c.hold
+	c.mu.Unlock()
+	if hold != nil {
+		<-hold
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fail {
+		return fakeToken{errors.New("connection lost")}
+	}
+	c.published[topic] = payload.([]byte)
+	c.count[topic]++
+	return fakeToken{}
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, handler paho.MessageHandler) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[topic] = handler
+	return fakeToken{}
+}
+
+func (c *fakeClient) IsConnectionOpen() bool { return true }
+
+// send delivers a command as the broker would
+func (c *fakeClient) send(t *testing.T, topic, payload string) {
+	t.Helper()
+	c.mu.Lock()
+	handler, ok := c.handlers[topic]
+	c.mu.Unlock()
+	if !ok {
+		t.Fatalf("no subscription to %v", topic)
+	}
+	handler(c, fakeMessage{topic, []byte(payload)})
+}
+
+func (c *fakeClient) state(t *testing.T) mqttStateT {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var state mqttStateT
+	if err := json.Unmarshal(c.published["caldera/state"], &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func (c *fakeClient) publishedCount(topic string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count[topic]
+}
+
+func newTestBridge(t *testing.T) (*mqttBridgeT, *fakeClient) {
+	t.Helper()
+	dir := t.TempDir()
+	configFile, dataFile := data.ConfigFileName, files.DataFile
+	data.ConfigFileName = filepath.Join(dir, "config.json")
+	files.DataFile = filepath.Join(dir, "missing.csv")
+	t.Cleanup(func() { data.ConfigFileName, files.DataFile = configFile, dataFile })
+	data.OpenSimulated()
+	ctl = data.NewController()
+
+	c := newFakeClient()
+	b := &mqttBridgeT{client: c, topic: "caldera"}
+	b.onConnect(c)
+	return b, c
+}
+
+func TestMQTTDiscovery(t *testing.T) {
+	_, c := newTestBridge(t)
+	if got := string(c.published["caldera/availability"]); got != "online" {
+		t.Errorf("availability %q", got)
+	}
+	tests := []struct {
+		topic  string
+		fields map[string]interface{}
+	}{
+		{"homeassistant/climate/caldera/thermostat/config", map[string]interface{}{
+			"unique_id":                 "caldera_thermostat",
+			"mode_command_topic":        "caldera/mode/set",
+			"temperature_command_topic": "caldera/target/set",
+			"current_temperature_topic": "caldera/state",
+			"action_template":           "{{ value_json.action }}",
+			"availability_topic":        "caldera/availability",
+		}},
+		{"homeassistant/switch/caldera/power/config", map[string]interface{}{
+			"unique_id":      "caldera_power",
+			"command_topic":  "caldera/power/set",
+			"value_template": "{{ value_json.power }}",
+		}},
+		{"homeassistant/binary_sensor/caldera/burner/config", map[string]interface{}{
+			"value_template": "{{ value_json.heat_read }}",
+			"device_class":   "heat",
+		}},
+		{"homeassistant/sensor/caldera/oil/config", map[string]interface{}{
+			"unit_of_measurement": "L",
+		}},
+		{"homeassistant/sensor/caldera/oil_daily/config", map[string]interface{}{
+			"unit_of_measurement": "L/d",
+		}},
+	}
+	for _, tt := range tests {
+		raw, ok := c.published[tt.topic]
+		if !ok {
+			t.Errorf("%v not published", tt.topic)
+			continue
+		}
+		var config map[string]interface{}
+		if err := json.Unmarshal(raw, &config); err != nil {
+			t.Errorf("%v: %v", tt.topic, err)
+			continue
+		}
+		for k, want := range tt.fields {
+			if config[k] != want {
+				t.Errorf("%v: %v is %v, want %v", tt.topic, k, config[k], want)
+			}
+		}
+		if device, _ := config["device"].(map[string]interface{}); device["name"] != "Caldera" {
+			t.Errorf("%v: device %v", tt.topic, config["device"])
+		}
+	}
+}
+
+func TestMQTTCommands(t *testing.T) {
+	_, c := newTestBridge(t)
+	state := c.state(t)
+	if state.Target != 21 || state.Mode != "heat" || state.Power != "ON" || state.Temperature != nil || state.OilLiters != nil {
+		t.Errorf("first state %+v", state)
+	}
+
+	c.send(t, "caldera/target/set", "19.5")
+	if state := c.state(t); state.Target != 19.5 || state.EffectiveTarget != 19.5 {
+		t.Errorf("target not published: %+v", state)
+	}
+	c.send(t, "caldera/hysteresis/set", "0.3")
+	if state := c.state(t); state.Hysteresis != 0.3 {
+		t.Errorf("hysteresis not published: %+v", state)
+	}
+	c.send(t, "caldera/mode/set", "off")
+	if state := c.state(t); state.Mode != "off" || state.Thermostat != "OFF" || state.Heat != "OFF" {
+		t.Errorf("mode off not published: %+v", state)
+	}
+	c.send(t, "caldera/power/set", "off")
+	if state := c.state(t); state.Power != "OFF" {
+		t.Errorf("power off not published: %+v", state)
+	}
+	if st := ctl.Snapshot(); st.TargetTemp != 19.5 || st.Hysteresis != 0.3 || st.ThermostatOn || st.PowerOn {
+		t.Errorf("controller not changed: %+v", st)
+	}
+
+	// Wrong commands change nothing, so the state is not published again
+	published := c.publishedCount("caldera/state")
+	for _, command := range [][2]string{
+		{"caldera/target/set", "mucho"},
+		{"caldera/target/set", "99"},
+		{"caldera/hysteresis/set", "-1"},
+		{"caldera/mode/set", "cool"},
+		{"caldera/power/set", "maybe"},
+	} {
+		c.send(t, command[0], command[1])
+	}
+	if got := c.publishedCount("caldera/state"); got != published {
+		t.Errorf("state published %v times on wrong commands", got-published)
+	}
+	if st := ctl.Snapshot(); st.TargetTemp != 19.5 || st.Hysteresis != 0.3 {
+		t.Errorf("wrong commands changed the controller: %+v", st)
+	}
+}
+
+// TestMQTTPublishUnlocked checks that the state is published without the
+// lock held, and published again if it was lost
+func TestMQTTPublishUnlocked(t *testing.T) {
+	b, c := newTestBridge(t)
+	c.mu.Lock()
+	c.hold = make(chan struct{})
+	c.mu.Unlock()
+	if err := ctl.SetHysteresis(0.4); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		b.publishState(false)
+		close(done)
+	}()
+	// While the broker is slow the bridge is free, and the same state is not
+	// published twice
+	for built := 0; built < 2; time.Sleep(time.Millisecond) {
+		b.mu.Lock()
+		built = b.built // The first one was on connecting
+		b.mu.Unlock()
+	}
+	if !b.mu.TryLock() {
+		t.Fatal("the lock is held while publishing")
+	}
+	b.mu.Unlock()
+	b.publishState(false)
+	close(c.hold)
+	<-done
+	if got := c.publishedCount("caldera/state"); got != 2 {
+		t.Errorf("state published %v times, want 2", got)
+	}
+	if state := c.state(t); state.Hysteresis != 0.4 {
+		t.Errorf("hysteresis not published: %+v", state)
+	}
+
+	c.mu.Lock()
+	c.hold, c.fail = nil, true
+	c.mu.Unlock()
+	if err := ctl.SetHysteresis(0.6); err != nil {
+		t.Fatal(err)
+	}
+	b.publishState(false)
+	c.mu.Lock()
+	c.fail = false
+	c.mu.Unlock()
+	b.publishState(false)
+	if state := c.state(t); state.Hysteresis != 0.6 {
+		t.Errorf("lost state not published again: %+v", state)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/juliofaura/caldera/data"
+)
+
+// sessionKeysT sign (Hash) and encrypt (Block) the session cookies
+type sessionKeysT struct {
+	Hash  []byte `json:"hash"`
+	Block []byte `json:"block"`
+}
+
+// sessionKeys reads the session keys, generating them on the first run. They
+// must be secret: with them anyone can forge a session as any user
+func sessionKeys(name string) (sessionKeysT, error) {
+	var keys sessionKeysT
+	raw, err := os.ReadFile(name)
+	if err == nil {
+		if err := json.Unmarshal(raw, &keys); err != nil {
+			return keys, fmt.Errorf("%v: %w", name, err)
+		}
+		if len(keys.Hash) != 64 || len(keys.Block) != 32 {
+			return keys, errors.New(name + ": wrong key lengths, remove it to generate new keys")
+		}
+		return keys, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return keys, err
+	}
+	keys.Hash, keys.Block = make([]byte, 64), make([]byte, 32)
+	if _, err := rand.Read(keys.Hash); err != nil {
+		return keys, err
+	}
+	if _, err := rand.Read(keys.Block); err != nil {
+		return keys, err
+	}
+	raw, err = json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return keys, err
+	}
+	if err := data.WriteFileAtomic(name, append(raw, '\n'), 0600); err != nil {
+		return keys, err
+	}
+	log.Println("Generated new session keys in", name, "(everybody has to log in again)")
+	return keys, nil
+}
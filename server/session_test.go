@@ -0,0 +1,38 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSessionKeys(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "keys.json")
+	keys, err := sessionKeys(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.Hash) != 64 || len(keys.Block) != 32 {
+		t.Errorf("generated keys of %v and %v bytes, want 64 and 32", len(keys.Hash), len(keys.Block))
+	}
+	if info, err := os.Stat(name); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("keys file %v (%v), want private", info.Mode().Perm(), err)
+	}
+
+	// The same keys after a restart
+	again, err := sessionKeys(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Hash, keys.Hash) || !bytes.Equal(again.Block, keys.Block) {
+		t.Error("the keys read back differ")
+	}
+
+	if err := os.WriteFile(name, []byte(`{"hash": "c2hvcnQ=", "block": "c2hvcnQ="}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessionKeys(name); err == nil {
+		t.Error("short keys did not fail")
+	}
+}